@@ -0,0 +1,438 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// Prefix of a checkpoint location which is a local file, e.g. "file:/var/lib/sks-lifecycler/checkpoint.json"
+	checkpointSchemeFile string = "file:"
+	// Prefix of a checkpoint location which is a ConfigMap in the cluster, e.g. "configmap:kube-system/sks-lifecycler"
+	checkpointSchemeConfigMap string = "configmap:"
+
+	// Key of the checkpoint in the data of its ConfigMap
+	checkpointConfigMapKey string = "checkpoint.json"
+)
+
+// checkpoint is the persisted state of a run, so a run which has been killed can be resumed
+type checkpoint struct {
+	ClusterId      string `json:"clusterId"`
+	RunId          string `json:"runId,omitempty"`
+	DesiredVersion string `json:"desiredVersion"`
+	// Selected nodes, in the order they are replaced
+	Nodes []checkpointNode `json:"nodes"`
+	// Surge nodes per nodepool, which have not yet been compensated by evicting an old node
+	SurgeCredit map[string]int `json:"surgeCredit,omitempty"`
+	// IDs of the surge instances per nodepool which the run has created, so a resumed run can still roll them back
+	SurgeInstances map[string][]string `json:"surgeInstances,omitempty"`
+	// Steps of the nodes which are being replaced, in the order they were started
+	Steps []checkpointStep `json:"steps,omitempty"`
+	// The node which was being replaced, in checkpoints of versions which replaced one node at a time
+	Current   *checkpointStep `json:"current,omitempty"`
+	UpdatedAt time.Time       `json:"updatedAt"`
+}
+
+type checkpointNode struct {
+	Name       string `json:"name"`
+	NodepoolId string `json:"nodepoolId,omitempty"`
+	InstanceId string `json:"instanceId"`
+	// Status of the node once it has been handled, see nodeResult
+	Status string `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// checkpointStep is the phase the replacement of a node is in
+type checkpointStep struct {
+	Node  string `json:"node"`
+	Phase string `json:"phase"`
+	// Size the nodepool is scaled to and the number of surge nodes this adds, in the surge phase
+	SurgeSize  int64 `json:"surgeSize,omitempty"`
+	SurgeNodes int   `json:"surgeNodes,omitempty"`
+	// Instance which is being evicted from its nodepool, in the sks-evict phase
+	PendingSksEviction string `json:"pendingSksEviction,omitempty"`
+}
+
+// checkpointStore persists the checkpoint of a run
+type checkpointStore interface {
+	// Load the checkpoint, or nil if there is none
+	Load(ctx context.Context) (*checkpoint, error)
+	Save(ctx context.Context, cp *checkpoint) error
+	Clear(ctx context.Context) error
+}
+
+// Create the checkpoint store for a location like "file:<path>" or "configmap:<namespace>/<name>".
+// An empty location disables checkpoints and returns nil.
+func newCheckpointStore(location string, clientset kubernetes.Interface) (checkpointStore, error) {
+	switch {
+	case location == "":
+		return nil, nil
+	case strings.HasPrefix(location, checkpointSchemeFile):
+		path := strings.TrimPrefix(location, checkpointSchemeFile)
+		if path == "" {
+			return nil, configError("invalid checkpoint location '%s', expected a file path", location)
+		}
+		return &fileCheckpointStore{path: path}, nil
+	case strings.HasPrefix(location, checkpointSchemeConfigMap):
+		namespace, name, found := strings.Cut(strings.TrimPrefix(location, checkpointSchemeConfigMap), "/")
+		if !found || namespace == "" || name == "" {
+			return nil, configError("invalid checkpoint location '%s', expected '%s<namespace>/<name>'", location, checkpointSchemeConfigMap)
+		}
+		return &configMapCheckpointStore{clientset: clientset, namespace: namespace, name: name}, nil
+	default:
+		return nil, configError("invalid checkpoint location '%s', expected '%s<path>' or '%s<namespace>/<name>'", location, checkpointSchemeFile, checkpointSchemeConfigMap)
+	}
+}
+
+// fileCheckpointStore keeps the checkpoint in a local file
+type fileCheckpointStore struct {
+	path string
+}
+
+func (s *fileCheckpointStore) Load(ctx context.Context) (*checkpoint, error) {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeCheckpoint(data)
+}
+
+func (s *fileCheckpointStore) Save(ctx context.Context, cp *checkpoint) error {
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Replace the file at once, so a killed process never leaves a partially written checkpoint behind
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+func (s *fileCheckpointStore) Clear(ctx context.Context) error {
+	if err := os.Remove(s.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// configMapCheckpointStore keeps the checkpoint in a ConfigMap, so it survives the container of the run
+type configMapCheckpointStore struct {
+	clientset kubernetes.Interface
+	namespace string
+	name      string
+}
+
+func (s *configMapCheckpointStore) Load(ctx context.Context) (*checkpoint, error) {
+	configMap, err := s.clientset.CoreV1().ConfigMaps(s.namespace).Get(ctx, s.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, kubernetesError(err)
+	}
+
+	data, ok := configMap.Data[checkpointConfigMapKey]
+	if !ok {
+		return nil, nil
+	}
+	return decodeCheckpoint([]byte(data))
+}
+
+func (s *configMapCheckpointStore) Save(ctx context.Context, cp *checkpoint) error {
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	configMap, err := s.clientset.CoreV1().ConfigMaps(s.namespace).Get(ctx, s.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = s.clientset.CoreV1().ConfigMaps(s.namespace).Create(ctx, &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: s.namespace, Name: s.name},
+			Data:       map[string]string{checkpointConfigMapKey: string(data)},
+		}, metav1.CreateOptions{})
+		return kubernetesError(err)
+	}
+	if err != nil {
+		return kubernetesError(err)
+	}
+
+	if configMap.Data == nil {
+		configMap.Data = make(map[string]string)
+	}
+	configMap.Data[checkpointConfigMapKey] = string(data)
+	_, err = s.clientset.CoreV1().ConfigMaps(s.namespace).Update(ctx, configMap, metav1.UpdateOptions{})
+	return kubernetesError(err)
+}
+
+func (s *configMapCheckpointStore) Clear(ctx context.Context) error {
+	err := s.clientset.CoreV1().ConfigMaps(s.namespace).Delete(ctx, s.name, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return kubernetesError(err)
+	}
+	return nil
+}
+
+func decodeCheckpoint(data []byte) (*checkpoint, error) {
+	cp := &checkpoint{}
+	if err := json.Unmarshal(data, cp); err != nil {
+		return nil, configError("invalid checkpoint: %w", err)
+	}
+	return cp, nil
+}
+
+// checkpointer keeps the checkpoint of a run up to date and persists it after every step. Without a store, the
+// checkpoint is only kept in memory. It is safe for concurrent use.
+type checkpointer struct {
+	store checkpointStore
+	mu    sync.Mutex
+	state *checkpoint
+}
+
+// Record the statuses of the nodes which have been handled, the surge credit and the step a node is in, and persist
+// the checkpoint. Without a step, the steps of the nodes in progress are kept. A failure to persist it is logged,
+// but does not stop the run.
+func (c *checkpointer) step(ctx context.Context, result *cycleResult, surgeCredit *surgeCredit, current *checkpointStep) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if current != nil {
+		c.state.Steps = slices.DeleteFunc(c.state.Steps, func(step checkpointStep) bool { return step.Node == current.Node })
+		c.state.Steps = append(c.state.Steps, *current)
+	}
+	c.save(ctx, result, surgeCredit)
+}
+
+// Remove the step of a node which has been handled and persist the checkpoint
+func (c *checkpointer) done(ctx context.Context, result *cycleResult, surgeCredit *surgeCredit, node string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.state.Steps = slices.DeleteFunc(c.state.Steps, func(step checkpointStep) bool { return step.Node == node })
+	c.save(ctx, result, surgeCredit)
+}
+
+func (c *checkpointer) save(ctx context.Context, result *cycleResult, surgeCredit *surgeCredit) {
+	for _, nodeResult := range result.handled() {
+		for i := range c.state.Nodes {
+			if c.state.Nodes[i].Name != nodeResult.Node {
+				continue
+			}
+			c.state.Nodes[i].Status = nodeResult.Status
+			c.state.Nodes[i].Error = ""
+			if nodeResult.Err != nil {
+				c.state.Nodes[i].Error = nodeResult.Err.Error()
+			}
+		}
+	}
+	c.state.SurgeCredit, c.state.SurgeInstances = surgeCredit.snapshot()
+	c.state.Current = nil
+	c.state.UpdatedAt = time.Now().UTC()
+
+	if c.store == nil {
+		return
+	}
+	// The checkpoint is also written once the run has been stopped, that is what it is there for
+	saveCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+	defer cancel()
+	if err := c.store.Save(saveCtx, c.state); err != nil {
+		loggerFrom(ctx).Error("Error while saving checkpoint", logKeyError, err)
+	}
+}
+
+// Remove the checkpoint once the run has completed, so it cannot be resumed anymore
+func (c *checkpointer) clear(ctx context.Context) {
+	if c.store == nil {
+		return
+	}
+	if err := c.store.Clear(ctx); err != nil {
+		loggerFrom(ctx).Error("Error while removing checkpoint", logKeyError, err)
+		return
+	}
+	loggerFrom(ctx).Debug("Checkpoint removed")
+}
+
+// Create the checkpoint of a new run. A checkpoint of an unfinished run is never overwritten, it has to be resumed.
+func newCheckpoint(ctx context.Context, store checkpointStore, clusterId string, runId string, desiredVersion string, nodes []corev1.Node) (*checkpointer, error) {
+	if store != nil {
+		existing, err := store.Load(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if existing != nil {
+			return nil, configError("a checkpoint of an unfinished run from %s exists, continue it with --resume", existing.UpdatedAt.Format(time.RFC3339))
+		}
+	}
+
+	cp := &checkpoint{ClusterId: clusterId, RunId: runId, DesiredVersion: desiredVersion}
+	for _, node := range nodes {
+		sksNodepoolId, _ := getNodepoolId(node)
+		cp.Nodes = append(cp.Nodes, checkpointNode{
+			Name:       node.Name,
+			NodepoolId: sksNodepoolId,
+			InstanceId: node.Status.NodeInfo.SystemUUID,
+		})
+	}
+
+	return &checkpointer{store: store, state: cp}, nil
+}
+
+// Load the checkpoint of an unfinished run and reconcile it against the live state of the cluster and its nodepools.
+// Nodes which have been handled are recorded in the result, the nodes which still have to be replaced are returned
+// in their original order, together with the surge credit of the run.
+func resumeCheckpoint(ctx context.Context, store checkpointStore, clientset kubernetes.Interface, provider SKSProvider, clusterId string, result *cycleResult) (*checkpointer, []corev1.Node, map[string]int, error) {
+	if store == nil {
+		return nil, nil, nil, configError("resuming a run requires a checkpoint location")
+	}
+	cp, err := store.Load(ctx)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if cp == nil {
+		return nil, nil, nil, configError("there is no checkpoint to resume from")
+	}
+	if cp.ClusterId != clusterId {
+		return nil, nil, nil, configError("the checkpoint belongs to cluster '%s', not '%s'", cp.ClusterId, clusterId)
+	}
+	loggerFrom(ctx).Info("Resuming run from checkpoint", "desired", cp.DesiredVersion, "updated_at", cp.UpdatedAt.Format(time.RFC3339))
+
+	// A resumed run keeps its ID, checkpoints of older versions do not have one. It is known before nodes are
+	// recorded, so their notifications carry it.
+	if cp.RunId == "" {
+		cp.RunId = string(uuid.NewUUID())
+	}
+	result.RunId, result.TargetVersion = cp.RunId, cp.DesiredVersion
+
+	surgeCredit := make(map[string]int)
+	for sksNodepoolId, credit := range cp.SurgeCredit {
+		surgeCredit[sksNodepoolId] = credit
+	}
+
+	steps := cp.Steps
+	if cp.Current != nil {
+		steps = append(steps, *cp.Current)
+	}
+	for _, current := range steps {
+		if err := reconcileCheckpointStep(ctx, provider, cp, &current, surgeCredit); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	cp.Steps, cp.Current = nil, nil
+
+	liveNodes, err := clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, nil, nil, kubernetesError(err)
+	}
+	live := make(map[string]corev1.Node)
+	for _, node := range liveNodes.Items {
+		live[node.Name] = node
+	}
+
+	var remaining []corev1.Node
+	for i, cpNode := range cp.Nodes {
+		node, exists := live[cpNode.Name]
+		if !exists {
+			node = corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: cpNode.Name}}
+		}
+
+		// Nodes which were interrupted are replaced again
+		if cpNode.Status != "" && cpNode.Status != nodeStatusInterrupted {
+			var nodeErr error
+			if cpNode.Error != "" {
+				nodeErr = errors.New(cpNode.Error)
+			}
+			// Nodes of the previous run have been counted in the metrics already
+			result.Nodes = append(result.Nodes, nodeResult{Node: cpNode.Name, NodepoolId: cpNode.NodepoolId, Status: cpNode.Status, Err: nodeErr})
+			continue
+		}
+		if !exists {
+			loggerFrom(ctx).Info("Node of the checkpoint does not exist anymore, it has been replaced", logKeyNode, cpNode.Name)
+			cp.Nodes[i].Status = nodeStatusReplaced
+			result.record(node, cpNode.NodepoolId, nodeStatusReplaced, nil)
+			continue
+		}
+		cp.Nodes[i].Status = ""
+		remaining = append(remaining, node)
+	}
+
+	return &checkpointer{store: store, state: cp}, remaining, surgeCredit, nil
+}
+
+// Find out how far the step of a node which was in progress got, from the state of its nodepool
+func reconcileCheckpointStep(ctx context.Context, provider SKSProvider, cp *checkpoint, current *checkpointStep, surgeCredit map[string]int) error {
+	var cpNode *checkpointNode
+	for i := range cp.Nodes {
+		if cp.Nodes[i].Name == current.Node {
+			cpNode = &cp.Nodes[i]
+		}
+	}
+	if cpNode == nil || cpNode.NodepoolId == "" {
+		return nil
+	}
+	log := loggerFrom(ctx).With(logKeyNode, current.Node, logKeyNodepool, cpNode.NodepoolId, logKeyPhase, current.Phase)
+
+	sksNodepool, err := provider.GetNodepool(ctx, cpNode.NodepoolId)
+	if err != nil {
+		return exoscaleError(err)
+	}
+
+	// The node is replaced again, unless it turns out to have left its nodepool already
+	cpNode.Status = ""
+
+	switch current.Phase {
+	case phaseSurge:
+		// The scale-up is only requested again, if it has not reached the nodepool
+		if sksNodepool.Size != nil && *sksNodepool.Size >= current.SurgeSize {
+			log.Info("Nodepool has already been scaled up", "size", *sksNodepool.Size)
+			surgeCredit[cpNode.NodepoolId] += current.SurgeNodes
+		}
+
+	case phaseSksEvict:
+		instances, err := provider.ListNodepoolInstances(ctx, sksNodepool)
+		if err != nil {
+			return exoscaleError(err)
+		}
+		for _, instance := range instances {
+			if instance.ID != nil && *instance.ID == current.PendingSksEviction {
+				log.Info("Pending eviction from the nodepool has not happened, the node is replaced again")
+				return nil
+			}
+		}
+		log.Info("Pending eviction from the nodepool has completed")
+		cpNode.Status = nodeStatusReplaced
+		if surgeCredit[cpNode.NodepoolId] > 0 {
+			surgeCredit[cpNode.NodepoolId] -= 1
+		}
+
+	default:
+		log.Info("Replacement of node was stopped, it is replaced again")
+	}
+
+	return nil
+}
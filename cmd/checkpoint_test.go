@@ -0,0 +1,137 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestRunCycleResumesInterruptedRun(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	clientset := fake.NewSimpleClientset()
+	provider := newFakeSKSProvider(clientset, "1.29.3")
+	provider.addNodepool("np-1", "workers", "v1.28.7", 2)
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "standalone", Namespace: "default"},
+		Spec:       corev1.PodSpec{NodeName: "pool-workers-1"},
+		Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+	if _, err := clientset.CoreV1().Pods("default").Create(ctx, pod, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first run is stopped while the first node is being drained, later evictions succeed
+	interrupted := false
+	clientset.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "eviction" {
+			return false, nil, nil
+		}
+		if !interrupted {
+			interrupted = true
+			cancel()
+			return true, nil, disruptionBudgetError()
+		}
+		return true, nil, clientset.Tracker().Delete(corev1.SchemeGroupVersion.WithResource("pods"), "default", "standalone")
+	})
+
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	opts := testCycleOptions()
+	opts.evictionTimeout = time.Minute
+	opts.checkpoint = checkpointSchemeFile + path
+
+	_, err := runCycle(ctx, clientset, provider, opts)
+	if code := exitCode(err); code != exitCodeInterrupted {
+		t.Fatalf("exit code = %d, want %d (error %v)", code, exitCodeInterrupted, err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("checkpoint was not kept: %v", err)
+	}
+
+	// A new run must not start over an unfinished one
+	if _, err := runCycle(context.Background(), clientset, provider, opts); exitCode(err) != exitCodeConfig {
+		t.Errorf("run without --resume error = %v, want a configuration error", err)
+	}
+
+	opts.resume = true
+	result, err := runCycle(context.Background(), clientset, provider, opts)
+	if err != nil {
+		t.Fatalf("resumed runCycle() error = %v", err)
+	}
+	if err := result.err(); err != nil {
+		t.Errorf("result error = %v, want nil", err)
+	}
+	if len(result.Nodes) != 2 {
+		t.Fatalf("results = %+v, want 2 nodes", result.Nodes)
+	}
+	for _, nodeResult := range result.Nodes {
+		if nodeResult.Status != nodeStatusReplaced {
+			t.Errorf("node %s status = %s, want %s", nodeResult.Node, nodeResult.Status, nodeStatusReplaced)
+		}
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("checkpoint of the completed run was not removed: %v", err)
+	}
+}
+
+func TestResumeReconcilesPendingSksEviction(t *testing.T) {
+	ctx := context.Background()
+	clientset := fake.NewSimpleClientset()
+	provider := newFakeSKSProvider(clientset, "1.29.3")
+	provider.addNodepool("np-1", "workers", "v1.28.7", 2)
+
+	nodes, err := clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp := &checkpoint{ClusterId: provider.sksClusterId, DesiredVersion: "v1.29.3"}
+	for _, node := range nodes.Items {
+		cp.Nodes = append(cp.Nodes, checkpointNode{Name: node.Name, NodepoolId: "np-1", InstanceId: node.Status.NodeInfo.SystemUUID})
+	}
+	cp.Current = &checkpointStep{Node: cp.Nodes[0].Name, Phase: phaseSksEvict, PendingSksEviction: cp.Nodes[0].InstanceId}
+
+	// The run was killed after the eviction from the nodepool had been requested
+	sksNodepool, err := provider.GetNodepool(ctx, "np-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := provider.EvictNodepoolMembers(ctx, sksNodepool, []string{cp.Nodes[0].InstanceId}); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := newCheckpointStore("configmap:kube-system/sks-lifecycler", clientset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(ctx, cp); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := testCycleOptions()
+	opts.checkpoint = "configmap:kube-system/sks-lifecycler"
+	opts.resume = true
+	result, err := runCycle(ctx, clientset, provider, opts)
+	if err != nil {
+		t.Fatalf("runCycle() error = %v", err)
+	}
+	if len(result.Nodes) != 2 || result.Nodes[0].Status != nodeStatusReplaced || result.Nodes[1].Status != nodeStatusReplaced {
+		t.Errorf("results = %+v, want both nodes replaced", result.Nodes)
+	}
+	// One eviction from the test itself, one for the second node
+	if evictions := provider.callCount("EvictNodepoolMembers"); evictions != 2 {
+		t.Errorf("nodepool evictions = %d, want 2", evictions)
+	}
+	if loaded, err := store.Load(ctx); err != nil || loaded != nil {
+		t.Errorf("checkpoint = %+v (error %v), want it to be removed", loaded, err)
+	}
+}
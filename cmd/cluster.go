@@ -0,0 +1,15 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// clusterCmd represents the cluster command
+var clusterCmd = &cobra.Command{
+	Use:   "cluster",
+	Short: "Manage the SKS cluster control plane.",
+}
+
+func init() {
+	rootCmd.AddCommand(clusterCmd)
+}
@@ -0,0 +1,321 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+	// The container image has no time zone database, it is embedded for the time zone of the schedule
+	_ "time/tzdata"
+
+	"github.com/robfig/cron/v3"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"k8s.io/client-go/kubernetes"
+)
+
+// controllerCmd represents the controller command
+var controllerCmd = &cobra.Command{
+	Use:   "controller",
+	Short: "Keep replacing nodes on a schedule, within maintenance windows.",
+	Long: `Run as a long-lived controller, e.g. as a Deployment in the cluster. The procedure is as follows:
+- Wait until a reconciliation is due, either every --interval or on the cron expression
+  of --schedule.
+- If maintenance windows are configured and none of them is open, postpone the
+  reconciliation until the next window opens.
+- Run a cycle, exactly like "nodepool cycle". It is stopped cleanly once the maintenance
+  window closes, the node in progress is uncordoned again.
+- With a checkpoint, a cycle which has been stopped is continued by the next reconciliation.
+
+Only the replica which holds the lock (--lock) reconciles, other replicas wait on standby
+until it is released or expires. The run timeout (--timeout) bounds every single reconciliation. /healthz and /readyz are
+served on --health-addr.`,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		return bindCycleFlags(cmd)
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// Errors from here on are not caused by wrong usage
+		cmd.SilenceUsage = true
+
+		opts, err := controllerOptionsFromConfig()
+		if err != nil {
+			return err
+		}
+
+		clientset, egoclient, err := initClients()
+		if err != nil {
+			return err
+		}
+
+		ctx := cmd.Context()
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		provider := newExoscaleProvider(egoclient, viper.GetString("exoscale_api_zone"), viper.GetString("sks_cluster_id"))
+		return newController(opts, clientset, provider).run(ctx)
+	},
+}
+
+// controllerOptions holds the configuration of the controller
+type controllerOptions struct {
+	cycle cycleOptions
+	// When reconciliations are due
+	schedule cron.Schedule
+	// Run the first reconciliation right away, instead of waiting until the schedule is due
+	immediate bool
+	// The time zone of the schedule
+	location *time.Location
+	windows  maintenanceWindows
+	// Bounds every reconciliation, 0 disables the timeout
+	runTimeout time.Duration
+	// Address the health endpoints are served on, empty disables them
+	healthAddr string
+	// Only the holder of the lock reconciles, other replicas wait on standby
+	lock lockOptions
+}
+
+// intervalSchedule is due a fixed interval after the previous reconciliation has ended
+type intervalSchedule struct {
+	interval time.Duration
+}
+
+func (s intervalSchedule) Next(t time.Time) time.Time {
+	return t.Add(s.interval)
+}
+
+// Read the options of the controller from the configuration
+func controllerOptionsFromConfig() (controllerOptions, error) {
+	cycle, err := cycleOptionsFromConfig()
+	if err != nil {
+		return controllerOptions{}, err
+	}
+	opts := controllerOptions{
+		cycle:      cycle,
+		runTimeout: viper.GetDuration("timeout"),
+		healthAddr: viper.GetString("health_addr"),
+		lock:       lockOptionsFromConfig(),
+	}
+	opts.lock.wait = true
+	// The controller decides on its own whether an unfinished run is continued
+	opts.cycle.resume = false
+	if err := opts.cycle.validate(); err != nil {
+		return opts, err
+	}
+
+	location, err := time.LoadLocation(viper.GetString("timezone"))
+	if err != nil {
+		return opts, configError("invalid time zone '%s': %w", viper.GetString("timezone"), err)
+	}
+	opts.location = location
+
+	if expression := viper.GetString("schedule"); expression != "" {
+		schedule, err := cron.ParseStandard(expression)
+		if err != nil {
+			return opts, configError("invalid schedule '%s': %w", expression, err)
+		}
+		opts.schedule = schedule
+	} else {
+		interval := viper.GetDuration("interval")
+		if interval <= 0 {
+			return opts, configError("invalid interval %s, expected more than 0", interval)
+		}
+		opts.schedule = intervalSchedule{interval: interval}
+		opts.immediate = true
+	}
+
+	opts.windows, err = parseMaintenanceWindows(viper.GetString("maintenance_windows"), location)
+	if err != nil {
+		return opts, err
+	}
+
+	return opts, nil
+}
+
+// controller runs a cycle whenever it is due and a maintenance window is open
+type controller struct {
+	opts      controllerOptions
+	clientset kubernetes.Interface
+	provider  SKSProvider
+	// Clock of the schedule and the maintenance windows
+	now func() time.Time
+
+	mu    sync.Mutex
+	ready bool
+}
+
+func newController(opts controllerOptions, clientset kubernetes.Interface, provider SKSProvider) *controller {
+	return &controller{
+		opts:      opts,
+		clientset: clientset,
+		provider:  provider,
+		now:       time.Now,
+	}
+}
+
+// Run reconciliations on the schedule until the context is done. Failed reconciliations are logged, the controller
+// keeps running and tries again once the next reconciliation is due.
+func (c *controller) run(ctx context.Context) error {
+	if c.opts.healthAddr != "" {
+		listener, err := net.Listen("tcp", c.opts.healthAddr)
+		if err != nil {
+			return fmt.Errorf("error serving health endpoints: %w", err)
+		}
+		server := &http.Server{Handler: c.healthHandler(), ReadHeaderTimeout: 10 * time.Second}
+		go func() {
+			if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Error("Error serving health endpoints", logKeyError, err)
+			}
+		}()
+		defer func() {
+			shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+			defer cancel()
+			server.Shutdown(shutdownCtx)
+		}()
+	}
+
+	// Replicas on standby are ready as well, they wait here until the lock is free
+	c.setReady(true)
+	defer c.setReady(false)
+	lockCtx, release, err := acquireLock(ctx, c.clientset, c.opts.lock)
+	if err != nil {
+		if ctx.Err() != nil {
+			loggerFrom(ctx).Info("Controller stopped")
+			return nil
+		}
+		return err
+	}
+	defer release()
+	controllerLeader.Set(1)
+	defer controllerLeader.Set(0)
+
+	next := c.now().In(c.opts.location)
+	if !c.opts.immediate {
+		next = c.opts.schedule.Next(next)
+	}
+
+	for {
+		loggerFrom(ctx).Info("Next reconciliation is scheduled", "at", next.Format(time.RFC3339))
+		if err := c.sleepUntil(lockCtx, next); err != nil {
+			// The controller exits once another instance has taken its lock over, so it is restarted on standby
+			if ctx.Err() == nil {
+				return interruptedError(lockCtx)
+			}
+			loggerFrom(ctx).Info("Controller stopped")
+			return nil
+		}
+
+		now := c.now().In(c.opts.location)
+		open, closes := c.opts.windows.open(now)
+		if !open {
+			next = c.opts.windows.next(now)
+			loggerFrom(ctx).Info("No maintenance window is open, postponing reconciliation", "until", next.Format(time.RFC3339))
+			continue
+		}
+
+		c.reconcile(lockCtx, closes)
+		next = c.opts.schedule.Next(c.now().In(c.opts.location))
+	}
+}
+
+// Run a single cycle, which is stopped once the maintenance window closes. An unfinished run is continued from its
+// checkpoint, e.g. after it has been stopped at the end of the previous window.
+func (c *controller) reconcile(ctx context.Context, closes time.Time) error {
+	runCtx, cancel := withTimeout(ctx, c.opts.runTimeout)
+	defer cancel()
+	if !closes.IsZero() {
+		runCtx, cancel = context.WithDeadline(runCtx, closes)
+		defer cancel()
+	}
+
+	opts := c.opts.cycle
+	store, err := newCheckpointStore(opts.checkpoint, c.clientset)
+	if err != nil {
+		return err
+	}
+	if store != nil {
+		cp, err := store.Load(runCtx)
+		if err != nil {
+			loggerFrom(ctx).Error("Error while loading checkpoint, skipping reconciliation", logKeyError, err)
+			return err
+		}
+		opts.resume = cp != nil
+	}
+
+	loggerFrom(ctx).Info("Starting reconciliation", "resume", opts.resume)
+	result, err := runCycle(runCtx, c.clientset, c.provider, opts)
+	if err == nil {
+		err = result.err()
+	}
+
+	switch errorClassOf(err) {
+	case errorClassNothingToDo:
+		loggerFrom(ctx).Info("Reconciliation completed", "result", err.Error())
+	case errorClassInterrupted:
+		loggerFrom(ctx).Warn("Reconciliation was stopped before it completed", logKeyError, err)
+	default:
+		if err != nil {
+			loggerFrom(ctx).Error("Reconciliation failed", logKeyError, err)
+		} else {
+			loggerFrom(ctx).Info("Reconciliation completed", "nodes", len(result.Nodes))
+		}
+	}
+	return err
+}
+
+// Wait until the time has come on the clock of the controller, or the context is done
+func (c *controller) sleepUntil(ctx context.Context, t time.Time) error {
+	timer := time.NewTimer(t.Sub(c.now()))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (c *controller) setReady(ready bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ready = ready
+}
+
+// Serve /healthz, which succeeds while the process is up, and /readyz, which succeeds while the controller runs,
+// whether it holds the lock or waits on standby. Which replica holds the lock is exposed by the sks_lifecycler_leader
+// metric.
+func (c *controller) healthHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		c.mu.Lock()
+		ready := c.ready
+		c.mu.Unlock()
+		if !ready {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	return mux
+}
+
+func init() {
+	rootCmd.AddCommand(controllerCmd)
+
+	addCycleFlags(controllerCmd)
+	controllerCmd.Flags().Duration("interval", time.Hour, "How long to wait after a reconciliation until the next one, ignored if --schedule is set")
+	viper.BindPFlag("interval", controllerCmd.Flags().Lookup("interval"))
+	controllerCmd.Flags().String("schedule", "", "Cron expression on which reconciliations are due, e.g. \"0 */4 * * *\" (overrides --interval)")
+	viper.BindPFlag("schedule", controllerCmd.Flags().Lookup("schedule"))
+	controllerCmd.Flags().String("maintenance-windows", "", "Windows in which nodes may be replaced, separated by \";\", e.g. \"Mon-Fri 22:00-04:00; Sat,Sun 00:00-24:00\" (empty allows any time)")
+	viper.BindPFlag("maintenance_windows", controllerCmd.Flags().Lookup("maintenance-windows"))
+	controllerCmd.Flags().String("timezone", "UTC", "Time zone of the schedule and the maintenance windows, e.g. Europe/Vienna")
+	viper.BindPFlag("timezone", controllerCmd.Flags().Lookup("timezone"))
+	controllerCmd.Flags().String("health-addr", ":8080", "Address /healthz and /readyz are served on (empty disables them)")
+	viper.BindPFlag("health_addr", controllerCmd.Flags().Lookup("health-addr"))
+}
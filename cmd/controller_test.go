@@ -0,0 +1,187 @@
+package cmd
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestMaintenanceWindows(t *testing.T) {
+	vienna, err := time.LoadLocation("Europe/Vienna")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2024-04-01 is a Monday
+	at := func(day int, hour int, minute int) time.Time {
+		return time.Date(2024, time.April, day, hour, minute, 0, 0, vienna)
+	}
+
+	tests := []struct {
+		name       string
+		spec       string
+		now        time.Time
+		wantOpen   bool
+		wantCloses time.Time
+		wantNext   time.Time
+	}{
+		{name: "inside window", spec: "Mon-Fri 02:00-05:00", now: at(2, 3, 0), wantOpen: true, wantCloses: at(2, 5, 0), wantNext: at(3, 2, 0)},
+		{name: "before window", spec: "Mon-Fri 02:00-05:00", now: at(2, 1, 59), wantNext: at(2, 2, 0)},
+		{name: "window closed at its end", spec: "Mon-Fri 02:00-05:00", now: at(2, 5, 0), wantNext: at(3, 2, 0)},
+		{name: "weekend is skipped", spec: "Mon-Fri 02:00-05:00", now: at(5, 6, 0), wantNext: at(8, 2, 0)},
+		{name: "wraps past midnight", spec: "Fri 22:00-04:00", now: at(6, 3, 0), wantOpen: true, wantCloses: at(6, 4, 0), wantNext: at(12, 22, 0)},
+		{name: "opens on its day only", spec: "Fri 22:00-04:00", now: at(5, 3, 0), wantNext: at(5, 22, 0)},
+		{name: "whole day", spec: "sat,sunday 00:00-24:00", now: at(7, 23, 0), wantOpen: true, wantCloses: at(8, 0, 0), wantNext: at(13, 0, 0)},
+		{name: "range wraps around the week", spec: "Sat-Mon 10:00-11:00", now: at(1, 10, 30), wantOpen: true, wantCloses: at(1, 11, 0), wantNext: at(6, 10, 0)},
+		{name: "latest closing window", spec: "Mon 01:00-03:00; Mon 02:00-06:00", now: at(1, 2, 30), wantOpen: true, wantCloses: at(1, 6, 0), wantNext: at(8, 1, 0)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			windows, err := parseMaintenanceWindows(tt.spec, vienna)
+			if err != nil {
+				t.Fatalf("parseMaintenanceWindows() error = %v", err)
+			}
+			open, closes := windows.open(tt.now)
+			if open != tt.wantOpen || !closes.Equal(tt.wantCloses) {
+				t.Errorf("open() = %v, %s, want %v, %s", open, closes, tt.wantOpen, tt.wantCloses)
+			}
+			if next := windows.next(tt.now); !next.Equal(tt.wantNext) {
+				t.Errorf("next() = %s, want %s", next, tt.wantNext)
+			}
+		})
+	}
+}
+
+func TestParseMaintenanceWindowsRejectsInvalidWindows(t *testing.T) {
+	for _, spec := range []string{"Mon", "Mon 02:00", "Mo 02:00-05:00", "Mon 25:00-05:00", "Mon 02:00-05:60", "Mon 24:00-02:00", "Mon-Fri 2-5"} {
+		if _, err := parseMaintenanceWindows(spec, time.UTC); exitCode(err) != exitCodeConfig {
+			t.Errorf("parseMaintenanceWindows(%q) error = %v, want a configuration error", spec, err)
+		}
+	}
+}
+
+func TestControllerReconcilesOnSchedule(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	clientset := fake.NewSimpleClientset()
+	provider := newFakeSKSProvider(clientset, "1.29.3")
+	provider.addNodepool("np-1", "workers", "v1.28.7", 2)
+
+	c := newController(controllerOptions{
+		cycle:     testCycleOptions(),
+		schedule:  intervalSchedule{interval: 10 * time.Millisecond},
+		immediate: true,
+		location:  time.UTC,
+	}, clientset, provider)
+
+	stopped := make(chan error)
+	go func() {
+		stopped <- c.run(ctx)
+	}()
+
+	// Both nodes are replaced by the first reconciliation, later ones have nothing to do
+	err := wait.PollUntilContextTimeout(ctx, 10*time.Millisecond, 10*time.Second, true, func(ctx context.Context) (bool, error) {
+		return provider.callCount("GetCluster") >= 3, nil
+	})
+	if err != nil {
+		t.Fatalf("controller did not reconcile repeatedly: %v", err)
+	}
+	if evictions := provider.callCount("EvictNodepoolMembers"); evictions != 2 {
+		t.Errorf("nodepool evictions = %d, want 2", evictions)
+	}
+
+	recorder := httptest.NewRecorder()
+	c.healthHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("/readyz status = %d, want %d", recorder.Code, http.StatusOK)
+	}
+	if leader := testutil.ToFloat64(controllerLeader); leader != 1 {
+		t.Errorf("sks_lifecycler_leader = %v, want 1", leader)
+	}
+
+	cancel()
+	if err := <-stopped; err != nil {
+		t.Errorf("run() error = %v, want nil", err)
+	}
+	recorder = httptest.NewRecorder()
+	c.healthHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz status of stopped controller = %d, want %d", recorder.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestControllerIsReadyOnStandby(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	clientset := fake.NewSimpleClientset(heldLease("other"))
+	provider := newFakeSKSProvider(clientset, "1.29.3")
+
+	c := newController(controllerOptions{
+		cycle:     testCycleOptions(),
+		schedule:  intervalSchedule{interval: time.Hour},
+		immediate: true,
+		location:  time.UTC,
+		lock:      lockOptions{location: "kube-system/exoscale-sks-lifecycler", wait: true},
+	}, clientset, provider)
+
+	stopped := make(chan error)
+	go func() {
+		stopped <- c.run(ctx)
+	}()
+
+	// The lock is held by another replica, so this one waits on standby, ready but not leading
+	err := wait.PollUntilContextTimeout(ctx, 10*time.Millisecond, 10*time.Second, true, func(ctx context.Context) (bool, error) {
+		recorder := httptest.NewRecorder()
+		c.healthHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return recorder.Code == http.StatusOK, nil
+	})
+	if err != nil {
+		t.Fatalf("/readyz of controller on standby did not succeed: %v", err)
+	}
+	if leader := testutil.ToFloat64(controllerLeader); leader != 0 {
+		t.Errorf("sks_lifecycler_leader = %v, want 0", leader)
+	}
+	if calls := provider.callCount("GetCluster"); calls != 0 {
+		t.Errorf("GetCluster calls on standby = %d, want 0", calls)
+	}
+
+	cancel()
+	if err := <-stopped; err != nil {
+		t.Errorf("run() error = %v, want nil", err)
+	}
+}
+
+func TestControllerWaitsForMaintenanceWindow(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	clientset := fake.NewSimpleClientset()
+	provider := newFakeSKSProvider(clientset, "1.29.3")
+	provider.addNodepool("np-1", "workers", "v1.28.7", 1)
+
+	windows, err := parseMaintenanceWindows("Mon 02:00-05:00", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newController(controllerOptions{
+		cycle:     testCycleOptions(),
+		schedule:  intervalSchedule{interval: time.Millisecond},
+		immediate: true,
+		location:  time.UTC,
+		windows:   windows,
+	}, clientset, provider)
+	// A Tuesday, the window opens again in six days
+	c.now = func() time.Time { return time.Date(2024, time.April, 2, 3, 0, 0, 0, time.UTC) }
+
+	if err := c.run(ctx); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+	if calls := provider.callCount("GetCluster"); calls != 0 {
+		t.Errorf("cluster was reconciled %d times outside of the maintenance window", calls)
+	}
+}
@@ -5,13 +5,22 @@ package cmd
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
+	egoscalev2 "github.com/exoscale/egoscale/v2"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/apimachinery/pkg/util/version"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"k8s.io/client-go/kubernetes"
 )
 
 // cycleCmd represents the cycle command
@@ -19,224 +28,951 @@ var cycleCmd = &cobra.Command{
 	Use:   "cycle",
 	Short: "Replace all nodes in a nodepool.",
 	Long: `Replace all nodes in a nodepool. The procedure is as follows:
-- Scale the nodepool up by one node (by default all nodes and nodepools are considered).
-- Wait for the new node to be added to the nodepool.
+- Scale the nodepool up by the surge count (by default all nodes and nodepools are considered).
+- Wait for the new nodes to be Ready in Kubernetes and running in the nodepool.
 - Cordon the node.
 - Pods that are managed by daemonsets are skipped.
 - Pods that are managed by deployments are rescheduled by restarting the deployment.
 - Evict all remaining pods from the node.
+- Evict pods of statefulsets one at a time, highest ordinal first, each after the replacement
+  of the previous one is ready and the statefulset reports all replicas as ready.
+- Wait for every workload which had pods on the node to have rolled out all replicas again.
 - Evict the node from the nodepool.
-- Wait for the pods to be running on other nodes.
 
-The procedure is repeated for all nodes in the nodepool.
-Nodes which have job pods running are cordoned, but the eviction is skipped.`,
-	Run: func(cmd *cobra.Command, args []string) {
-		desiredK8sVersion := viper.GetString("desired_k8s_version")
-		exoscaleZone := viper.GetString("exoscale_api_zone")
-		sksClusterId := viper.GetString("sks_cluster_id")
-		evictNodesLabelSelector := viper.GetString("evict_nodes_labelselector")
+The procedure is repeated for all nodes in the nodepool. Every evicted node shrinks the
+nodepool by one, so it is back at its original size once all surge nodes are used up.
+Up to --max-unavailable nodes of a nodepool and --parallel-nodepools nodepools are cycled
+at the same time, by default one node at a time.
+Nodes which have job pods running are cordoned, but the eviction is skipped.
+If the replacement of a node fails, the failure policy decides what happens: rollback
+uncordons the node (and optionally scales its nodepool back down), leave keeps it cordoned,
+abort-all rolls it back and stops the cycle.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// Errors from here on are not caused by wrong usage
+		cmd.SilenceUsage = true
 
+		ctx, cancel := commandContext(cmd)
+		defer cancel()
 
-		ctx := context.Background()
+		if dryRun, _ := cmd.Flags().GetBool("dry-run"); dryRun {
+			output, _ := cmd.Flags().GetString("output")
+			return printPlanFromConfig(ctx, cmd.OutOrStdout(), output)
+		}
 
-		clientset, err := initKubeClient()
+		opts, err := cycleOptionsFromConfig()
 		if err != nil {
-			panic(err.Error())
+			return err
 		}
 
-		egoclient, err := initExoscaleClient()
+		clientset, egoclient, err := initClients()
 		if err != nil {
-			panic(err.Error())
+			return err
 		}
 
+		// Only one instance may change nodes at a time
+		ctx, release, err := acquireLock(ctx, clientset, lockOptionsFromConfig())
+		if err != nil {
+			return err
+		}
+		defer release()
 
-		sksCluster, err := egoclient.GetSKSCluster(ctx, exoscaleZone, sksClusterId)
+		result, err := runCycle(ctx, clientset, newExoscaleProvider(egoclient, viper.GetString("exoscale_api_zone"), viper.GetString("sks_cluster_id")), opts)
 		if err != nil {
-			panic(err.Error())
+			return err
 		}
-	
 
+		return result.err()
+	},
+}
 
-		nodes, err := clientset.CoreV1().Nodes().List(context.Background(), metav1.ListOptions{})
-		if err != nil {
-			panic(err.Error())
+// cycleOptions holds the configuration of a single cycle run
+type cycleOptions struct {
+	desiredK8sVersion       string
+	evictNodesLabelSelector string
+	surgeCount              int
+	evictionTimeout         time.Duration
+	evictionTimeoutAction   string
+	workloadTimeout         time.Duration
+	nodeReadyTimeout        time.Duration
+	drainTimeout            time.Duration
+	sksEvictTimeout         time.Duration
+	// Where the progress of the run is persisted, empty disables checkpoints
+	checkpoint string
+	// Continue an unfinished run from its checkpoint, instead of selecting nodes
+	resume bool
+	// What to do with a node whose replacement failed: rollback, leave or abort-all
+	failurePolicy string
+	// Scale a nodepool back down by its surge nodes, when rolling back a failed node
+	restoreNodepoolSize bool
+	// Where the report of the run is written once it is done, empty disables the report
+	report string
+	// Format of the report: json, markdown or junit, empty infers it from the extension of the path
+	reportFormat string
+	// Webhooks the progress of the run is posted to
+	notify notifierOptions
+	// Hooks which run at points in the replacement of a node
+	hooks []hookConfig
+	// Number of nodes per nodepool which are replaced at the same time, a count or a percentage of the nodepool size
+	maxUnavailable string
+	// Number of nodepools whose nodes are replaced at the same time
+	parallelNodepools int
+	// Nodepools which are cycled by ID or name, empty cycles all nodepools
+	nodepools []string
+	// Nodepools which are not cycled by ID or name
+	excludeNodepools []string
+	// Order in which nodepools are cycled: name, size or listed
+	nodepoolOrder string
+}
+
+// Read the options of a cycle from the configuration
+func cycleOptionsFromConfig() (cycleOptions, error) {
+	hooks, err := hooksFromConfig()
+	if err != nil {
+		return cycleOptions{}, err
+	}
+	return cycleOptions{
+		desiredK8sVersion:       viper.GetString("desired_k8s_version"),
+		evictNodesLabelSelector: viper.GetString("evict_nodes_labelselector"),
+		surgeCount:              viper.GetInt("surge_count"),
+		evictionTimeout:         viper.GetDuration("eviction_timeout"),
+		evictionTimeoutAction:   viper.GetString("eviction_timeout_action"),
+		workloadTimeout:         viper.GetDuration("workload_timeout"),
+		nodeReadyTimeout:        viper.GetDuration("node_ready_timeout"),
+		drainTimeout:            viper.GetDuration("drain_timeout"),
+		sksEvictTimeout:         viper.GetDuration("sks_evict_timeout"),
+		checkpoint:              viper.GetString("checkpoint"),
+		resume:                  viper.GetBool("resume"),
+		failurePolicy:           viper.GetString("failure_policy"),
+		restoreNodepoolSize:     viper.GetBool("restore_nodepool_size"),
+		report:                  viper.GetString("report"),
+		reportFormat:            viper.GetString("report_format"),
+		notify:                  notifierOptionsFromConfig(),
+		hooks:                   hooks,
+		maxUnavailable:          viper.GetString("max_unavailable"),
+		parallelNodepools:       viper.GetInt("parallel_nodepools"),
+		nodepools:               splitList(viper.GetString("nodepool")),
+		excludeNodepools:        splitList(viper.GetString("exclude_nodepool")),
+		nodepoolOrder:           viper.GetString("nodepool_order"),
+	}, nil
+}
+
+// Check the options before anything in the cluster is changed
+func (opts cycleOptions) validate() error {
+	if opts.desiredK8sVersion == "" {
+		return configError("the desired Kubernetes version is not set")
+	}
+	if opts.surgeCount < 0 {
+		return configError("invalid surge count %d, expected 0 or more", opts.surgeCount)
+	}
+	if opts.evictionTimeout < 0 {
+		return configError("invalid eviction timeout %s, expected 0 or more", opts.evictionTimeout)
+	}
+	if opts.workloadTimeout < 0 {
+		return configError("invalid workload timeout %s, expected 0 or more", opts.workloadTimeout)
+	}
+	if opts.nodeReadyTimeout < 0 {
+		return configError("invalid node ready timeout %s, expected 0 or more", opts.nodeReadyTimeout)
+	}
+	if opts.drainTimeout < 0 {
+		return configError("invalid drain timeout %s, expected 0 or more", opts.drainTimeout)
+	}
+	if opts.sksEvictTimeout < 0 {
+		return configError("invalid SKS eviction timeout %s, expected 0 or more", opts.sksEvictTimeout)
+	}
+	if opts.failurePolicy != failurePolicyRollback && opts.failurePolicy != failurePolicyLeave && opts.failurePolicy != failurePolicyAbortAll {
+		return configError("invalid failure policy '%s', expected '%s', '%s' or '%s'", opts.failurePolicy, failurePolicyRollback, failurePolicyLeave, failurePolicyAbortAll)
+	}
+	if opts.evictionTimeoutAction != evictionTimeoutActionAbort && opts.evictionTimeoutAction != evictionTimeoutActionDelete {
+		return configError("invalid eviction timeout action '%s', expected '%s' or '%s'", opts.evictionTimeoutAction, evictionTimeoutActionAbort, evictionTimeoutActionDelete)
+	}
+	if _, err := parseMaxUnavailable(opts.maxUnavailable, 1); err != nil {
+		return err
+	}
+	if opts.parallelNodepools < 1 {
+		return configError("invalid number of parallel nodepools %d, expected 1 or more", opts.parallelNodepools)
+	}
+	if opts.nodepoolOrder != "" && opts.nodepoolOrder != nodepoolOrderName && opts.nodepoolOrder != nodepoolOrderSize && opts.nodepoolOrder != nodepoolOrderListed {
+		return configError("invalid nodepool order '%s', expected '%s', '%s' or '%s'", opts.nodepoolOrder, nodepoolOrderName, nodepoolOrderSize, nodepoolOrderListed)
+	}
+	if opts.nodepoolOrder == nodepoolOrderListed && len(opts.nodepools) == 0 {
+		return configError("nodepool order '%s' requires the nodepools to be listed", nodepoolOrderListed)
+	}
+	if opts.reportFormat != "" && opts.reportFormat != reportFormatJSON && opts.reportFormat != reportFormatMarkdown && opts.reportFormat != reportFormatJUnit {
+		return configError("invalid report format '%s', expected '%s', '%s' or '%s'", opts.reportFormat, reportFormatJSON, reportFormatMarkdown, reportFormatJUnit)
+	}
+	return nil
+}
+
+const (
+	// The node has been drained and evicted from its nodepool
+	nodeStatusReplaced string = "replaced"
+	// The node has been cordoned, but not replaced, because it has running jobs
+	nodeStatusSkipped string = "skipped"
+	// The replacement of the node failed, the error is recorded in the result
+	nodeStatusFailed string = "failed"
+	// The run was stopped while the node was being replaced, it has been uncordoned again
+	nodeStatusInterrupted string = "interrupted"
+	// The node has not been selected, because it is on the desired or a newer version
+	nodeStatusUpToDate string = "up-to-date"
+	// The node has not been selected for another reason, e.g. its version cannot be parsed
+	nodeStatusNotSelected string = "not-selected"
+)
+
+// nodeResult records what happened to a node which was selected for replacement
+type nodeResult struct {
+	Node       string
+	NodepoolId string
+	Status     string
+	Err        error
+	// Steps which have been undone after the replacement failed, see failurePolicyRollback
+	Undone []string
+	// Kubelet version of the node when the run started
+	KubeletVersion string
+	// Why a node has not been selected
+	Reason string
+	// Phases of the replacement which have been run, in order
+	Phases []phaseResult
+	// Deployments which have been rollout-restarted to drain the node
+	RestartedDeployments []string
+}
+
+// phaseResult records when a phase of the replacement of a node started and ended
+type phaseResult struct {
+	Phase string
+	Start time.Time
+	End   time.Time
+}
+
+// cycleResult records the results of all nodes which were selected for replacement. Nodes are replaced
+// concurrently, so it is safe for concurrent use.
+type cycleResult struct {
+	Nodes []nodeResult
+	// Nodes which have not been selected, they are reported but do not count towards the outcome of the run
+	Kept []nodeResult
+
+	RunId         string
+	ClusterId     string
+	TargetVersion string
+	Start         time.Time
+	End           time.Time
+
+	// Names of the nodepools of the cluster by ID
+	nodepoolNames map[string]string
+	// Notifies webhooks of handled nodes, nil if no webhook is configured
+	notifier *notifier
+	mu       sync.Mutex
+	// Phases and restarted deployments of the nodes in progress by node name, until they are recorded
+	phases    map[string][]phaseResult
+	restarted map[string][]string
+}
+
+func (r *cycleResult) record(node corev1.Node, sksNodepoolId string, status string, err error) {
+	r.mu.Lock()
+	r.Nodes = append(r.Nodes, nodeResult{
+		Node:                 node.Name,
+		NodepoolId:           sksNodepoolId,
+		Status:               status,
+		Err:                  err,
+		KubeletVersion:       node.Status.NodeInfo.KubeletVersion,
+		Phases:               r.phases[node.Name],
+		RestartedDeployments: r.restarted[node.Name],
+	})
+	delete(r.phases, node.Name)
+	delete(r.restarted, node.Name)
+	r.mu.Unlock()
+	r.notifier.node(r, node.Name, sksNodepoolId, status, err)
+
+	reason := ""
+	switch status {
+	case nodeStatusSkipped:
+		reason = nodeReasonRunningJobs
+	case nodeStatusFailed, nodeStatusInterrupted:
+		reason = errorClassOf(err).String()
+	}
+	observeNode(sksNodepoolId, status, reason)
+}
+
+// Record a node which has not been selected for replacement
+func (r *cycleResult) keep(node corev1.Node, status string, reason string) {
+	sksNodepoolId, _ := getNodepoolId(node)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Kept = append(r.Kept, nodeResult{
+		Node:           node.Name,
+		NodepoolId:     sksNodepoolId,
+		Status:         status,
+		KubeletVersion: node.Status.NodeInfo.KubeletVersion,
+		Reason:         reason,
+	})
+}
+
+// Record a phase of a node in progress which started at the given time and has just ended
+func (r *cycleResult) endPhase(node string, phase string, start time.Time) {
+	r.mu.Lock()
+	if r.phases == nil {
+		r.phases = make(map[string][]phaseResult)
+	}
+	r.phases[node] = append(r.phases[node], phaseResult{Phase: phase, Start: start, End: time.Now()})
+	r.mu.Unlock()
+	observePhase(phase, start)
+}
+
+// Record the deployments which have been restarted to drain a node in progress
+func (r *cycleResult) restartedDeployments(node string, deployments []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.restarted == nil {
+		r.restarted = make(map[string][]string)
+	}
+	r.restarted[node] = deployments
+}
+
+// Record the steps which have been undone for a node, after it has been recorded as failed
+func (r *cycleResult) undo(node string, undone []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := len(r.Nodes) - 1; i >= 0; i-- {
+		if r.Nodes[i].Node == node {
+			r.Nodes[i].Undone = undone
+			return
 		}
+	}
+}
+
+// Copy of the results of the nodes which have been handled so far
+func (r *cycleResult) handled() []nodeResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.Nodes)
+}
 
-		evictNodesLabels := parseLabelSelector(evictNodesLabelSelector)
+// Summarize the results as an error: nil if every selected node has been handled, errNothingToDo if no node
+// was selected, a drain timeout if only drains timed out and a partial failure otherwise
+func (r *cycleResult) err() error {
+	if len(r.Nodes) == 0 {
+		return errNothingToDo
+	}
 
-		// Iterate over all nodes
-		for _, node := range nodes.Items {
-			var hasDesiredVersion bool = false
-			if node.Status.NodeInfo.KubeletVersion == desiredK8sVersion {
-				fmt.Printf("Node %s is already on desired version %s\n", node.Name, node.Status.NodeInfo.KubeletVersion)
-				hasDesiredVersion = true
-			} else {				
-				fmt.Printf("Node %s is not on desired version\n", node.Name)
-			}
-			
-			var isSelectedForEvictionDueToLabels bool = false
-			for key, value := range evictNodesLabels {
-				if nodeValue, exists := node.Labels[key]; exists && nodeValue == value {
-					fmt.Printf("Node %s is selected for eviction due to evictNodesLabelSelector config.\n", node.Name)
-					isSelectedForEvictionDueToLabels = true
-					break
-				}
-			}
-	
-			if !hasDesiredVersion || (hasDesiredVersion && isSelectedForEvictionDueToLabels) {
-				// Proceed with the operation
-			} else {
-				continue
-			}
-		
-			fmt.Printf("Node %s is currently on version %s\n", node.Name, node.Status.NodeInfo.KubeletVersion)
+	var failed []error
+	drainTimeoutsOnly := true
+	for _, result := range r.Nodes {
+		if result.Status != nodeStatusFailed {
+			continue
+		}
+		failed = append(failed, fmt.Errorf("node %s: %w", result.Node, result.Err))
+		if errorClassOf(result.Err) != errorClassDrainTimeout {
+			drainTimeoutsOnly = false
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+
+	class := errorClassPartialFailure
+	if drainTimeoutsOnly {
+		class = errorClassDrainTimeout
+	}
+	return &classifiedError{
+		class: class,
+		err:   fmt.Errorf("%d of %d selected nodes could not be replaced: %w", len(failed), len(r.Nodes), errors.Join(failed...)),
+	}
+}
 
-			sksNodepoolId, err := getNodepoolId(node)
-			if err != nil {
-				fmt.Printf("Error while trying to get nodepool ID: %s", err)
+// runCycle replaces all selected nodes of the cluster. Failures of single nodes are recorded in the result and the
+// cycle continues with the next node, the returned error is only set if the cycle could not be completed.
+// Once the context is done, the nodes in progress are left uncordoned and no further node is started.
+// With a checkpoint location, the progress is persisted after every step and an unfinished run can be resumed.
+func runCycle(ctx context.Context, clientset kubernetes.Interface, provider SKSProvider, opts cycleOptions) (result *cycleResult, err error) {
+	result = &cycleResult{Start: time.Now()}
+	defer func() {
+		result.End = time.Now()
+		observeRun(result, err)
+		if opts.report != "" {
+			if reportErr := writeReport(ctx, clientset, opts, result, err); reportErr != nil {
+				loggerFrom(ctx).Error("Error while writing report", logKeyError, reportErr)
 			}
+		}
+		result.notifier.finish(result, err)
+	}()
+	if err := opts.validate(); err != nil {
+		return result, err
+	}
+	if result.notifier, err = newNotifier(ctx, opts.notify); err != nil {
+		return result, err
+	}
+
+	store, err := newCheckpointStore(opts.checkpoint, clientset)
+	if err != nil {
+		return result, err
+	}
+
+	sksCluster, err := provider.GetCluster(ctx)
+	if err != nil {
+		return result, exoscaleError(err)
+	}
+	ctx = withLogFields(ctx, logKeyClusterId, *sksCluster.ID)
+	result.ClusterId = *sksCluster.ID
+	result.nodepoolNames = make(map[string]string)
+	for _, sksNodepool := range sksCluster.Nodepools {
+		if sksNodepool.ID != nil && sksNodepool.Name != nil {
+			result.nodepoolNames[*sksNodepool.ID] = *sksNodepool.Name
+		}
+	}
+
+	budgets, err := nodepoolBudgets(sksCluster, opts.maxUnavailable)
+	if err != nil {
+		return result, err
+	}
+
+	var run *checkpointer
+	var selectedNodes []corev1.Node
+	var desiredK8sVersion *version.Version
+	// Surge nodes which have been added to a nodepool, but not yet been compensated by evicting an old node
+	credit := make(map[string]int)
+	if opts.resume {
+		run, selectedNodes, credit, err = resumeCheckpoint(ctx, store, clientset, provider, *sksCluster.ID, result)
+		if err != nil {
+			return result, err
+		}
+	} else {
+		desiredK8sVersion, selectedNodes, err = selectNodes(ctx, clientset, provider, sksCluster, opts, result)
+		if err != nil {
+			return result, err
+		}
+		run, err = newCheckpoint(ctx, store, *sksCluster.ID, string(uuid.NewUUID()), kubeletVersionString(desiredK8sVersion), selectedNodes)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	surgeCredit := newSurgeCredit(credit, run.state.SurgeInstances, selectedNodes)
+
+	// The checkpoint is removed once the run has completed, an unfinished run leaves it behind to be resumed with
+	// the steps of the nodes which were in progress
+	defer func() {
+		if err != nil {
+			run.step(ctx, result, surgeCredit, nil)
+		} else {
+			run.clear(ctx)
+		}
+	}()
+
+	ctx = withLogFields(ctx, logKeyRunId, run.state.RunId)
+	result.RunId, result.TargetVersion = run.state.RunId, run.state.DesiredVersion
 
-			sksNodepool, err := getNodepool(egoclient, ctx, sksClusterId, sksNodepoolId)
-			if err != nil {
-				fmt.Printf("Error while trying to get nodepool: %s", err)
+	// Every action is recorded as an event on the object it acts on
+	events := newLifecycleEvents(clientset, run.state.RunId, run.state.DesiredVersion)
+	defer events.shutdown()
+	ctx = withEvents(ctx, events)
+	// Nodes of a resumed run have been selected by the run it continues
+	if !opts.resume {
+		for _, node := range selectedNodes {
+			reason := "its kubelet is older than the target version"
+			if selectionReason(node, desiredK8sVersion) == nodeReasonLabel {
+				reason = "it matches the evictNodesLabelSelector"
 			}
-			
-
-			// nodepoolNodes, err := clientset.CoreV1().Nodes().List(context.TODO(), metav1.ListOptions{
-			// 	LabelSelector: nodeLabelNodepoolId + "=" + sksNodepoolId,
-			// })
-			// if err != nil {
-			// 	fmt.Printf("Error while trying to list nodes: %s", err)
-			// }
-
-			// if err := scaleNodepool(egoclient, ctx, node, sksClusterId, sksNodepoolId); err != nil {
-			// 	fmt.Printf("Error while trying to scale nodepool: %s", err)
-			// }
-
-			// // Wait until the nodepool has been scaled
-			// for {
-
-			// 	// Check via the Kubernetes API if a new node has been added to the nodepool
-			// 	nodepoolNodesNext, err := clientset.CoreV1().Nodes().List(context.TODO(), metav1.ListOptions{
-			// 		LabelSelector: nodeLabelNodepoolId + "=" + sksNodepoolId,
-			// 	})
-			// 	if err != nil {
-			// 		fmt.Printf("Error while trying to list nodes: %s", err)
-			// 	}
-			// 	if len(nodepoolNodesNext.Items) > len(nodepoolNodes.Items) {
-			// 		fmt.Printf("Node has been added to the nodepool.\n")
-			// 		break
-			// 	}
-
-			// 	fmt.Printf("Waiting for a new node to be added to the nodepool. Sleeping for 15 seconds.\n")
-			// 	time.Sleep(15 * time.Second)
-			// }
-
-			if err := waitNodesReady(clientset); err != nil {
-				fmt.Printf("Error while waiting for nodes to be ready: %s", err)
+			events.node(ctx, node, nodeStateSelected, corev1.EventTypeNormal, eventReasonSelected, "Node is selected for replacement, because %s", reason)
+		}
+	}
+	if len(selectedNodes) > 0 {
+		result.notifier.notify(result, notification{Event: notifyEventRunStarted, Nodes: len(selectedNodes)})
+	}
+
+	// Waits are served from informers, so they react to changes of nodes, pods and workloads right away
+	var watcher *clusterWatcher
+	if len(selectedNodes) > 0 {
+		watcher, err = startClusterWatcher(ctx, clientset)
+		if err != nil {
+			return result, kubernetesError(err)
+		}
+		defer watcher.stop()
+	}
+
+	c := &cycler{
+		clientset: clientset,
+		provider:  provider,
+		opts:      opts,
+		result:    result,
+		run:       run,
+		watcher:   watcher,
+		surge:     surgeCredit,
+		budgets:   budgets,
+	}
+	return result, c.replaceNodes(ctx, selectedNodes)
+}
+
+// cycler replaces the selected nodes of a run. Nodes are replaced concurrently, so everything it shares between
+// them is safe for concurrent use.
+type cycler struct {
+	clientset kubernetes.Interface
+	provider  SKSProvider
+	opts      cycleOptions
+	result    *cycleResult
+	run       *checkpointer
+	watcher   *clusterWatcher
+	surge     *surgeCredit
+	// Number of nodes per nodepool which may be replaced at the same time
+	budgets map[string]int
+}
+
+// Replace a node. A failure of the node is recorded in the result, the returned error is only set if the cycle has
+// to be stopped. Once the context is done, the node is left uncordoned.
+func (c *cycler) replaceNode(ctx context.Context, node corev1.Node) error {
+	events := eventsFrom(ctx)
+	nodeCtx := withLogFields(ctx, logKeyNode, node.Name)
+	loggerFrom(nodeCtx).Info("Replacing node", "version", node.Status.NodeInfo.KubeletVersion)
+
+	sksNodepoolId, err := getNodepoolId(node)
+	if err != nil {
+		loggerFrom(nodeCtx).Error("Error while trying to get nodepool ID, skipping node", logKeyError, err)
+		return failNode(nodeCtx, c.clientset, c.provider, c.opts, c.result, node, "", false, c.surge, err)
+	}
+	nodeCtx = withLogFields(nodeCtx, logKeyNodepool, sksNodepoolId)
+
+	// Whether the node holds a surge node of its nodepool, which it gives back if its replacement does not go through
+	claimed := false
+	// A node which never held a surge node is not counted as needing one anymore, once it is done
+	held := false
+	defer func() {
+		if !held {
+			c.surge.settle(sksNodepoolId)
+		}
+	}()
+	interrupt := func(cordoned bool) error {
+		if claimed {
+			c.surge.release(sksNodepoolId)
+		}
+		return interruptNode(nodeCtx, c.clientset, c.result, node, sksNodepoolId, cordoned)
+	}
+	// Record the failure of the node, a failed hook whose failure aborts the run stops the cycle
+	fail := func(ctx context.Context, cordoned bool, err error) error {
+		if claimed {
+			c.surge.release(sksNodepoolId)
+		}
+		abortErr := failNode(ctx, c.clientset, c.provider, c.opts, c.result, node, sksNodepoolId, cordoned, c.surge, err)
+		if abortErr == nil && hookAborts(err) {
+			abortErr = safetyAbortError(fmt.Errorf("cycle aborted, because a hook failed on node %s: %w", node.Name, err))
+		}
+		return abortErr
+	}
+
+	sksNodepool, err := c.provider.GetNodepool(nodeCtx, sksNodepoolId)
+	if err != nil {
+		loggerFrom(nodeCtx).Error("Error while trying to get nodepool, skipping node", logKeyError, err)
+		return fail(nodeCtx, false, exoscaleError(err))
+	}
+
+	// If the node has running jobs, cordon it and continue to the next node, before any surge capacity is requested for it
+	cordonCtx := withPhase(nodeCtx, phaseCordon)
+	hasRunningJobs, err := nodeHasRunningJobs(cordonCtx, c.clientset, node.Name)
+	if err != nil {
+		loggerFrom(cordonCtx).Error("Error while checking if node has running jobs, skipping node", logKeyError, err)
+		return fail(cordonCtx, false, kubernetesError(err))
+	}
+	if hasRunningJobs {
+		if err := cordonNode(cordonCtx, c.clientset, node.Name, true); err != nil {
+			loggerFrom(cordonCtx).Error("Error while cordoning node", logKeyError, err)
+			return fail(cordonCtx, false, kubernetesError(err))
+		}
+		loggerFrom(cordonCtx).Warn("Node has running jobs, skipping eviction and continuing to next node")
+		events.node(cordonCtx, node, nodeStatusSkipped, corev1.EventTypeWarning, eventReasonSkipped, "Node has running jobs, it has been cordoned but is not replaced")
+		c.result.record(node, sksNodepoolId, nodeStatusSkipped, nil)
+		return nil
+	}
+
+	// Every node which is replaced holds a surge node, so the nodepool keeps its capacity while nodes are drained
+	if c.opts.surgeCount > 0 {
+		surgeCtx := withPhase(nodeCtx, phaseSurge)
+		claimed, err = c.claimSurgeNode(surgeCtx, node, sksNodepoolId)
+		held = claimed
+		if err != nil {
+			if ctx.Err() != nil {
+				return interrupt(false)
 			}
+			loggerFrom(surgeCtx).Error("Error while scaling nodepool up, skipping node", logKeyError, err)
+			return fail(surgeCtx, false, err)
+		}
+	}
 
-			if err := cordonNode(clientset, node.Name, true); err != nil {
-				fmt.Printf("Error while cordoning node: %s", err)
+	// Never cordon another node while the cluster is not healthy, the remaining nodes are not touched either
+	c.run.step(cordonCtx, c.result, c.surge, &checkpointStep{Node: node.Name, Phase: phaseCordon})
+	cordonStart := time.Now()
+	if err := waitNodesReady(cordonCtx, c.watcher, c.opts.nodeReadyTimeout); err != nil {
+		c.result.endPhase(node.Name, phaseCordon, cordonStart)
+		if ctx.Err() != nil {
+			return interrupt(false)
+		}
+		loggerFrom(cordonCtx).Error("Error while waiting for nodes to be ready, aborting cycle", logKeyError, err)
+		if claimed {
+			c.surge.release(sksNodepoolId)
+		}
+		err = safetyAbortError(fmt.Errorf("nodes are not ready: %w", err))
+		c.result.record(node, sksNodepoolId, nodeStatusFailed, err)
+		return err
+	}
+
+	if c.opts.surgeCount > 0 {
+		if err := runHooks(cordonCtx, c.opts.hooks, hookPointReplacementReady, node.Name, sksNodepoolId, c.result); err != nil {
+			if ctx.Err() != nil {
+				return interrupt(false)
 			}
+			loggerFrom(cordonCtx).Error("Hook failed, skipping node", logKeyError, err)
+			return fail(cordonCtx, false, err)
+		}
+	}
+	if err := runHooks(cordonCtx, c.opts.hooks, hookPointPreCordon, node.Name, sksNodepoolId, c.result); err != nil {
+		if ctx.Err() != nil {
+			return interrupt(false)
+		}
+		loggerFrom(cordonCtx).Error("Hook failed, skipping node", logKeyError, err)
+		return fail(cordonCtx, false, err)
+	}
 
-			// If the node has running jobs, continue to the next node
-			hasRunningJobs, err := nodeHasRunningJobs(clientset, node.Name)
-			if err != nil {
-				fmt.Printf("Error while checking if node has running jobs: %s", err)
+	err = cordonNode(cordonCtx, c.clientset, node.Name, true)
+	c.result.endPhase(node.Name, phaseCordon, cordonStart)
+	if err != nil {
+		loggerFrom(cordonCtx).Error("Error while cordoning node, skipping node", logKeyError, err)
+		return fail(cordonCtx, false, kubernetesError(err))
+	}
+	events.node(cordonCtx, node, nodeStateCordoned, corev1.EventTypeNormal, eventReasonCordoned, "Node has been cordoned")
+
+	drainCtx := withPhase(nodeCtx, phaseDrain)
+	c.run.step(drainCtx, c.result, c.surge, &checkpointStep{Node: node.Name, Phase: phaseDrain})
+	drainStart := time.Now()
+	workloads, restarted, err := drainNode(drainCtx, c.clientset, c.watcher, node, c.opts)
+	c.result.restartedDeployments(node.Name, restarted)
+	if err != nil {
+		c.result.endPhase(node.Name, phaseDrain, drainStart)
+		if ctx.Err() != nil {
+			return interrupt(true)
+		}
+		loggerFrom(drainCtx).Error("Aborting replacement of node", logKeyError, err)
+		return fail(drainCtx, true, kubernetesError(err))
+	}
+
+	drainDuration.WithLabelValues(sksNodepoolId).Observe(time.Since(drainStart).Seconds())
+
+	// The node is only removed once the workloads which had pods on it are fully available elsewhere
+	err = waitWorkloadsAvailable(drainCtx, c.watcher, workloads, c.opts.workloadTimeout)
+	c.result.endPhase(node.Name, phaseDrain, drainStart)
+	if err != nil {
+		if ctx.Err() != nil {
+			return interrupt(true)
+		}
+		loggerFrom(drainCtx).Error("Workloads are not available, aborting replacement of node", logKeyError, err)
+		return fail(drainCtx, true, kubernetesError(err))
+	}
+
+	events.node(drainCtx, node, nodeStateDrained, corev1.EventTypeNormal, eventReasonDrained, "Node has been drained, the workloads which had pods on it are available")
+
+	if err := runHooks(drainCtx, c.opts.hooks, hookPointPostDrain, node.Name, sksNodepoolId, c.result); err != nil {
+		if ctx.Err() != nil {
+			return interrupt(true)
+		}
+		loggerFrom(drainCtx).Error("Hook failed, aborting replacement of node", logKeyError, err)
+		return fail(drainCtx, true, err)
+	}
+
+	if ctx.Err() != nil {
+		return interrupt(true)
+	}
+
+	// Evicting a member from the nodepool also decreases its size by one. Once started, the eviction is not
+	// cancelled by a stopped run, so the node is not abandoned halfway through leaving its nodepool.
+	sksEvictCtx, cancel := withTimeout(context.WithoutCancel(withPhase(nodeCtx, phaseSksEvict)), c.opts.sksEvictTimeout)
+	defer cancel()
+	c.run.step(sksEvictCtx, c.result, c.surge, &checkpointStep{Node: node.Name, Phase: phaseSksEvict, PendingSksEviction: node.Status.NodeInfo.SystemUUID})
+	sksEvictStart := time.Now()
+	unlock := c.surge.lockNodepool(sksNodepoolId)
+	err = c.provider.EvictNodepoolMembers(sksEvictCtx, sksNodepool, []string{node.Status.NodeInfo.SystemUUID})
+	if err == nil {
+		c.surge.use(sksNodepoolId, claimed)
+		claimed = false
+	}
+	unlock()
+	c.result.endPhase(node.Name, phaseSksEvict, sksEvictStart)
+	if err != nil {
+		loggerFrom(sksEvictCtx).Error("Error while evicting node from nodepool", logKeyError, err)
+		return fail(nodeCtx, true, exoscaleError(err))
+	}
+	loggerFrom(sksEvictCtx).Info("Node evicted from nodepool")
+	events.node(sksEvictCtx, node, nodeStateEvicted, corev1.EventTypeNormal, eventReasonEvicted, "Node has been evicted from nodepool %s", sksNodepoolId)
+
+	// The node has left its nodepool, there is nothing left to roll back
+	if err := runHooks(withPhase(nodeCtx, phaseSksEvict), c.opts.hooks, hookPointPostSksEvict, node.Name, sksNodepoolId, c.result); err != nil {
+		loggerFrom(sksEvictCtx).Error("Hook failed after the node has been evicted from its nodepool", logKeyError, err)
+		c.result.record(node, sksNodepoolId, nodeStatusFailed, err)
+		if hookAborts(err) {
+			return safetyAbortError(fmt.Errorf("cycle aborted, because a hook failed on node %s: %w", node.Name, err))
+		}
+		return nil
+	}
+	c.result.record(node, sksNodepoolId, nodeStatusReplaced, nil)
+	return nil
+}
+
+// Claim a surge node of the nodepool for the node, scaling the nodepool up first if no surge node is left. A scale-up
+// tops the surge nodes of the nodepool up to the surge count, so nodes which are replaced at the same time share it.
+// The budget never lets more nodes than the surge count hold a surge node, so the nodepool never grows beyond it. Scaling up and waiting for the new nodes is serialized per nodepool, so no other node changes
+// its size meanwhile. It returns whether a surge node has been claimed, also if waiting for it failed.
+func (c *cycler) claimSurgeNode(ctx context.Context, node corev1.Node, sksNodepoolId string) (bool, error) {
+	unlock := c.surge.lockNodepool(sksNodepoolId)
+	defer unlock()
+
+	if c.surge.claim(sksNodepoolId) {
+		return true, nil
+	}
+
+	// The size is read again, other nodes of the nodepool may have changed it
+	sksNodepool, err := c.provider.GetNodepool(ctx, sksNodepoolId)
+	if err != nil {
+		return false, exoscaleError(err)
+	}
+	surgeNodes := c.surge.shortfall(sksNodepoolId, c.opts.surgeCount)
+	sksNodepoolSize := *sksNodepool.Size + int64(surgeNodes)
+
+	existing, err := nodepoolInstanceIds(ctx, c.provider, sksNodepool)
+	if err != nil {
+		return false, exoscaleError(err)
+	}
+
+	surgeStart := time.Now()
+	c.run.step(ctx, c.result, c.surge, &checkpointStep{Node: node.Name, Phase: phaseSurge, SurgeSize: sksNodepoolSize, SurgeNodes: surgeNodes})
+	if err := c.provider.ScaleNodepool(ctx, sksNodepool, sksNodepoolSize); err != nil {
+		return false, exoscaleError(err)
+	}
+	// The instances which the scale-up created are recorded, so a rollback removes exactly them and no old node
+	instances, err := nodepoolInstanceIds(ctx, c.provider, sksNodepool)
+	if err != nil {
+		loggerFrom(ctx).Warn("Error while listing the surge instances, they are not rolled back", logKeyError, err)
+	}
+	var surgeInstances []string
+	for id := range instances {
+		if !existing[id] {
+			surgeInstances = append(surgeInstances, id)
+		}
+	}
+	slices.Sort(surgeInstances)
+	c.surge.add(sksNodepoolId, surgeNodes, surgeInstances)
+	loggerFrom(ctx).Info("Nodepool scaled up", "surge", surgeNodes, "size", sksNodepoolSize)
+
+	err = waitNodepoolScaled(ctx, c.watcher, c.provider, sksNodepoolId, sksNodepoolSize, c.opts.nodeReadyTimeout)
+	c.result.endPhase(node.Name, phaseSurge, surgeStart)
+	return true, err
+}
+
+// Resolve the desired version and select the nodes which have to be replaced, nodepool by nodepool in the order of
+// the cycle. Nodes which are not selected are kept in the result.
+func selectNodes(ctx context.Context, clientset kubernetes.Interface, provider SKSProvider, sksCluster *egoscalev2.SKSCluster, opts cycleOptions, result *cycleResult) (*version.Version, []corev1.Node, error) {
+	filter, err := newNodepoolFilter(sksCluster, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	desiredK8sVersion, err := resolveDesiredVersion(ctx, provider, sksCluster, opts.desiredK8sVersion)
+	if err != nil {
+		return nil, nil, err
+	}
+	loggerFrom(ctx).Info("Resolved desired Kubernetes version", "desired", opts.desiredK8sVersion, "version", kubeletVersionString(desiredK8sVersion))
+
+	nodes, err := clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, nil, kubernetesError(err)
+	}
+
+	labelSelectedNodes, err := listLabelSelectedNodes(ctx, clientset, opts.evictNodesLabelSelector)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	selectCtx := withPhase(ctx, phaseSelect)
+	var selectedNodes []corev1.Node
+	for _, node := range nodes.Items {
+		selected, reason := nodeSelected(node, desiredK8sVersion, labelSelectedNodes)
+		inCycle, filterReason := filter.selected(node)
+		if selected && !inCycle {
+			loggerFrom(selectCtx).Info("Node is skipped", logKeyNode, node.Name, "reason", filterReason)
+			result.keep(node, nodeStatusNotSelected, filterReason)
+		} else if selected {
+			loggerFrom(selectCtx).Info("Node is selected for replacement", logKeyNode, node.Name, "reason", reason)
+			selectedNodes = append(selectedNodes, node)
+			sksNodepoolId, _ := getNodepoolId(node)
+			observeNode(sksNodepoolId, nodeStatusSelected, selectionReason(node, desiredK8sVersion))
+		} else {
+			loggerFrom(selectCtx).Info("Node is skipped", logKeyNode, node.Name, "reason", reason)
+			status := nodeStatusUpToDate
+			if _, err := version.ParseGeneric(node.Status.NodeInfo.KubeletVersion); err != nil {
+				status = nodeStatusNotSelected
 			}
-			if hasRunningJobs {
-				fmt.Printf("Node %s has running jobs, skipping eviction and continuing to next node.\n", node.Name)
+			result.keep(node, status, reason)
+		}
+	}
+	filter.sort(selectedNodes)
+
+	return desiredK8sVersion, selectedNodes, nil
+}
+
+// Record the node whose replacement was in progress when the run was stopped. A cordoned node is uncordoned again,
+// so it keeps serving workloads instead of being left half drained.
+func interruptNode(ctx context.Context, clientset kubernetes.Interface, result *cycleResult, node corev1.Node, sksNodepoolId string, cordoned bool) error {
+	err := interruptedError(ctx)
+	loggerFrom(ctx).Warn("Run was stopped while replacing node", logKeyError, err)
+
+	if cordoned {
+		// The context of the run is done already, the node is uncordoned regardless
+		uncordonCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Minute)
+		defer cancel()
+		if uncordonErr := cordonNode(uncordonCtx, clientset, node.Name, false); uncordonErr != nil {
+			err = fmt.Errorf("%w, uncordoning node failed: %w", err, uncordonErr)
+		}
+	}
+
+	result.record(node, sksNodepoolId, nodeStatusInterrupted, err)
+	eventsFrom(ctx).node(ctx, node, nodeStatusInterrupted, corev1.EventTypeWarning, eventReasonInterrupted, "Run was stopped while replacing the node: %v", err)
+	return err
+}
+
+// drainNode evicts all pods from the node, except for pods managed by a DaemonSet. Pods of StatefulSets are evicted
+// last, one at a time and from the highest ordinal down. It returns the workloads whose pods have been moved off the node,
+// each with the generation its controller has to observe before it counts as rolled out (the one of its restart, 0 if it
+// has not been restarted), and the deployments which have been rollout-restarted.
+func drainNode(ctx context.Context, clientset kubernetes.Interface, watcher *clusterWatcher, node corev1.Node, opts cycleOptions) (map[workloadRef]int64, []string, error) {
+	ctx, cancel := withTimeout(ctx, opts.drainTimeout)
+	defer cancel()
+
+	workloads := make(map[workloadRef]int64)
+	// Deployments are restarted and other pods are evicted only once, later passes wait for them to leave the node
+	restarted := make(map[workloadRef]bool)
+	var restartedDeployments []string
+	evicted := make(map[string]bool)
+	var lastRescheduling, lastTerminating int = -1, -1
+	// The drain timeout is reported as such, also when it expires during an eviction or a call to the API
+	timedOut := func(err error) error {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) && !errors.Is(err, errEvictionTimeout) {
+			return fmt.Errorf("%w: node %s is not drained after %s: %w", errEvictionTimeout, node.Name, opts.drainTimeout, err)
+		}
+		return err
+	}
+
+	// Pass over all pods on the node until there are no more reschedulable pods left on the node, starting
+	// another pass whenever a pod or workload changes. Reschedulable pods are pods which are managed by a Deployment.
+	for {
+		var reschedulablePodsCount int = 0
+		var podsTerminatingCount int = 0
+		var statefulSetPods []corev1.Pod
+
+		changed := watcher.changes()
+		pods, err := watcher.nodePods(node.Name)
+		if err != nil {
+			return workloads, restartedDeployments, timedOut(err)
+		}
+
+		for _, pod := range pods {
+			log := loggerFrom(ctx).With(logKeyPod, pod.Name, logKeyNamespace, pod.Namespace)
+			if pod.DeletionTimestamp != nil {
+				podsTerminatingCount += 1
+				log.Debug("Pod is already terminating")
 				continue
 			}
-		
-			// Loop over all pods on the node until there are no more reschedulable pods left on the node.
-			// Reschedulable pods are pods which are managed by a Deployment.
-			for {
-				var reschedulablePodsCount int = 0
-				var podsTerminatingCount int = 0
-
-				pods, err := clientset.CoreV1().Pods("").List(context.Background(), metav1.ListOptions{
-					FieldSelector: "spec.nodeName=" + node.Name,
-				})
-				if err != nil {
-					panic(err.Error())
+
+			podOwnerRef := metav1.GetControllerOf(&pod)
+			if podOwnerRef == nil {
+				log.Debug("Pod has no owner")
+			} else {
+				if podOwnerRef.Kind == "DaemonSet" {
+					log.Debug("Pod is managed by a DaemonSet, skipping eviction")
+					continue
 				}
-	
-				for _, pod := range pods.Items {
-					if pod.DeletionTimestamp != nil {
-						podsTerminatingCount += 1
-						fmt.Printf("Pod %s/%s is already terminating\n", pod.Namespace, pod.Name)
-						continue
+				if podOwnerRef.Kind == "StatefulSet" {
+					if !evicted[pod.Namespace+"/"+pod.Name] {
+						statefulSetPods = append(statefulSetPods, pod)
 					}
+					continue
+				}
 
-					podOwnerRef := metav1.GetControllerOf(&pod)
-					if podOwnerRef == nil {
-						fmt.Printf("pod %s/%s has no owner", pod.Namespace, pod.Name)
-					} else {
-						if podOwnerRef.Kind == "DaemonSet" {
-							fmt.Printf("Pod %s/%s is managed by a DaemonSet, skipping eviction\n", pod.Namespace, pod.Name)
-							continue
-						}
+				deployment, err := watcher.podDeployment(pod)
+				if err != nil {
+					log.Error("Error getting deployment of pod", logKeyError, err)
+				} else if deployment != nil {
+					reschedulablePodsCount += 1
+					workload := workloadRef{kind: "Deployment", namespace: deployment.Namespace, name: deployment.Name}
+					if _, ok := workloads[workload]; !ok {
+						workloads[workload] = 0
+					}
 
-						if podOwnerRef.Kind == "ReplicaSet" {
-							replicaSet, err := clientset.AppsV1().ReplicaSets(pod.Namespace).Get(context.Background(), podOwnerRef.Name, metav1.GetOptions{})
-							if err != nil {
-								fmt.Printf("Error getting replicaSet %s/%s: %v\n", pod.Namespace, podOwnerRef.Name, err)
-							}
-						
-							replicaSetOwnerRef := metav1.GetControllerOf(replicaSet)
-							if replicaSetOwnerRef.Kind == "Deployment" {
-								reschedulablePodsCount += 1
-
-								deployment, err := clientset.AppsV1().Deployments(pod.Namespace).Get(context.Background(), replicaSetOwnerRef.Name, metav1.GetOptions{})
-								if err != nil {
-									fmt.Printf("Error getting deployment %s/%s: %v\n", pod.Namespace, replicaSetOwnerRef.Name, err)
-								}
-
-								if deployment.Status.UnavailableReplicas == 0 {
-									if err := restartDeployment(clientset, *deployment); err != nil {
-										fmt.Printf("Error while restarting deployment: %s", err)
-									}	
-								} else {
-									fmt.Printf("Deployment %s/%s is currently progressing, skipping rollout restart.\n", deployment.Namespace, deployment.Name)
-								}
-
-								continue
-							}
+					if restarted[workload] {
+						continue
+					}
+					if deployment.Status.UnavailableReplicas == 0 {
+						if generation, err := restartDeployment(ctx, clientset, *deployment); err != nil {
+							log.Error("Error while restarting deployment", logKeyError, err)
+						} else {
+							workloads[workload] = generation
+							restartedDeployments = append(restartedDeployments, deployment.Namespace+"/"+deployment.Name)
 						}
+						restarted[workload] = true
+					} else {
+						log.Debug("Deployment is currently progressing, skipping rollout restart", "deployment", deployment.Name)
 					}
 
-					if err := evictPod(clientset, pod); err != nil {
-						fmt.Printf("Error while evicting pod: %s", err)
-					}
+					continue
 				}
+			}
 
-				if reschedulablePodsCount == 0 && podsTerminatingCount == 0 {
-					break
-				} else {
-					fmt.Println("Not all reschedulable pods have been rescheduled, sleeping for 15 seconds.")
-					time.Sleep(time.Second * 15)
+			if evicted[pod.Namespace+"/"+pod.Name] {
+				continue
+			}
+			evicted[pod.Namespace+"/"+pod.Name] = true
+			if err := evictPod(ctx, clientset, watcher.policyVersion, pod, opts.evictionTimeout, opts.evictionTimeoutAction); err != nil {
+				if errors.Is(err, errEvictionTimeout) || ctx.Err() != nil {
+					return workloads, restartedDeployments, timedOut(err)
 				}
+				log.Error("Error while evicting pod", logKeyError, err)
+				continue
 			}
+			addPodWorkload(ctx, watcher, workloads, pod)
+		}
 
-			// if err := waitPodsRunning(clientset); err != nil {
-			// 	fmt.Printf("Error while waiting for pods to be running: %s", err)
-			// }
-
-			if err := egoclient.EvictSKSNodepoolMembers(ctx, exoscaleZone, sksCluster, &sksNodepool, []string{node.Status.NodeInfo.SystemUUID}); err != nil {
-				fmt.Printf("Error while evicting node from nodepool: %s", err)
+		// StatefulSet pods are evicted one at a time, each waiting for its replacement to be ready
+		sortStatefulSetPods(statefulSetPods)
+		for _, pod := range statefulSetPods {
+			evicted[pod.Namespace+"/"+pod.Name] = true
+			if err := drainStatefulSetPod(ctx, clientset, watcher, node, pod, opts); err != nil {
+				if errors.Is(err, errEvictionTimeout) || ctx.Err() != nil {
+					return workloads, restartedDeployments, timedOut(err)
+				}
+				loggerFrom(ctx).Error("Error while evicting StatefulSet pod", logKeyPod, pod.Name, logKeyNamespace, pod.Namespace, logKeyError, err)
+				continue
 			}
-			fmt.Printf("Node %s evicted from nodepool %s\n", node.Name, sksNodepoolId)
-
-			// if err := waitPodsRunning(clientset); err != nil {
-			// 	fmt.Printf("Error while waiting for pods to be running: %s", err)
-			// }
+			addPodWorkload(ctx, watcher, workloads, pod)
 		}
 
+		if reschedulablePodsCount == 0 && podsTerminatingCount == 0 {
+			return workloads, restartedDeployments, nil
+		}
+		if reschedulablePodsCount != lastRescheduling || podsTerminatingCount != lastTerminating {
+			loggerFrom(ctx).Info("Not all reschedulable pods have been rescheduled yet", "rescheduling", reschedulablePodsCount, "terminating", podsTerminatingCount)
+			lastRescheduling, lastTerminating = reschedulablePodsCount, podsTerminatingCount
+		}
+		if err := waitForChange(ctx, changed); errors.Is(err, context.DeadlineExceeded) {
+			return workloads, restartedDeployments, fmt.Errorf("%w: %d pods are still on node %s after %s: %w", errEvictionTimeout, reschedulablePodsCount+podsTerminatingCount, node.Name, opts.drainTimeout, err)
+		} else if err != nil {
+			return workloads, restartedDeployments, err
+		}
+	}
+}
 
-
-	},
+// Add the workload of an evicted pod to the workloads which have to become available again
+func addPodWorkload(ctx context.Context, watcher *clusterWatcher, workloads map[workloadRef]int64, pod corev1.Pod) {
+	workload, err := podWorkload(watcher, pod)
+	if err != nil {
+		loggerFrom(ctx).Error("Error getting workload of pod", logKeyPod, pod.Name, logKeyNamespace, pod.Namespace, logKeyError, err)
+		return
+	}
+	if workload != nil {
+		if _, ok := workloads[*workload]; !ok {
+			workloads[*workload] = 0
+		}
+	}
 }
 
 func init() {
@@ -251,4 +987,94 @@ func init() {
 	// Cobra supports local flags which will only run when this command
 	// is called directly, e.g.:
 	// cycleCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+
+	addCycleFlags(cycleCmd)
+	bindCycleFlags(cycleCmd)
+	cycleCmd.Flags().Bool("resume", false, "Continue an unfinished run from its checkpoint, reconciled against the live state of the cluster")
+	viper.BindPFlag("resume", cycleCmd.Flags().Lookup("resume"))
+	cycleCmd.Flags().Bool("dry-run", false, "Only print which nodes would be replaced (same as \"nodepool plan\"), without changing anything")
+	cycleCmd.Flags().StringP("output", "o", "table", "Output format of --dry-run: table or json")
+}
+
+// Configuration keys of the flags which tune a cycle, by flag name
+var cycleFlagKeys = map[string]string{
+	"eviction-timeout":        "eviction_timeout",
+	"eviction-timeout-action": "eviction_timeout_action",
+	"workload-timeout":        "workload_timeout",
+	"node-ready-timeout":      "node_ready_timeout",
+	"drain-timeout":           "drain_timeout",
+	"sks-evict-timeout":       "sks_evict_timeout",
+	"checkpoint":              "checkpoint",
+	"failure-policy":          "failure_policy",
+	"restore-nodepool-size":   "restore_nodepool_size",
+	"report":                  "report",
+	"report-format":           "report_format",
+	"notify-url":              "notify_url",
+	"notify-format":           "notify_format",
+	"notify-template":         "notify_template",
+	"notify-events":           "notify_events",
+	"max-unavailable":         "max_unavailable",
+	"parallel-nodepools":      "parallel_nodepools",
+}
+
+// Configuration keys of the flags which decide which nodes are cycled in which order, by flag name. They are shared
+// by the commands which run cycles and the plan, so both select nodes the same way.
+var nodepoolFlagKeys = map[string]string{
+	"surge":            "surge_count",
+	"nodepool":         "nodepool",
+	"exclude-nodepool": "exclude_nodepool",
+	"nodepool-order":   "nodepool_order",
+}
+
+// Add the flags which decide which nodes are cycled in which order
+func addNodepoolFlags(cmd *cobra.Command) {
+	cmd.Flags().Int("surge", 1, "Number of nodes the nodepool is scaled up by before old nodes are drained, also the most nodes of a nodepool which are replaced at the same time (0 disables surging)")
+	cmd.Flags().String("nodepool", "", "Comma-separated IDs or names of the nodepools which are cycled (empty cycles all nodepools)")
+	cmd.Flags().String("exclude-nodepool", "", "Comma-separated IDs or names of the nodepools which are not cycled")
+	cmd.Flags().String("nodepool-order", nodepoolOrderName, "Order in which nodepools are cycled: name, size (smallest first) or listed (in the order of --nodepool)")
+}
+
+// Add the flags which tune a cycle to a command which runs cycles
+func addCycleFlags(cmd *cobra.Command) {
+	addNodepoolFlags(cmd)
+	cmd.Flags().Duration("eviction-timeout", 5*time.Minute, "How long the eviction of a pod is retried while a PodDisruptionBudget blocks it (0 does not retry it)")
+	cmd.Flags().String("eviction-timeout-action", evictionTimeoutActionAbort, "What to do with a pod which could not be evicted in time: abort (skip the node) or delete (force-delete the pod)")
+	cmd.Flags().Duration("workload-timeout", 5*time.Minute, "How long to wait for each workload with pods on a drained node to be available again, before the node is evicted from its nodepool (0 disables waiting)")
+	cmd.Flags().Duration("node-ready-timeout", 20*time.Minute, "How long to wait for surge nodes and all other nodes to be ready before a node is cordoned (0 disables the timeout)")
+	cmd.Flags().Duration("drain-timeout", time.Hour, "How long draining a single node may take in total (0 disables the timeout)")
+	cmd.Flags().Duration("sks-evict-timeout", 10*time.Minute, "How long to wait for a drained node to be evicted from its nodepool (0 disables the timeout)")
+	cmd.Flags().String("checkpoint", "", "Where the progress of the run is persisted after every step: file:<path> or configmap:<namespace>/<name> (empty disables checkpoints)")
+	cmd.Flags().String("failure-policy", failurePolicyRollback, "What to do with a node whose replacement failed: rollback (uncordon it and continue), leave (keep it cordoned and continue) or abort-all (uncordon it and stop the cycle)")
+	cmd.Flags().Bool("restore-nodepool-size", false, "When rolling back a failed node, also remove the empty surge nodes which have not been used up from its nodepool")
+	cmd.Flags().String("report", "", "Path the report of the run is written to once it is done (empty disables the report)")
+	cmd.Flags().String("report-format", "", "Format of the report: json, markdown or junit (by default inferred from the extension of the path: .json, .md or .xml)")
+	cmd.Flags().String("notify-url", "", "Comma-separated webhook URLs notifications of the run are posted to (empty disables notifications)")
+	cmd.Flags().String("notify-format", notifyFormatGeneric, "Payload of the notifications: generic (JSON), slack or teams")
+	cmd.Flags().String("notify-template", "", "Path of a Go template which renders the message of a notification (empty uses the default message)")
+	cmd.Flags().String("max-unavailable", "1", "Number of nodes per nodepool which are replaced at the same time, a count or a percentage of the nodepool size like 25% (rounded down, at least 1). With surging, at most --surge nodes are replaced at the same time")
+	cmd.Flags().Int("parallel-nodepools", 1, "Number of nodepools whose nodes are replaced at the same time")
+	cmd.Flags().String("notify-events", "", "Comma-separated events notifications are sent for: "+strings.Join(notifyEvents, ", ")+" (empty sends all)")
+}
+
+// Bind the cycle flags of the command to their configuration keys. Several commands share the keys, so a command
+// which is not bound in init has to bind its flags once it is known to be the one which runs.
+func bindCycleFlags(cmd *cobra.Command) error {
+	if err := bindNodepoolFlags(cmd); err != nil {
+		return err
+	}
+	return bindFlags(cmd, cycleFlagKeys)
+}
+
+// Bind the nodepool flags of the command to their configuration keys, see bindCycleFlags
+func bindNodepoolFlags(cmd *cobra.Command) error {
+	return bindFlags(cmd, nodepoolFlagKeys)
+}
+
+func bindFlags(cmd *cobra.Command, keys map[string]string) error {
+	for name, key := range keys {
+		if err := viper.BindPFlag(key, cmd.Flags().Lookup(name)); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,241 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func init() {
+	pollInterval = 10 * time.Millisecond
+	evictionBackoff.Duration = time.Millisecond
+	evictionBackoff.Cap = 5 * time.Millisecond
+}
+
+// testCycleOptions returns valid options of a cycle to v1.29.3 without surging, which replaces one node at a time.
+// Tests set the options they are about on top of them.
+func testCycleOptions() cycleOptions {
+	return cycleOptions{
+		desiredK8sVersion:     "v1.29.3",
+		parallelNodepools:     1,
+		evictionTimeoutAction: evictionTimeoutActionAbort,
+		failurePolicy:         failurePolicyRollback,
+	}
+}
+
+func TestRunCycleReplacesOutdatedNodes(t *testing.T) {
+	ctx := context.Background()
+	clientset := fake.NewSimpleClientset()
+	provider := newFakeSKSProvider(clientset, "1.29.3")
+	provider.creationDelay = 30 * time.Millisecond
+	provider.addNodepool("np-1", "workers", "v1.28.7", 2)
+	provider.setNodepoolVersion("np-1", "v1.29.3")
+
+	opts := testCycleOptions()
+	opts.surgeCount = 1
+	result, err := runCycle(ctx, clientset, provider, opts)
+	if err != nil {
+		t.Fatalf("runCycle() error = %v", err)
+	}
+	if err := result.err(); err != nil {
+		t.Errorf("result error = %v, want nil", err)
+	}
+
+	if size := provider.nodepoolSize("np-1"); size != 2 {
+		t.Errorf("nodepool size = %d, want 2", size)
+	}
+	if evictions := provider.callCount("EvictNodepoolMembers"); evictions != 2 {
+		t.Errorf("nodepool evictions = %d, want 2", evictions)
+	}
+
+	nodes, err := clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes.Items) != 2 {
+		t.Errorf("nodes = %d, want 2", len(nodes.Items))
+	}
+	for _, node := range nodes.Items {
+		if node.Status.NodeInfo.KubeletVersion != "v1.29.3" {
+			t.Errorf("node %s is on version %s, want v1.29.3", node.Name, node.Status.NodeInfo.KubeletVersion)
+		}
+	}
+}
+
+func TestRunCycleSkipsNodeWhenScalingFails(t *testing.T) {
+	ctx := context.Background()
+	clientset := fake.NewSimpleClientset()
+	provider := newFakeSKSProvider(clientset, "1.29.3")
+	provider.addNodepool("np-1", "workers", "v1.28.7", 1)
+	provider.failNext("ScaleNodepool", errors.New("quota exceeded"))
+
+	opts := testCycleOptions()
+	opts.surgeCount = 1
+	result, err := runCycle(ctx, clientset, provider, opts)
+	if err != nil {
+		t.Fatalf("runCycle() error = %v", err)
+	}
+	if code := exitCode(result.err()); code != exitCodePartialFailure {
+		t.Errorf("exit code = %d, want %d", code, exitCodePartialFailure)
+	}
+	if status := result.Nodes[0].Status; status != nodeStatusFailed {
+		t.Errorf("node status = %s, want %s", status, nodeStatusFailed)
+	}
+
+	if evictions := provider.callCount("EvictNodepoolMembers"); evictions != 0 {
+		t.Errorf("nodepool evictions = %d, want 0", evictions)
+	}
+
+	nodes, err := clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes.Items) != 1 || nodes.Items[0].Spec.Unschedulable {
+		t.Errorf("expected the node to be left untouched, got %+v", nodes.Items)
+	}
+}
+
+func TestRunCycleUncordonsNodeWhenInterrupted(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	clientset := fake.NewSimpleClientset()
+	provider := newFakeSKSProvider(clientset, "1.29.3")
+	provider.addNodepool("np-1", "workers", "v1.28.7", 2)
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "standalone", Namespace: "default"},
+		Spec:       corev1.PodSpec{NodeName: "pool-workers-1"},
+		Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+	if _, err := clientset.CoreV1().Pods("default").Create(ctx, pod, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The run is stopped while the first node is being drained
+	clientset.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "eviction" {
+			return false, nil, nil
+		}
+		cancel()
+		return true, nil, disruptionBudgetError()
+	})
+
+	opts := testCycleOptions()
+	opts.evictionTimeout = time.Minute
+	result, err := runCycle(ctx, clientset, provider, opts)
+	if code := exitCode(err); code != exitCodeInterrupted {
+		t.Fatalf("exit code = %d, want %d (error %v)", code, exitCodeInterrupted, err)
+	}
+	if len(result.Nodes) != 1 || result.Nodes[0].Status != nodeStatusInterrupted {
+		t.Fatalf("results = %+v, want the first node to be interrupted", result.Nodes)
+	}
+
+	if evictions := provider.callCount("EvictNodepoolMembers"); evictions != 0 {
+		t.Errorf("nodepool evictions = %d, want 0", evictions)
+	}
+	nodes, err := clientset.CoreV1().Nodes().List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range nodes.Items {
+		if node.Spec.Unschedulable {
+			t.Errorf("node %s is left cordoned", node.Name)
+		}
+	}
+}
+
+func TestRunCycleEvictsWithTheDetectedPolicyVersion(t *testing.T) {
+	ctx := context.Background()
+	clientset := fake.NewSimpleClientset()
+	provider := newFakeSKSProvider(clientset, "1.29.3")
+	provider.addNodepool("np-1", "workers", "v1.28.7", 2)
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", Labels: map[string]string{"app": "web"}},
+		Spec:       corev1.PodSpec{NodeName: "pool-workers-1"},
+		Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+	if _, err := clientset.CoreV1().Pods("default").Create(ctx, pod, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	pdb := &policyv1beta1.PodDisruptionBudget{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec:       policyv1beta1.PodDisruptionBudgetSpec{Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}}},
+	}
+	if _, err := clientset.PolicyV1beta1().PodDisruptionBudgets("default").Create(ctx, pdb, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The fake server does not serve policy/v1, the first evictions are refused
+	var mu sync.Mutex
+	refused := 0
+	clientset.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "eviction" {
+			return false, nil, nil
+		}
+		if _, ok := action.(k8stesting.CreateAction).GetObject().(*policyv1beta1.Eviction); !ok {
+			t.Errorf("eviction = %T, want a policy/v1beta1 eviction", action.(k8stesting.CreateAction).GetObject())
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if refused < 3 {
+			refused += 1
+			return true, nil, disruptionBudgetError()
+		}
+		return true, nil, clientset.Tracker().Delete(corev1.SchemeGroupVersion.WithResource("pods"), "default", "web")
+	})
+
+	opts := testCycleOptions()
+	opts.evictionTimeout = time.Minute
+	if _, err := runCycle(ctx, clientset, provider, opts); err != nil {
+		t.Fatalf("runCycle() error = %v", err)
+	}
+
+	discoveries := 0
+	for _, action := range clientset.Actions() {
+		if action.GetVerb() == "get" && action.GetResource().Resource == "resource" {
+			discoveries += 1
+		}
+		if action.GetVerb() == "list" && action.GetResource().Resource == "poddisruptionbudgets" && action.GetResource().Version != "v1beta1" {
+			t.Errorf("PodDisruptionBudgets listed with policy/%s, want policy/v1beta1", action.GetResource().Version)
+		}
+	}
+	if discoveries != 1 {
+		t.Errorf("policy API discoveries = %d, want 1 per run", discoveries)
+	}
+}
+
+func TestRunCycleAbortsAllOnFailureWithAbortAllPolicy(t *testing.T) {
+	ctx := context.Background()
+	clientset := fake.NewSimpleClientset()
+	provider := newFakeSKSProvider(clientset, "1.29.3")
+	provider.addNodepool("np-1", "workers", "v1.28.7", 2)
+	provider.failNext("ScaleNodepool", errors.New("quota exceeded"))
+
+	opts := testCycleOptions()
+	opts.surgeCount = 1
+	opts.failurePolicy = failurePolicyAbortAll
+	result, err := runCycle(ctx, clientset, provider, opts)
+	if code := exitCode(err); code != exitCodeSafetyAbort {
+		t.Fatalf("exit code = %d, want %d (error %v)", code, exitCodeSafetyAbort, err)
+	}
+	if len(result.Nodes) != 1 || result.Nodes[0].Status != nodeStatusFailed {
+		t.Errorf("results = %+v, want only the first node to be failed", result.Nodes)
+	}
+	// The node keeps the class of its own failure
+	if code := exitCode(result.Nodes[0].Err); code != exitCodeExoscaleAPI {
+		t.Errorf("node exit code = %d, want %d", code, exitCodeExoscaleAPI)
+	}
+	if scales := provider.callCount("ScaleNodepool"); scales != 1 {
+		t.Errorf("nodepool scale-ups = %d, want 1", scales)
+	}
+}
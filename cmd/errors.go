@@ -0,0 +1,154 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// errorClass groups errors by their cause, each class maps to a distinct exit code
+type errorClass int
+
+const (
+	errorClassUnknown errorClass = iota
+	// Invalid or missing configuration
+	errorClassConfig
+	// A call to the Kubernetes API failed
+	errorClassKubernetesAPI
+	// A call to the Exoscale API failed
+	errorClassExoscaleAPI
+	// A pod could not be evicted in time while draining a node, or its workload did not become available in time
+	errorClassDrainTimeout
+	// A safety check failed and the cycle was aborted
+	errorClassSafetyAbort
+	// The cycle completed, but not all selected nodes could be replaced
+	errorClassPartialFailure
+	// No node was selected for replacement
+	errorClassNothingToDo
+	// The run was stopped by SIGINT, SIGTERM, its deadline or the loss of its lock before it completed
+	errorClassInterrupted
+	// Another instance holds the cluster-wide lock
+	errorClassLocked
+)
+
+// Names of the error classes, as they are reported in metrics
+var errorClassNames = map[errorClass]string{
+	errorClassUnknown:        "unknown",
+	errorClassConfig:         "config",
+	errorClassKubernetesAPI:  "kubernetes-api",
+	errorClassExoscaleAPI:    "exoscale-api",
+	errorClassDrainTimeout:   "drain-timeout",
+	errorClassSafetyAbort:    "safety-abort",
+	errorClassPartialFailure: "partial-failure",
+	errorClassNothingToDo:    "nothing-to-do",
+	errorClassInterrupted:    "interrupted",
+	errorClassLocked:         "locked",
+}
+
+func (c errorClass) String() string {
+	return errorClassNames[c]
+}
+
+// Exit codes of the process, so pipelines can tell the outcome of a run apart
+const (
+	exitCodeSuccess        int = 0
+	exitCodeUnknown        int = 1
+	exitCodeConfig         int = 2
+	exitCodeKubernetesAPI  int = 3
+	exitCodeExoscaleAPI    int = 4
+	exitCodeDrainTimeout   int = 5
+	exitCodeSafetyAbort    int = 6
+	exitCodePartialFailure int = 7
+	exitCodeNothingToDo    int = 8
+	exitCodeInterrupted    int = 9
+	exitCodeLocked         int = 10
+)
+
+var exitCodes = map[errorClass]int{
+	errorClassUnknown:        exitCodeUnknown,
+	errorClassConfig:         exitCodeConfig,
+	errorClassKubernetesAPI:  exitCodeKubernetesAPI,
+	errorClassExoscaleAPI:    exitCodeExoscaleAPI,
+	errorClassDrainTimeout:   exitCodeDrainTimeout,
+	errorClassSafetyAbort:    exitCodeSafetyAbort,
+	errorClassPartialFailure: exitCodePartialFailure,
+	errorClassNothingToDo:    exitCodeNothingToDo,
+	errorClassInterrupted:    exitCodeInterrupted,
+	errorClassLocked:         exitCodeLocked,
+}
+
+// errNothingToDo is returned when no node had to be replaced
+var errNothingToDo = &classifiedError{class: errorClassNothingToDo, err: errors.New("no node is selected for replacement")}
+
+// classifiedError attaches an errorClass to an error
+type classifiedError struct {
+	class errorClass
+	err   error
+}
+
+func (e *classifiedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *classifiedError) Unwrap() error {
+	return e.err
+}
+
+// Attach the class to the error, unless it is nil or has already been classified
+func classify(class errorClass, err error) error {
+	if err == nil || errorClassOf(err) != errorClassUnknown {
+		return err
+	}
+	return &classifiedError{class: class, err: err}
+}
+
+func configError(format string, args ...any) error {
+	return &classifiedError{class: errorClassConfig, err: fmt.Errorf(format, args...)}
+}
+
+func kubernetesError(err error) error {
+	return classify(errorClassKubernetesAPI, err)
+}
+
+func exoscaleError(err error) error {
+	return classify(errorClassExoscaleAPI, err)
+}
+
+// Classify the error which aborted the cycle. The abort takes precedence over the class of the error which caused it.
+func safetyAbortError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &classifiedError{class: errorClassSafetyAbort, err: err}
+}
+
+// Get the error of a run whose context is done, telling a signal apart from the run deadline and other causes
+func interruptedError(ctx context.Context) error {
+	if cause := context.Cause(ctx); cause != nil && cause != ctx.Err() {
+		return &classifiedError{class: errorClassInterrupted, err: fmt.Errorf("run was interrupted: %w", cause)}
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return &classifiedError{class: errorClassInterrupted, err: fmt.Errorf("run timeout exceeded: %w", ctx.Err())}
+	}
+	return &classifiedError{class: errorClassInterrupted, err: fmt.Errorf("run was interrupted: %w", ctx.Err())}
+}
+
+// Get the class of an error, errors which have not been classified are of errorClassUnknown
+func errorClassOf(err error) errorClass {
+	var classified *classifiedError
+	if errors.As(err, &classified) {
+		return classified.class
+	}
+	if errors.Is(err, errEvictionTimeout) || errors.Is(err, errWorkloadTimeout) {
+		return errorClassDrainTimeout
+	}
+	return errorClassUnknown
+}
+
+// Get the exit code of the process for the error returned by a command
+func exitCode(err error) int {
+	if err == nil {
+		return exitCodeSuccess
+	}
+	return exitCodes[errorClassOf(err)]
+}
@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+func TestExitCode(t *testing.T) {
+	stopped, stop := context.WithCancel(context.Background())
+	stop()
+
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"success", nil, exitCodeSuccess},
+		{"unclassified", errors.New("boom"), exitCodeUnknown},
+		{"configuration", configError("invalid surge count %d", -1), exitCodeConfig},
+		{"kubernetes", kubernetesError(errors.New("connection refused")), exitCodeKubernetesAPI},
+		{"exoscale", fmt.Errorf("scaling nodepool: %w", exoscaleError(errors.New("quota exceeded"))), exitCodeExoscaleAPI},
+		{"drain timeout", fmt.Errorf("%w default/web after 5m0s", errEvictionTimeout), exitCodeDrainTimeout},
+		{"drain timeout is not reclassified", kubernetesError(fmt.Errorf("%w default/web", errEvictionTimeout)), exitCodeDrainTimeout},
+		{"safety abort", safetyAbortError(errors.New("nodes are not ready")), exitCodeSafetyAbort},
+		{"safety abort takes precedence", safetyAbortError(fmt.Errorf("cycle aborted: %w", exoscaleError(errors.New("quota exceeded")))), exitCodeSafetyAbort},
+		{"nothing to do", errNothingToDo, exitCodeNothingToDo},
+		{"interrupted", interruptedError(stopped), exitCodeInterrupted},
+		{"locked", lockedError("kube-system/exoscale-sks-lifecycler", &resourcelock.LeaderElectionRecord{HolderIdentity: "other"}), exitCodeLocked},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exitCode(tt.err); got != tt.want {
+				t.Errorf("exitCode(%v) = %d, want %d", tt.err, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// Component events are reported by
+const eventComponent string = "exoscale-sks-lifecycler"
+
+// Annotations of nodes and events, which record what the lifecycler did to a node and in which run
+const (
+	annotationRunId         string = "sks-lifecycler.whizus.com/run-id"
+	annotationTargetVersion string = "sks-lifecycler.whizus.com/target-version"
+	annotationState         string = "sks-lifecycler.whizus.com/state"
+)
+
+// States of a node in its annotation, in addition to the statuses of nodeResult
+const (
+	nodeStateSelected string = "selected"
+	nodeStateCordoned string = "cordoned"
+	nodeStateDrained  string = "drained"
+	nodeStateEvicted  string = "evicted"
+)
+
+// Reasons of the events
+const (
+	eventReasonSelected         string = "SelectedForReplacement"
+	eventReasonSkipped          string = "ReplacementSkipped"
+	eventReasonCordoned         string = "Cordoned"
+	eventReasonDrained          string = "Drained"
+	eventReasonEvicted          string = "EvictedFromNodepool"
+	eventReasonFailed           string = "ReplacementFailed"
+	eventReasonInterrupted      string = "ReplacementInterrupted"
+	eventReasonRolloutRestarted string = "RolloutRestarted"
+	eventReasonPodEvicted       string = "Evicted"
+	eventReasonPodDeleted       string = "Deleted"
+)
+
+// lifecycleEvents records Kubernetes events for the actions of a run and annotates the nodes it acts on.
+// A nil lifecycleEvents records nothing.
+type lifecycleEvents struct {
+	clientset     kubernetes.Interface
+	broadcaster   record.EventBroadcaster
+	recorder      record.EventRecorder
+	runId         string
+	targetVersion string
+}
+
+type eventsContextKey struct{}
+
+func newLifecycleEvents(clientset kubernetes.Interface, runId string, targetVersion string) *lifecycleEvents {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+	return &lifecycleEvents{
+		clientset:     clientset,
+		broadcaster:   broadcaster,
+		recorder:      broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: eventComponent}),
+		runId:         runId,
+		targetVersion: targetVersion,
+	}
+}
+
+// Stop recording, events which have been recorded already are still sent
+func (e *lifecycleEvents) shutdown() {
+	if e == nil {
+		return
+	}
+	e.broadcaster.Shutdown()
+}
+
+// Attach the events of the run to the context, so every action can record its events
+func withEvents(ctx context.Context, events *lifecycleEvents) context.Context {
+	return context.WithValue(ctx, eventsContextKey{}, events)
+}
+
+// Get the events of the run from the context, nil if there are none
+func eventsFrom(ctx context.Context) *lifecycleEvents {
+	events, _ := ctx.Value(eventsContextKey{}).(*lifecycleEvents)
+	return events
+}
+
+// Record an event on the object, with the target version and the run ID in its message and annotations
+func (e *lifecycleEvents) event(object runtime.Object, eventType string, reason string, format string, args ...any) {
+	if e == nil {
+		return
+	}
+	annotations := map[string]string{annotationRunId: e.runId, annotationTargetVersion: e.targetVersion}
+	message := fmt.Sprintf(format, args...)
+	e.recorder.AnnotatedEventf(object, annotations, eventType, reason, "%s (target version %s, run %s)", message, e.targetVersion, e.runId)
+}
+
+// Record an event on the node and annotate it with its state. A failure to annotate the node is logged, but does not
+// stop the run.
+func (e *lifecycleEvents) node(ctx context.Context, node corev1.Node, state string, eventType string, reason string, format string, args ...any) {
+	if e == nil {
+		return
+	}
+	e.event(&node, eventType, reason, format, args...)
+
+	patch, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{
+			"annotations": map[string]string{
+				annotationState:         state,
+				annotationRunId:         e.runId,
+				annotationTargetVersion: e.targetVersion,
+			},
+		},
+	})
+	if err != nil {
+		loggerFrom(ctx).Warn("Error while annotating node", logKeyError, err)
+		return
+	}
+	// The annotations are also written once the run has been stopped
+	patchCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+	defer cancel()
+	_, err = e.clientset.CoreV1().Nodes().Patch(patchCtx, node.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		loggerFrom(ctx).Warn("Error while annotating node", logKeyError, err)
+	}
+}
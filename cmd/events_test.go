@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestRunCycleRecordsEventsAndAnnotatesNode(t *testing.T) {
+	ctx := context.Background()
+	clientset := fake.NewSimpleClientset()
+	provider := newFakeSKSProvider(clientset, "1.29.3")
+	provider.addNodepool("np-1", "workers", "v1.28.7", 1)
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "standalone", Namespace: "default"},
+		Spec:       corev1.PodSpec{NodeName: "pool-workers-1"},
+		Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+	if _, err := clientset.CoreV1().Pods("default").Create(ctx, pod, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	clientset.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "eviction" {
+			return false, nil, nil
+		}
+		return true, nil, clientset.Tracker().Delete(corev1.SchemeGroupVersion.WithResource("pods"), "default", "standalone")
+	})
+
+	if _, err := runCycle(ctx, clientset, provider, testCycleOptions()); err != nil {
+		t.Fatalf("runCycle() error = %v", err)
+	}
+
+	// Events are sent in the background
+	want := []string{eventReasonSelected, eventReasonCordoned, eventReasonPodEvicted, eventReasonDrained, eventReasonEvicted}
+	var events *corev1.EventList
+	err := wait.PollUntilContextTimeout(ctx, 10*time.Millisecond, 5*time.Second, true, func(ctx context.Context) (bool, error) {
+		var err error
+		events, err = clientset.CoreV1().Events("").List(ctx, metav1.ListOptions{})
+		return err == nil && len(events.Items) >= len(want), err
+	})
+	if err != nil {
+		t.Fatalf("events = %+v, want %v: %v", events, want, err)
+	}
+
+	runIds := make(map[string]bool)
+	reasons := make(map[string]bool)
+	for _, event := range events.Items {
+		reasons[event.Reason] = true
+		runIds[event.Annotations[annotationRunId]] = true
+		if event.Annotations[annotationTargetVersion] != "v1.29.3" {
+			t.Errorf("event %s has target version %q, want v1.29.3", event.Reason, event.Annotations[annotationTargetVersion])
+		}
+	}
+	for _, reason := range want {
+		if !reasons[reason] {
+			t.Errorf("no %s event has been recorded", reason)
+		}
+	}
+	if len(runIds) != 1 || runIds[""] {
+		t.Errorf("events have run IDs %v, want a single one", runIds)
+	}
+
+	// The last annotation of the node records that it has been evicted from its nodepool
+	var annotations map[string]string
+	for _, action := range clientset.Actions() {
+		if patch, ok := action.(k8stesting.PatchAction); ok && action.GetResource().Resource == "nodes" {
+			var patched struct {
+				Metadata struct {
+					Annotations map[string]string `json:"annotations"`
+				} `json:"metadata"`
+			}
+			if err := json.Unmarshal(patch.GetPatch(), &patched); err != nil {
+				t.Fatal(err)
+			}
+			annotations = patched.Metadata.Annotations
+		}
+	}
+	if annotations[annotationState] != nodeStateEvicted || !runIds[annotations[annotationRunId]] {
+		t.Errorf("node annotations = %v, want state %s and the run ID of the events", annotations, nodeStateEvicted)
+	}
+}
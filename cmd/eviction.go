@@ -0,0 +1,190 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// Abort the replacement of the node, if a pod could not be evicted in time
+	evictionTimeoutActionAbort string = "abort"
+	// Delete the pod, if it could not be evicted in time, ignoring its PodDisruptionBudget
+	evictionTimeoutActionDelete string = "delete"
+)
+
+// errEvictionTimeout is returned when a pod could not be evicted in time and the node has to be aborted
+var errEvictionTimeout = errors.New("timed out evicting pod")
+
+// Backoff between eviction attempts, which are refused because of a PodDisruptionBudget
+var evictionBackoff = wait.Backoff{
+	Duration: 5 * time.Second,
+	Factor:   2,
+	Jitter:   0.1,
+	Steps:    math.MaxInt32,
+	Cap:      time.Minute,
+}
+
+// Detect the version of the policy API which the server serves evictions and PodDisruptionBudgets with, policy/v1
+// if the server supports it and policy/v1beta1 otherwise
+func detectPolicyVersion(clientset kubernetes.Interface) string {
+	if _, err := clientset.Discovery().ServerResourcesForGroupVersion(policyv1.SchemeGroupVersion.String()); err == nil {
+		return policyv1.SchemeGroupVersion.Version
+	}
+	return policyv1beta1.SchemeGroupVersion.Version
+}
+
+// Evict a pod with the given version of the policy API. Evictions refused because of a PodDisruptionBudget are retried
+// with backoff until the timeout is reached, after which the pod is either deleted or errEvictionTimeout is returned,
+// depending on timeoutAction. A timeout of 0 gives up after the first refusal. Evictions which the API server throttles
+// are retried once it suggests to, regardless of the timeout.
+func evictPod(ctx context.Context, clientset kubernetes.Interface, policyVersion string, pod corev1.Pod, timeout time.Duration, timeoutAction string) error {
+	log := loggerFrom(ctx).With(logKeyPod, pod.Name, logKeyNamespace, pod.Namespace)
+	deadline := time.Now().Add(timeout)
+	backoff := evictionBackoff
+	throttleBackoff := evictionBackoff
+
+	for {
+		err := createEviction(ctx, clientset, policyVersion, pod)
+		if err == nil || apierrors.IsNotFound(err) {
+			log.Info("Pod evicted")
+			if err == nil {
+				eventsFrom(ctx).event(&pod, corev1.EventTypeNormal, eventReasonPodEvicted, "Pod has been evicted to drain node %s", pod.Spec.NodeName)
+			}
+			return nil
+		}
+		if !apierrors.IsTooManyRequests(err) {
+			log.Error("Error evicting pod", logKeyError, err)
+			return err
+		}
+		if !isDisruptionBudgetViolation(err) {
+			delay := throttleBackoff.Step()
+			if seconds, ok := apierrors.SuggestsClientDelay(err); ok {
+				delay = time.Duration(seconds) * time.Second
+			}
+			log.Warn("Eviction of pod is throttled by the API server", logKeyError, err, "retry_in", delay)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(delay):
+			}
+			continue
+		}
+
+		// The eviction would violate a PodDisruptionBudget
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			break
+		}
+		delay := min(backoff.Step(), remaining)
+		evictionRetriesTotal.Inc()
+		log.Warn("Eviction of pod is blocked by a PodDisruptionBudget", "pdb", blockingPodDisruptionBudgets(ctx, clientset, policyVersion, pod), "retry_in", delay)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+
+	if timeoutAction == evictionTimeoutActionDelete {
+		log.Warn("Pod could not be evicted in time, deleting it", "timeout", timeout)
+		if err := clientset.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		eventsFrom(ctx).event(&pod, corev1.EventTypeWarning, eventReasonPodDeleted, "Pod could not be evicted within %s, it has been deleted to drain node %s", timeout, pod.Spec.NodeName)
+		return nil
+	}
+
+	return fmt.Errorf("%w %s/%s after %s", errEvictionTimeout, pod.Namespace, pod.Name, timeout)
+}
+
+// Check whether an eviction has been refused, because it would violate a PodDisruptionBudget. The API server refuses
+// it with 429 Too Many Requests, just like requests it throttles, the status cause tells them apart. API servers which
+// do not set the cause yet only tell it in the message.
+func isDisruptionBudgetViolation(err error) bool {
+	if !apierrors.IsTooManyRequests(err) {
+		return false
+	}
+	if apierrors.HasStatusCause(err, policyv1.DisruptionBudgetCause) {
+		return true
+	}
+	var status apierrors.APIStatus
+	return errors.As(err, &status) && strings.Contains(status.Status().Message, "disruption budget")
+}
+
+// Create the eviction of a pod
+func createEviction(ctx context.Context, clientset kubernetes.Interface, policyVersion string, pod corev1.Pod) error {
+	if policyVersion == policyv1.SchemeGroupVersion.Version {
+		return clientset.CoreV1().Pods(pod.Namespace).EvictV1(ctx, &policyv1.Eviction{
+			ObjectMeta:    metav1.ObjectMeta{Namespace: pod.Namespace, Name: pod.Name},
+			DeleteOptions: &metav1.DeleteOptions{},
+		})
+	}
+
+	return clientset.CoreV1().Pods(pod.Namespace).EvictV1beta1(ctx, &policyv1beta1.Eviction{
+		ObjectMeta:    metav1.ObjectMeta{Namespace: pod.Namespace, Name: pod.Name},
+		DeleteOptions: &metav1.DeleteOptions{},
+	})
+}
+
+// Get the names of the PodDisruptionBudgets which select the pod, listed with the given version of the policy API
+func blockingPodDisruptionBudgets(ctx context.Context, clientset kubernetes.Interface, policyVersion string, pod corev1.Pod) string {
+	selectors, err := podDisruptionBudgetSelectors(ctx, clientset, policyVersion, pod.Namespace)
+	if err != nil {
+		return "<unknown>"
+	}
+
+	var names []string
+	for name, labelSelector := range selectors {
+		selector, err := metav1.LabelSelectorAsSelector(labelSelector)
+		if err != nil || selector.Empty() {
+			continue
+		}
+		if selector.Matches(labels.Set(pod.Labels)) {
+			names = append(names, pod.Namespace+"/"+name)
+		}
+	}
+	if len(names) == 0 {
+		return "<unknown>"
+	}
+
+	slices.Sort(names)
+	return strings.Join(names, ", ")
+}
+
+// List the selectors of the PodDisruptionBudgets of a namespace by name
+func podDisruptionBudgetSelectors(ctx context.Context, clientset kubernetes.Interface, policyVersion string, namespace string) (map[string]*metav1.LabelSelector, error) {
+	selectors := make(map[string]*metav1.LabelSelector)
+	if policyVersion == policyv1.SchemeGroupVersion.Version {
+		pdbs, err := clientset.PolicyV1().PodDisruptionBudgets(namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		for _, pdb := range pdbs.Items {
+			selectors[pdb.Name] = pdb.Spec.Selector
+		}
+		return selectors, nil
+	}
+
+	pdbs, err := clientset.PolicyV1beta1().PodDisruptionBudgets(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, pdb := range pdbs.Items {
+		selectors[pdb.Name] = pdb.Spec.Selector
+	}
+	return selectors, nil
+}
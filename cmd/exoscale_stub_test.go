@@ -0,0 +1,262 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// exoscaleStub is a local stand-in for the parts of the Exoscale v2 API the lifecycler uses.
+// Nodepool members are backed by Nodes in a fake clientset: scaling a nodepool up registers
+// ready nodes, evicting a member deletes its node.
+type exoscaleStub struct {
+	mu sync.Mutex
+
+	server       *httptest.Server
+	clientset    *fake.Clientset
+	recorder     *actionRecorder
+	sksClusterId string
+	version      string
+	// Versions listed as available for SKS clusters, defaults to the cluster version
+	versions  []string
+	nodepools []*stubNodepool
+
+	instanceCount int
+}
+
+type stubNodepool struct {
+	id        string
+	name      string
+	version   string
+	instances []stubInstance
+}
+
+type stubInstance struct {
+	id       string
+	nodeName string
+}
+
+func newExoscaleStub(clientset *fake.Clientset, recorder *actionRecorder, version string) *exoscaleStub {
+	stub := &exoscaleStub{
+		clientset:    clientset,
+		recorder:     recorder,
+		sksClusterId: "00000000-0000-0000-0000-000000000000",
+		version:      version,
+		versions:     []string{version},
+	}
+	stub.server = httptest.NewServer(http.HandlerFunc(stub.serveHTTP))
+
+	return stub
+}
+
+func (s *exoscaleStub) close() {
+	s.server.Close()
+}
+
+// addNodepool registers a nodepool whose members back the given, already existing nodes
+func (s *exoscaleStub) addNodepool(id string, name string, version string, nodeNames []string) map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	instanceIds := make(map[string]string)
+	nodepool := &stubNodepool{id: id, name: name, version: version}
+	for _, nodeName := range nodeNames {
+		instanceIds[nodeName] = s.newInstance(nodepool, nodeName).id
+	}
+	s.nodepools = append(s.nodepools, nodepool)
+
+	return instanceIds
+}
+
+func (s *exoscaleStub) nodepoolSize(id string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if nodepool := s.nodepool(id); nodepool != nil {
+		return len(nodepool.instances)
+	}
+	return 0
+}
+
+func (s *exoscaleStub) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := strings.Split(strings.TrimPrefix(r.URL.Path, "/v2/"), "/")
+
+	switch {
+	case r.Method == http.MethodGet && len(path) == 2 && path[0] == "sks-cluster" && path[1] == s.sksClusterId:
+		nodepools := make([]map[string]any, 0, len(s.nodepools))
+		for _, nodepool := range s.nodepools {
+			nodepools = append(nodepools, s.nodepoolJSON(nodepool))
+		}
+		writeJSON(w, map[string]any{
+			"id":        s.sksClusterId,
+			"name":      "test",
+			"state":     "running",
+			"version":   s.version,
+			"nodepools": nodepools,
+		})
+
+	case r.Method == http.MethodPut && len(path) == 4 && path[0] == "sks-cluster" && path[2] == "nodepool":
+		nodepoolId, operation, _ := strings.Cut(path[3], ":")
+		nodepool := s.nodepool(nodepoolId)
+		if nodepool == nil {
+			writeError(w, http.StatusNotFound, "nodepool not found")
+			return
+		}
+
+		var body struct {
+			Size      int64    `json:"size"`
+			Instances []string `json:"instances"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		switch operation {
+		case "scale":
+			s.recorder.record("sks-scale %s %d", nodepool.id, body.Size)
+			for int64(len(nodepool.instances)) < body.Size {
+				s.newInstance(nodepool, "")
+			}
+			for int64(len(nodepool.instances)) > body.Size {
+				s.removeInstance(nodepool, nodepool.instances[len(nodepool.instances)-1].id)
+			}
+		case "evict":
+			for _, instanceId := range body.Instances {
+				nodeName, ok := s.removeInstance(nodepool, instanceId)
+				if !ok {
+					writeError(w, http.StatusBadRequest, "instance is not a member of the nodepool")
+					return
+				}
+				s.recorder.record("sks-evict %s", nodeName)
+			}
+		default:
+			writeError(w, http.StatusNotFound, "unknown operation")
+			return
+		}
+		writeJSON(w, map[string]any{"id": "operation-" + operation, "state": "success"})
+
+	case r.Method == http.MethodGet && len(path) == 1 && path[0] == "sks-cluster-version":
+		writeJSON(w, map[string]any{"sks-cluster-versions": s.versions})
+
+	case r.Method == http.MethodGet && len(path) == 2 && path[0] == "operation":
+		writeJSON(w, map[string]any{"id": path[1], "state": "success"})
+
+	case r.Method == http.MethodGet && len(path) == 2 && path[0] == "instance-pool":
+		for _, nodepool := range s.nodepools {
+			if "instance-pool-"+nodepool.id != path[1] {
+				continue
+			}
+
+			instances := make([]map[string]any, 0, len(nodepool.instances))
+			for _, instance := range nodepool.instances {
+				instances = append(instances, map[string]any{"id": instance.id})
+			}
+			writeJSON(w, map[string]any{
+				"id":            path[1],
+				"state":         "running",
+				"size":          len(nodepool.instances),
+				"instances":     instances,
+				"instance-type": map[string]any{"id": "instance-type"},
+				"template":      map[string]any{"id": "template"},
+			})
+			return
+		}
+		writeError(w, http.StatusNotFound, "instance pool not found")
+
+	case r.Method == http.MethodGet && len(path) == 2 && path[0] == "instance":
+		writeJSON(w, map[string]any{
+			"id":            path[1],
+			"state":         "running",
+			"instance-type": map[string]any{"id": "instance-type"},
+			"template":      map[string]any{"id": "template"},
+		})
+
+	default:
+		writeError(w, http.StatusNotFound, fmt.Sprintf("%s %s is not implemented by the stub", r.Method, r.URL.Path))
+	}
+}
+
+func (s *exoscaleStub) nodepool(id string) *stubNodepool {
+	for _, nodepool := range s.nodepools {
+		if nodepool.id == id {
+			return nodepool
+		}
+	}
+	return nil
+}
+
+func (s *exoscaleStub) nodepoolJSON(nodepool *stubNodepool) map[string]any {
+	return map[string]any{
+		"id":            nodepool.id,
+		"name":          nodepool.name,
+		"size":          len(nodepool.instances),
+		"state":         "running",
+		"version":       nodepool.version,
+		"instance-pool": map[string]any{"id": "instance-pool-" + nodepool.id},
+		"instance-type": map[string]any{"id": "instance-type"},
+		"template":      map[string]any{"id": "template"},
+	}
+}
+
+// newInstance adds an instance to the nodepool. Without a node name, a new ready node is registered for it.
+func (s *exoscaleStub) newInstance(nodepool *stubNodepool, nodeName string) stubInstance {
+	s.instanceCount += 1
+	instance := stubInstance{
+		id:       fmt.Sprintf("00000000-0000-0000-0000-%012d", s.instanceCount),
+		nodeName: nodeName,
+	}
+
+	if instance.nodeName == "" {
+		instance.nodeName = fmt.Sprintf("%s-%d", nodepool.name, s.instanceCount)
+		_ = s.clientset.Tracker().Add(&corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   instance.nodeName,
+				Labels: map[string]string{nodeLabelNodepoolId: nodepool.id},
+			},
+			Status: corev1.NodeStatus{
+				Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: corev1.ConditionTrue}},
+				NodeInfo: corev1.NodeSystemInfo{
+					SystemUUID:     instance.id,
+					KubeletVersion: nodepool.version,
+				},
+			},
+		})
+	}
+
+	nodepool.instances = append(nodepool.instances, instance)
+	return instance
+}
+
+func (s *exoscaleStub) removeInstance(nodepool *stubNodepool, instanceId string) (string, bool) {
+	for i, instance := range nodepool.instances {
+		if instance.id == instanceId {
+			nodepool.instances = append(nodepool.instances[:i], nodepool.instances[i+1:]...)
+			_ = s.clientset.CoreV1().Nodes().Delete(context.Background(), instance.nodeName, metav1.DeleteOptions{})
+			return instance.nodeName, true
+		}
+	}
+	return "", false
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"message": message})
+}
@@ -0,0 +1,140 @@
+package cmd
+
+import (
+	"cmp"
+	"slices"
+
+	egoscalev2 "github.com/exoscale/egoscale/v2"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Orders in which the nodepools of a cycle are processed
+const (
+	// By nodepool name
+	nodepoolOrderName string = "name"
+	// Smallest nodepool first, so a problem shows up on as few nodes as possible
+	nodepoolOrderSize string = "size"
+	// In the order of the included nodepools
+	nodepoolOrderListed string = "listed"
+)
+
+// nodepoolFilter restricts a cycle to some nodepools of the cluster and orders the selected nodes nodepool by nodepool
+type nodepoolFilter struct {
+	// IDs of the nodepools which are cycled, nil cycles all nodepools
+	include map[string]bool
+	// IDs of the nodepools which are not cycled
+	exclude map[string]bool
+	// Position of every nodepool of the cluster in the order of the cycle by ID
+	rank map[string]int
+}
+
+// Create the filter of the cycle. Nodepools are given by ID or by name, names are resolved through the nodepools of
+// the cluster.
+func newNodepoolFilter(sksCluster *egoscalev2.SKSCluster, opts cycleOptions) (*nodepoolFilter, error) {
+	f := &nodepoolFilter{exclude: make(map[string]bool), rank: make(map[string]int)}
+
+	var listed []string
+	for _, ref := range opts.nodepools {
+		ids, err := resolveNodepool(sksCluster, ref)
+		if err != nil {
+			return nil, err
+		}
+		if f.include == nil {
+			f.include = make(map[string]bool)
+		}
+		for _, id := range ids {
+			if !f.include[id] {
+				listed = append(listed, id)
+			}
+			f.include[id] = true
+		}
+	}
+	for _, ref := range opts.excludeNodepools {
+		ids, err := resolveNodepool(sksCluster, ref)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			f.exclude[id] = true
+		}
+	}
+
+	sksNodepools := slices.Clone(sksCluster.Nodepools)
+	slices.SortStableFunc(sksNodepools, func(a, b *egoscalev2.SKSNodepool) int {
+		switch opts.nodepoolOrder {
+		case nodepoolOrderSize:
+			if c := cmp.Compare(valueOf(a.Size), valueOf(b.Size)); c != 0 {
+				return c
+			}
+		case nodepoolOrderListed:
+			if c := cmp.Compare(listedRank(listed, valueOf(a.ID)), listedRank(listed, valueOf(b.ID))); c != 0 {
+				return c
+			}
+		}
+		if c := cmp.Compare(valueOf(a.Name), valueOf(b.Name)); c != 0 {
+			return c
+		}
+		return cmp.Compare(valueOf(a.ID), valueOf(b.ID))
+	})
+	for i, sksNodepool := range sksNodepools {
+		f.rank[valueOf(sksNodepool.ID)] = i
+	}
+	return f, nil
+}
+
+// Find the IDs of the nodepools of the cluster with the given ID or name
+func resolveNodepool(sksCluster *egoscalev2.SKSCluster, ref string) ([]string, error) {
+	var ids []string
+	for _, sksNodepool := range sksCluster.Nodepools {
+		if valueOf(sksNodepool.ID) == ref || valueOf(sksNodepool.Name) == ref {
+			ids = append(ids, valueOf(sksNodepool.ID))
+		}
+	}
+	if len(ids) == 0 {
+		return nil, configError("nodepool '%s' does not exist in cluster %s", ref, valueOf(sksCluster.ID))
+	}
+	return ids, nil
+}
+
+// Position of a nodepool in the listed nodepools, unlisted nodepools come last
+func listedRank(listed []string, id string) int {
+	if i := slices.Index(listed, id); i >= 0 {
+		return i
+	}
+	return len(listed)
+}
+
+// Check whether the nodepool of a node is cycled, otherwise tell why not
+func (f *nodepoolFilter) selected(node corev1.Node) (bool, string) {
+	sksNodepoolId, _ := getNodepoolId(node)
+	if f.include != nil && !f.include[sksNodepoolId] {
+		return false, "its nodepool is not included in the cycle"
+	}
+	if f.exclude[sksNodepoolId] {
+		return false, "its nodepool is excluded from the cycle"
+	}
+	return true, ""
+}
+
+// Sort the nodes nodepool by nodepool in the order of the cycle, nodes of a nodepool keep their order. Nodes whose
+// nodepool is unknown come last.
+func (f *nodepoolFilter) sort(nodes []corev1.Node) {
+	rank := func(node corev1.Node) int {
+		sksNodepoolId, _ := getNodepoolId(node)
+		if i, exists := f.rank[sksNodepoolId]; exists {
+			return i
+		}
+		return len(f.rank)
+	}
+	slices.SortStableFunc(nodes, func(a, b corev1.Node) int {
+		return cmp.Compare(rank(a), rank(b))
+	})
+}
+
+func valueOf[T any](p *T) T {
+	var zero T
+	if p == nil {
+		return zero
+	}
+	return *p
+}
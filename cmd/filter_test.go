@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestRunCycleOnlyCyclesSelectedNodepools(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	provider := newFakeSKSProvider(clientset, "1.29.3")
+	provider.addNodepool("np-1", "workers", "v1.28.7", 1)
+	provider.addNodepool("np-2", "gpu", "v1.28.7", 1)
+	provider.addNodepool("np-3", "system", "v1.28.7", 1)
+
+	opts := testCycleOptions()
+	opts.nodepools = []string{"gpu", "np-3"}
+	opts.excludeNodepools = []string{"system"}
+	result, err := runCycle(context.Background(), clientset, provider, opts)
+	if err != nil {
+		t.Fatalf("runCycle() error = %v", err)
+	}
+	if len(result.Nodes) != 1 || result.Nodes[0].NodepoolId != "np-2" || result.Nodes[0].Status != nodeStatusReplaced {
+		t.Errorf("results = %+v, want only the node of the gpu nodepool replaced", result.Nodes)
+	}
+	kept := make(map[string]string)
+	for _, node := range result.Kept {
+		kept[node.NodepoolId] = node.Reason
+	}
+	if !strings.Contains(kept["np-1"], "not included") || !strings.Contains(kept["np-3"], "excluded") {
+		t.Errorf("kept nodes = %+v, want the nodes of the other nodepools filtered out", result.Kept)
+	}
+	if evictions := provider.callCount("EvictNodepoolMembers"); evictions != 1 {
+		t.Errorf("nodepool evictions = %d, want 1", evictions)
+	}
+}
+
+func TestNodepoolFilterOrder(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	provider := newFakeSKSProvider(clientset, "1.29.3")
+	provider.addNodepool("np-1", "workers", "v1.28.7", 3)
+	provider.addNodepool("np-2", "gpu", "v1.28.7", 2)
+	provider.addNodepool("np-3", "system", "v1.28.7", 1)
+	sksCluster, err := provider.GetCluster(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeList, err := clientset.CoreV1().Nodes().List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes := nodeList.Items
+
+	tests := []struct {
+		opts cycleOptions
+		want string
+	}{
+		{cycleOptions{}, "np-2,np-3,np-1"},
+		{cycleOptions{nodepoolOrder: nodepoolOrderName}, "np-2,np-3,np-1"},
+		{cycleOptions{nodepoolOrder: nodepoolOrderSize}, "np-3,np-2,np-1"},
+		{cycleOptions{nodepoolOrder: nodepoolOrderListed, nodepools: []string{"system", "np-1", "gpu"}}, "np-3,np-1,np-2"},
+	}
+	for _, test := range tests {
+		filter, err := newNodepoolFilter(sksCluster, test.opts)
+		if err != nil {
+			t.Fatalf("newNodepoolFilter(%+v) error = %v", test.opts, err)
+		}
+		filter.sort(nodes)
+
+		var order []string
+		for _, group := range groupByNodepool(nodes) {
+			order = append(order, group.id)
+		}
+		if got := strings.Join(order, ","); got != test.want {
+			t.Errorf("order %q = %s, want %s", test.opts.nodepoolOrder, got, test.want)
+		}
+	}
+
+	if _, err := newNodepoolFilter(sksCluster, cycleOptions{excludeNodepools: []string{"batch"}}); exitCode(err) != exitCodeConfig {
+		t.Errorf("newNodepoolFilter() error = %v, want a config error for an unknown nodepool", err)
+	}
+}
@@ -0,0 +1,220 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Points in the replacement of a node at which hooks run
+const (
+	// Once the surge nodes which replace the node are ready, before it is cordoned. Only with surging.
+	hookPointReplacementReady string = "replacement-ready"
+	// Before the node is cordoned
+	hookPointPreCordon string = "pre-cordon"
+	// Once the node has been drained and its workloads are available, before it is evicted from its nodepool
+	hookPointPostDrain string = "post-drain"
+	// Once the node has been evicted from its nodepool
+	hookPointPostSksEvict string = "post-sks-evict"
+)
+
+var hookPoints = []string{hookPointReplacementReady, hookPointPreCordon, hookPointPostDrain, hookPointPostSksEvict}
+
+// What happens when a hook fails
+const (
+	// The replacement of the node fails and it is handled by the failure policy
+	hookOnFailureFailNode string = "fail-node"
+	// The replacement of the node fails and the cycle is aborted
+	hookOnFailureAbortRun string = "abort-run"
+	// The failure is logged and the replacement continues
+	hookOnFailureIgnore string = "ignore"
+)
+
+// Default timeout of a hook
+const defaultHookTimeout = 5 * time.Minute
+
+// hookConfig is a hook of the configuration file, it either runs a command or calls a URL
+type hookConfig struct {
+	Name  string `mapstructure:"name"`
+	Point string `mapstructure:"point"`
+	// Command and arguments which are executed, the context is passed in the environment and as JSON on stdin
+	Command []string `mapstructure:"command"`
+	// URL the context is posted to as JSON, any status other than 2xx fails the hook
+	URL     string            `mapstructure:"url"`
+	Method  string            `mapstructure:"method"`
+	Headers map[string]string `mapstructure:"headers"`
+	Timeout time.Duration     `mapstructure:"timeout"`
+	// fail-node (default), abort-run or ignore
+	OnFailure string `mapstructure:"onFailure"`
+}
+
+// hookContext is what a hook is told about the node, as JSON and as environment variables
+type hookContext struct {
+	Point         string `json:"point"`
+	Node          string `json:"node"`
+	NodepoolId    string `json:"nodepoolId"`
+	RunId         string `json:"runId"`
+	ClusterId     string `json:"clusterId"`
+	TargetVersion string `json:"targetVersion"`
+}
+
+// Read the hooks from the configuration file and check them
+func hooksFromConfig() ([]hookConfig, error) {
+	var hooks []hookConfig
+	if err := viper.UnmarshalKey("hooks", &hooks); err != nil {
+		return nil, configError("invalid hooks: %v", err)
+	}
+	for i := range hooks {
+		if err := hooks[i].validate(); err != nil {
+			return nil, err
+		}
+	}
+	return hooks, nil
+}
+
+// Check the hook and fill in its defaults
+func (h *hookConfig) validate() error {
+	if h.Name == "" {
+		h.Name = h.Point
+	}
+	if !slices.Contains(hookPoints, h.Point) {
+		return configError("invalid point '%s' of hook %s, expected one of %s", h.Point, h.Name, strings.Join(hookPoints, ", "))
+	}
+	if (len(h.Command) == 0) == (h.URL == "") {
+		return configError("hook %s needs either a command or a URL", h.Name)
+	}
+	if h.Method == "" {
+		h.Method = http.MethodPost
+	}
+	if h.Timeout == 0 {
+		h.Timeout = defaultHookTimeout
+	}
+	if h.Timeout < 0 {
+		return configError("invalid timeout %s of hook %s, expected more than 0", h.Timeout, h.Name)
+	}
+	switch h.OnFailure {
+	case hookOnFailureFailNode, hookOnFailureAbortRun, hookOnFailureIgnore:
+	case "":
+		h.OnFailure = hookOnFailureFailNode
+	default:
+		return configError("invalid onFailure '%s' of hook %s, expected '%s', '%s' or '%s'", h.OnFailure, h.Name, hookOnFailureFailNode, hookOnFailureAbortRun, hookOnFailureIgnore)
+	}
+	return nil
+}
+
+// hookError is returned when a hook failed, abort tells whether it stops the cycle
+type hookError struct {
+	hook  string
+	point string
+	abort bool
+	err   error
+}
+
+func (e *hookError) Error() string {
+	return fmt.Sprintf("hook %s (%s) failed: %v", e.hook, e.point, e.err)
+}
+
+func (e *hookError) Unwrap() error {
+	return e.err
+}
+
+// Check whether the error is a failed hook which aborts the cycle
+func hookAborts(err error) bool {
+	var hookErr *hookError
+	return errors.As(err, &hookErr) && hookErr.abort
+}
+
+// Run the hooks of the point for the node, one after the other. The first hook which fails stops the others,
+// unless its failure is ignored.
+func runHooks(ctx context.Context, hooks []hookConfig, point string, node string, sksNodepoolId string, result *cycleResult) error {
+	hookCtx := hookContext{
+		Point:         point,
+		Node:          node,
+		NodepoolId:    sksNodepoolId,
+		RunId:         result.RunId,
+		ClusterId:     result.ClusterId,
+		TargetVersion: result.TargetVersion,
+	}
+	payload, err := json.Marshal(hookCtx)
+	if err != nil {
+		return err
+	}
+
+	for _, hook := range hooks {
+		if hook.Point != point {
+			continue
+		}
+		log := loggerFrom(ctx).With("hook", hook.Name)
+		log.Info("Running hook", "point", point)
+
+		runCtx, cancel := context.WithTimeout(ctx, hook.Timeout)
+		if len(hook.Command) > 0 {
+			err = runExecHook(runCtx, hook, hookCtx, payload)
+		} else {
+			err = runHTTPHook(runCtx, hook, payload)
+		}
+		cancel()
+		if err == nil {
+			continue
+		}
+		if hook.OnFailure == hookOnFailureIgnore && ctx.Err() == nil {
+			log.Warn("Hook failed, ignoring it", logKeyError, err)
+			continue
+		}
+		return &hookError{hook: hook.Name, point: point, abort: hook.OnFailure == hookOnFailureAbortRun, err: err}
+	}
+	return nil
+}
+
+// Run the command of the hook, its output is logged
+func runExecHook(ctx context.Context, hook hookConfig, hookCtx hookContext, payload []byte) error {
+	cmd := exec.CommandContext(ctx, hook.Command[0], hook.Command[1:]...)
+	cmd.Env = append(os.Environ(),
+		"SKS_LIFECYCLER_HOOK_POINT="+hookCtx.Point,
+		"SKS_LIFECYCLER_NODE="+hookCtx.Node,
+		"SKS_LIFECYCLER_NODEPOOL_ID="+hookCtx.NodepoolId,
+		"SKS_LIFECYCLER_RUN_ID="+hookCtx.RunId,
+		"SKS_LIFECYCLER_CLUSTER_ID="+hookCtx.ClusterId,
+		"SKS_LIFECYCLER_TARGET_VERSION="+hookCtx.TargetVersion,
+	)
+	cmd.Stdin = bytes.NewReader(payload)
+	output, err := cmd.CombinedOutput()
+	if len(output) > 0 {
+		loggerFrom(ctx).Info("Output of hook", "hook", hook.Name, "output", strings.TrimSpace(string(output)))
+	}
+	return err
+}
+
+// Call the URL of the hook with the context as JSON
+func runHTTPHook(ctx context.Context, hook hookConfig, payload []byte) error {
+	req, err := http.NewRequestWithContext(ctx, hook.Method, hook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range hook.Headers {
+		req.Header.Set(key, os.ExpandEnv(value))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, math.MaxInt16))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s responded with status %d", hook.Method, hook.URL, resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestRunCycleRunsHooks(t *testing.T) {
+	log := filepath.Join(t.TempDir(), "hooks.log")
+	script := `echo "$SKS_LIFECYCLER_HOOK_POINT $SKS_LIFECYCLER_NODE $SKS_LIFECYCLER_NODEPOOL_ID $SKS_LIFECYCLER_RUN_ID" >> ` + log
+
+	var posted hookContext
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&posted); err != nil || r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	var hooks []hookConfig
+	for _, point := range hookPoints {
+		hooks = append(hooks, hookConfig{Point: point, Command: []string{"sh", "-c", script}})
+	}
+	hooks = append(hooks, hookConfig{Point: hookPointPostDrain, URL: server.URL, Headers: map[string]string{"Authorization": "Bearer token"}})
+	for i := range hooks {
+		if err := hooks[i].validate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	clientset := fake.NewSimpleClientset()
+	provider := newFakeSKSProvider(clientset, "1.29.3")
+	provider.addNodepool("np-1", "workers", "v1.28.7", 1)
+
+	opts := testCycleOptions()
+	opts.surgeCount = 1
+	opts.hooks = hooks
+	result, err := runCycle(context.Background(), clientset, provider, opts)
+	if err != nil {
+		t.Fatalf("runCycle() error = %v", err)
+	}
+	if err := result.err(); err != nil {
+		t.Fatalf("result error = %v", err)
+	}
+
+	data, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatalf("no hook has been run: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != len(hookPoints) {
+		t.Fatalf("hooks ran at %v, want %v", lines, hookPoints)
+	}
+	for i, point := range hookPoints {
+		if want := point + " pool-workers-1 np-1 " + result.RunId; lines[i] != want {
+			t.Errorf("hook %d ran with %q, want %q", i, lines[i], want)
+		}
+	}
+	if posted.Point != hookPointPostDrain || posted.Node != "pool-workers-1" || posted.RunId != result.RunId {
+		t.Errorf("HTTP hook was called with %+v, want the post-drain context of the node", posted)
+	}
+}
+
+func TestHookFailureBlocksNodeOrAbortsRun(t *testing.T) {
+	for _, onFailure := range []string{hookOnFailureFailNode, hookOnFailureAbortRun} {
+		t.Run(onFailure, func(t *testing.T) {
+			hook := hookConfig{Point: hookPointPreCordon, Command: []string{"false"}, OnFailure: onFailure}
+			if err := hook.validate(); err != nil {
+				t.Fatal(err)
+			}
+
+			clientset := fake.NewSimpleClientset()
+			provider := newFakeSKSProvider(clientset, "1.29.3")
+			provider.addNodepool("np-1", "workers", "v1.28.7", 2)
+
+			opts := testCycleOptions()
+			opts.hooks = []hookConfig{hook}
+			result, err := runCycle(context.Background(), clientset, provider, opts)
+
+			wantFailed := 2
+			if onFailure == hookOnFailureAbortRun {
+				wantFailed = 1
+				if exitCode(err) != exitCodeSafetyAbort {
+					t.Errorf("runCycle() error = %v, want the run to be aborted", err)
+				}
+			} else if err != nil || exitCode(result.err()) != exitCodePartialFailure {
+				t.Errorf("runCycle() error = %v, result error = %v, want a partial failure", err, result.err())
+			}
+			if len(result.Nodes) != wantFailed {
+				t.Fatalf("results = %+v, want %d failed nodes", result.Nodes, wantFailed)
+			}
+			for _, node := range result.Nodes {
+				if node.Status != nodeStatusFailed || !strings.Contains(node.Err.Error(), "hook pre-cordon") {
+					t.Errorf("node %s is %s (%v), want it failed by the hook", node.Node, node.Status, node.Err)
+				}
+			}
+
+			// Nodes are not cordoned, because the hook runs before
+			nodes, err := clientset.CoreV1().Nodes().List(context.Background(), metav1.ListOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, node := range nodes.Items {
+				if node.Spec.Unschedulable {
+					t.Errorf("node %s has been cordoned", node.Name)
+				}
+			}
+		})
+	}
+}
+
+func TestHookConfigValidate(t *testing.T) {
+	tests := map[string]hookConfig{
+		"point":      {Point: "pre-drain", Command: []string{"true"}},
+		"no action":  {Point: hookPointPreCordon},
+		"both":       {Point: hookPointPreCordon, Command: []string{"true"}, URL: "http://localhost"},
+		"on failure": {Point: hookPointPreCordon, Command: []string{"true"}, OnFailure: "retry"},
+	}
+	for name, hook := range tests {
+		if err := hook.validate(); exitCode(err) != exitCodeConfig {
+			t.Errorf("%s: validate() error = %v, want a config error", name, err)
+		}
+	}
+
+	hook := hookConfig{Point: hookPointPostDrain, URL: "http://localhost"}
+	if err := hook.validate(); err != nil {
+		t.Fatalf("validate() error = %v", err)
+	}
+	if hook.Name != hookPointPostDrain || hook.Method != http.MethodPost || hook.Timeout != defaultHookTimeout || hook.OnFailure != hookOnFailureFailNode {
+		t.Errorf("hook = %+v, want the defaults to be filled in", hook)
+	}
+}
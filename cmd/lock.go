@@ -0,0 +1,170 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+
+	"github.com/spf13/viper"
+)
+
+// Timings of the Lease behind the lock. A holder which stops renewing the Lease, e.g. because it has been killed,
+// loses the lock once the lease duration has passed.
+var (
+	lockLeaseDuration = 60 * time.Second
+	lockRenewDeadline = 45 * time.Second
+	lockRetryPeriod   = 5 * time.Second
+)
+
+// errLockLost is the cause of a run which has been stopped, because another instance took over its lock
+var errLockLost = errors.New("the lock has been lost to another instance")
+
+// lockOptions holds the configuration of the cluster-wide lock, which keeps instances from changing nodes at the same time
+type lockOptions struct {
+	// The Lease behind the lock as <namespace>/<name>, empty disables the lock
+	location string
+	// Take the lock over from another holder, instead of refusing to run
+	force bool
+	// Wait until the lock is free, instead of refusing to run while another instance holds it
+	wait bool
+}
+
+// Read the options of the lock from the configuration
+func lockOptionsFromConfig() lockOptions {
+	return lockOptions{
+		location: viper.GetString("lock"),
+		force:    viper.GetBool("force_lock"),
+	}
+}
+
+// Acquire the cluster-wide lock and keep renewing it in the background. It returns a context, which is cancelled with
+// errLockLost once the lock is lost, and a function which releases the lock. Unless it waits or is forced, it refuses
+// to run while another instance holds the lock.
+func acquireLock(ctx context.Context, clientset kubernetes.Interface, opts lockOptions) (context.Context, func(), error) {
+	if opts.location == "" {
+		return ctx, func() {}, nil
+	}
+	namespace, name, found := strings.Cut(opts.location, "/")
+	if !found || namespace == "" || name == "" {
+		return nil, nil, configError("invalid lock '%s', expected '<namespace>/<name>'", opts.location)
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	identity := hostname + "_" + string(uuid.NewUUID())
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Client:     clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+	}
+
+	if !opts.wait || opts.force {
+		record, _, err := lock.Get(ctx)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return nil, nil, kubernetesError(fmt.Errorf("error getting lock %s: %w", opts.location, err))
+		}
+		if err == nil && lockHeld(record, time.Now()) {
+			if !opts.force {
+				return nil, nil, lockedError(opts.location, record)
+			}
+			loggerFrom(ctx).Warn("Taking the lock over from another instance", "lock", opts.location, "holder", record.HolderIdentity)
+			now := metav1.NewTime(time.Now())
+			record.HolderIdentity = identity
+			record.AcquireTime = now
+			record.RenewTime = now
+			record.LeaderTransitions += 1
+			if err := lock.Update(ctx, *record); err != nil {
+				return nil, nil, kubernetesError(fmt.Errorf("error taking over lock %s: %w", opts.location, err))
+			}
+		}
+	}
+
+	lockCtx, cancelLock := context.WithCancelCause(ctx)
+	// The lock is kept while a stopped run cleans up, it is only released once the run has returned
+	electorCtx, stopElector := context.WithCancel(context.WithoutCancel(ctx))
+	acquired := make(chan struct{})
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		Name:            opts.location,
+		LeaseDuration:   lockLeaseDuration,
+		RenewDeadline:   lockRenewDeadline,
+		RetryPeriod:     lockRetryPeriod,
+		ReleaseOnCancel: true,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(context.Context) {
+				close(acquired)
+			},
+			OnStoppedLeading: func() {
+				if electorCtx.Err() == nil {
+					loggerFrom(ctx).Error("Lost the lock, stopping", "lock", opts.location)
+				}
+				cancelLock(errLockLost)
+			},
+		},
+	})
+	if err != nil {
+		stopElector()
+		cancelLock(nil)
+		return nil, nil, configError("invalid lock configuration: %w", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		elector.Run(electorCtx)
+		close(done)
+	}()
+	release := func() {
+		stopElector()
+		<-done
+		cancelLock(nil)
+	}
+
+	// Another instance may have taken the lock since it was checked, which is only noticed by the elector
+	var timeout <-chan time.Time
+	if !opts.wait {
+		timeout = time.After(3 * lockRetryPeriod)
+	} else {
+		loggerFrom(ctx).Info("Waiting for the lock", "lock", opts.location, "identity", identity)
+	}
+	select {
+	case <-acquired:
+		loggerFrom(ctx).Info("Acquired the lock", "lock", opts.location, "identity", identity)
+		return lockCtx, release, nil
+	case <-ctx.Done():
+		release()
+		return nil, nil, interruptedError(ctx)
+	case <-timeout:
+		release()
+		record, _, err := lock.Get(ctx)
+		if err != nil {
+			return nil, nil, kubernetesError(fmt.Errorf("error acquiring lock %s: %w", opts.location, err))
+		}
+		return nil, nil, lockedError(opts.location, record)
+	}
+}
+
+// Get whether the lock has a holder which has renewed it recently enough
+func lockHeld(record *resourcelock.LeaderElectionRecord, now time.Time) bool {
+	expires := record.RenewTime.Add(time.Duration(record.LeaseDurationSeconds) * time.Second)
+	return record.HolderIdentity != "" && expires.After(now)
+}
+
+func lockedError(location string, record *resourcelock.LeaderElectionRecord) error {
+	return &classifiedError{
+		class: errorClassLocked,
+		err: fmt.Errorf("lock %s is held by %s since %s, another instance is running (use --force-lock to take it over)",
+			location, record.HolderIdentity, record.AcquireTime.Format(time.RFC3339)),
+	}
+}
@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/utils/ptr"
+)
+
+func heldLease(holder string) *coordinationv1.Lease {
+	now := metav1.NewMicroTime(time.Now())
+	return &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "exoscale-sks-lifecycler"},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity:       ptr.To(holder),
+			LeaseDurationSeconds: ptr.To[int32](60),
+			AcquireTime:          &now,
+			RenewTime:            &now,
+		},
+	}
+}
+
+func TestAcquireLockRefusesWhileHeld(t *testing.T) {
+	ctx := context.Background()
+	clientset := fake.NewSimpleClientset(heldLease("other"))
+	opts := lockOptions{location: "kube-system/exoscale-sks-lifecycler"}
+
+	if _, _, err := acquireLock(ctx, clientset, opts); exitCode(err) != exitCodeLocked {
+		t.Fatalf("acquireLock() error = %v, want the lock to be held", err)
+	}
+
+	// A forced run takes the lock over and releases it once it is done
+	opts.force = true
+	_, release, err := acquireLock(ctx, clientset, opts)
+	if err != nil {
+		t.Fatalf("forced acquireLock() error = %v", err)
+	}
+	lease, err := clientset.CoordinationV1().Leases("kube-system").Get(ctx, "exoscale-sks-lifecycler", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if holder := ptr.Deref(lease.Spec.HolderIdentity, ""); holder == "other" || holder == "" {
+		t.Errorf("lock holder = %q, want it to be taken over", holder)
+	}
+
+	release()
+	lease, err = clientset.CoordinationV1().Leases("kube-system").Get(ctx, "exoscale-sks-lifecycler", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if holder := ptr.Deref(lease.Spec.HolderIdentity, ""); holder != "" {
+		t.Errorf("lock holder after release = %q, want none", holder)
+	}
+}
+
+func TestLostLockStopsRun(t *testing.T) {
+	leaseDuration, renewDeadline, retryPeriod := lockLeaseDuration, lockRenewDeadline, lockRetryPeriod
+	lockLeaseDuration, lockRenewDeadline, lockRetryPeriod = 300*time.Millisecond, 200*time.Millisecond, 20*time.Millisecond
+	t.Cleanup(func() {
+		lockLeaseDuration, lockRenewDeadline, lockRetryPeriod = leaseDuration, renewDeadline, retryPeriod
+	})
+
+	ctx := context.Background()
+	clientset := fake.NewSimpleClientset()
+	lockCtx, release, err := acquireLock(ctx, clientset, lockOptions{location: "kube-system/exoscale-sks-lifecycler"})
+	if err != nil {
+		t.Fatalf("acquireLock() error = %v", err)
+	}
+	defer release()
+
+	// Another instance forces the lock over
+	if _, err := clientset.CoordinationV1().Leases("kube-system").Update(ctx, heldLease("other"), metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-lockCtx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("run was not stopped after the lock had been lost")
+	}
+	if err := interruptedError(lockCtx); !errors.Is(err, errLockLost) || exitCode(err) != exitCodeInterrupted {
+		t.Errorf("interruptedError() = %v, want the lost lock as cause", err)
+	}
+}
@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Keys of the fields which are attached to log records
+const (
+	logKeyClusterId string = "cluster_id"
+	logKeyRunId     string = "run_id"
+	logKeyNode      string = "node"
+	logKeyNodepool  string = "nodepool"
+	logKeyPod       string = "pod"
+	logKeyNamespace string = "namespace"
+	logKeyPhase     string = "phase"
+	logKeyError     string = "error"
+)
+
+// Phases of the replacement of a node and of a control plane upgrade, logged in the phase field
+const (
+	phaseSelect   string = "select"
+	phaseSurge    string = "surge"
+	phaseCordon   string = "cordon"
+	phaseDrain    string = "drain"
+	phaseSksEvict string = "sks-evict"
+	phaseUpgrade  string = "upgrade"
+)
+
+// logger is the root logger, configured by initLogger. Loggers with additional fields are carried in contexts.
+var logger = slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+type loggerContextKey struct{}
+
+// Set up the root logger with the given format (text or json) and level (debug, info, warn or error)
+func initLogger(out io.Writer, format string, level string) error {
+	var logLevel slog.Level
+	if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level '%s', expected 'debug', 'info', 'warn' or 'error'", level)
+	}
+	handlerOpts := &slog.HandlerOptions{Level: logLevel}
+
+	switch strings.ToLower(format) {
+	case "json":
+		logger = slog.New(slog.NewJSONHandler(out, handlerOpts))
+	case "text", "":
+		logger = slog.New(slog.NewTextHandler(out, handlerOpts))
+	default:
+		return fmt.Errorf("invalid log format '%s', expected 'text' or 'json'", format)
+	}
+	slog.SetDefault(logger)
+
+	return nil
+}
+
+// Get the logger of the context, falling back to the root logger
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerContextKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return logger
+}
+
+// Return a context whose logger adds the given fields to every record
+func withLogFields(ctx context.Context, args ...any) context.Context {
+	return context.WithValue(ctx, loggerContextKey{}, loggerFrom(ctx).With(args...))
+}
+
+// Return a context whose logger records the given phase
+func withPhase(ctx context.Context, phase string) context.Context {
+	return withLogFields(ctx, logKeyPhase, phase)
+}
@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestLoggerJSONFields(t *testing.T) {
+	previous := logger
+	defer func() { logger = previous }()
+
+	var out bytes.Buffer
+	if err := initLogger(&out, "json", "info"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := withLogFields(context.Background(), logKeyClusterId, "cluster-1")
+	ctx = withLogFields(ctx, logKeyNode, "node-1", logKeyNodepool, "np-1")
+	loggerFrom(withPhase(ctx, phaseCordon)).Error("Error while cordoning node", logKeyError, errors.New("conflict"))
+	loggerFrom(ctx).Debug("Not logged below the info level")
+
+	var record map[string]any
+	if err := json.Unmarshal(out.Bytes(), &record); err != nil {
+		t.Fatalf("expected a single JSON record, got %q: %v", out.String(), err)
+	}
+	want := map[string]string{
+		"level":         "ERROR",
+		logKeyClusterId: "cluster-1",
+		logKeyNode:      "node-1",
+		logKeyNodepool:  "np-1",
+		logKeyPhase:     phaseCordon,
+		logKeyError:     "conflict",
+	}
+	for key, value := range want {
+		if record[key] != value {
+			t.Errorf("%s = %v, want %s", key, record[key], value)
+		}
+	}
+}
+
+func TestInitLoggerRejectsInvalidOptions(t *testing.T) {
+	previous := logger
+	defer func() { logger = previous }()
+
+	if err := initLogger(&bytes.Buffer{}, "yaml", "info"); err == nil {
+		t.Error("expected an error for an invalid log format")
+	}
+	if err := initLogger(&bytes.Buffer{}, "text", "verbose"); err == nil {
+		t.Error("expected an error for an invalid log level")
+	}
+}
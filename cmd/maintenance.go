@@ -0,0 +1,177 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maintenanceWindow is a recurring time range in which the controller may replace nodes
+type maintenanceWindow struct {
+	// Days on which the window opens, indexed by time.Weekday
+	days [7]bool
+	// Minutes since midnight, a window whose end is not after its start closes on the next day
+	start int
+	end   int
+
+	location *time.Location
+}
+
+// maintenanceWindows are the windows in which the controller may act, no windows means it may always act
+type maintenanceWindows []maintenanceWindow
+
+// Parse maintenance windows separated by ";", each made of days and a time range in the given location,
+// e.g. "Mon-Fri 22:00-04:00; Sat,Sun 00:00-24:00"
+func parseMaintenanceWindows(spec string, location *time.Location) (maintenanceWindows, error) {
+	var windows maintenanceWindows
+	for _, windowSpec := range strings.Split(spec, ";") {
+		windowSpec = strings.TrimSpace(windowSpec)
+		if windowSpec == "" {
+			continue
+		}
+		window, err := parseMaintenanceWindow(windowSpec, location)
+		if err != nil {
+			return nil, configError("invalid maintenance window '%s': %w", windowSpec, err)
+		}
+		windows = append(windows, window)
+	}
+	return windows, nil
+}
+
+func parseMaintenanceWindow(spec string, location *time.Location) (maintenanceWindow, error) {
+	window := maintenanceWindow{location: location}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 2 {
+		return window, fmt.Errorf("expected days and a time range, e.g. 'Mon-Fri 22:00-04:00'")
+	}
+
+	// Days are a list of single days and ranges, e.g. "Mon,Wed-Fri". A range may wrap around the week, e.g. "Fri-Mon".
+	for _, daySpec := range strings.Split(fields[0], ",") {
+		first, last, isRange := strings.Cut(daySpec, "-")
+		from, err := parseWeekday(first)
+		if err != nil {
+			return window, err
+		}
+		to := from
+		if isRange {
+			if to, err = parseWeekday(last); err != nil {
+				return window, err
+			}
+		}
+		for day := from; ; day = (day + 1) % 7 {
+			window.days[day] = true
+			if day == to {
+				break
+			}
+		}
+	}
+
+	start, end, found := strings.Cut(fields[1], "-")
+	if !found {
+		return window, fmt.Errorf("invalid time range '%s', expected e.g. '22:00-04:00'", fields[1])
+	}
+	var err error
+	if window.start, err = parseTimeOfDay(start); err != nil {
+		return window, err
+	}
+	if window.end, err = parseTimeOfDay(end); err != nil {
+		return window, err
+	}
+	if window.start == 24*60 {
+		return window, fmt.Errorf("a maintenance window cannot start at 24:00")
+	}
+
+	return window, nil
+}
+
+// Parse the name of a weekday, either in full or abbreviated to three letters
+func parseWeekday(name string) (time.Weekday, error) {
+	name = strings.ToLower(name)
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		if dayName := strings.ToLower(day.String()); name == dayName || name == dayName[:3] {
+			return day, nil
+		}
+	}
+	return time.Sunday, fmt.Errorf("invalid weekday '%s', expected e.g. 'Mon' or 'Monday'", name)
+}
+
+// Parse a time of day in the form HH:MM into minutes since midnight, 24:00 is the end of the day
+func parseTimeOfDay(value string) (int, error) {
+	hours, minutes, found := strings.Cut(value, ":")
+	h, hoursErr := strconv.Atoi(hours)
+	m, minutesErr := strconv.Atoi(minutes)
+	if !found || hoursErr != nil || minutesErr != nil || h < 0 || h > 24 || m < 0 || m > 59 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("invalid time '%s', expected HH:MM", value)
+	}
+	return h*60 + m, nil
+}
+
+// Get when the window which opens on the day of t opens and closes
+func (w maintenanceWindow) bounds(t time.Time) (time.Time, time.Time) {
+	opens := time.Date(t.Year(), t.Month(), t.Day(), 0, w.start, 0, 0, w.location)
+	closes := time.Date(t.Year(), t.Month(), t.Day(), 0, w.end, 0, 0, w.location)
+	if w.end <= w.start {
+		closes = time.Date(t.Year(), t.Month(), t.Day()+1, 0, w.end, 0, 0, w.location)
+	}
+	return opens, closes
+}
+
+// Get whether the window is open at t and, if so, when it closes
+func (w maintenanceWindow) open(t time.Time) (bool, time.Time) {
+	t = t.In(w.location)
+	// A window which wraps past midnight may have opened on the day before
+	for _, day := range []time.Time{t, time.Date(t.Year(), t.Month(), t.Day()-1, 12, 0, 0, 0, w.location)} {
+		if !w.days[day.Weekday()] {
+			continue
+		}
+		opens, closes := w.bounds(day)
+		if !t.Before(opens) && t.Before(closes) {
+			return true, closes
+		}
+	}
+	return false, time.Time{}
+}
+
+// Get when the window opens next after t
+func (w maintenanceWindow) next(t time.Time) time.Time {
+	t = t.In(w.location)
+	for days := 0; days <= 7; days++ {
+		day := time.Date(t.Year(), t.Month(), t.Day()+days, 12, 0, 0, 0, w.location)
+		if opens, _ := w.bounds(day); w.days[day.Weekday()] && opens.After(t) {
+			return opens
+		}
+	}
+	return time.Time{}
+}
+
+// Get whether any window is open at t and, if so, when the last of the open windows closes.
+// Without windows the controller may always act, so there is no time at which it has to stop.
+func (ws maintenanceWindows) open(t time.Time) (bool, time.Time) {
+	if len(ws) == 0 {
+		return true, time.Time{}
+	}
+	isOpen := false
+	var closes time.Time
+	for _, window := range ws {
+		if windowOpen, windowCloses := window.open(t); windowOpen {
+			isOpen = true
+			if windowCloses.After(closes) {
+				closes = windowCloses
+			}
+		}
+	}
+	return isOpen, closes
+}
+
+// Get when the next window opens after t
+func (ws maintenanceWindows) next(t time.Time) time.Time {
+	var next time.Time
+	for _, window := range ws {
+		if opens := window.next(t); !opens.IsZero() && (next.IsZero() || opens.Before(next)) {
+			next = opens
+		}
+	}
+	return next
+}
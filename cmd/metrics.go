@@ -0,0 +1,184 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/version"
+)
+
+// Job name of the metrics pushed to a Pushgateway
+const metricsJob string = "exoscale-sks-lifecycler"
+
+// Status of the node metrics of a node which is selected for replacement, in addition to the statuses of nodeResult
+const nodeStatusSelected string = "selected"
+
+// Reasons of the node metrics, in addition to the names of the error classes for failed and interrupted nodes
+const (
+	nodeReasonVersion     string = "version"
+	nodeReasonLabel       string = "label"
+	nodeReasonRunningJobs string = "running-jobs"
+)
+
+// metricsRegistry holds all metrics of the lifecycler, they are served on /metrics and pushed to a Pushgateway
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	nodesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sks_lifecycler_nodes_total",
+		Help: "Nodes which have been selected for replacement, replaced, skipped, failed or interrupted, by nodepool and reason.",
+	}, []string{"nodepool", "status", "reason"})
+	phaseDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sks_lifecycler_phase_duration_seconds",
+		Help:    "Duration of the phases of the replacement of a node, whether they succeeded or not.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 14),
+	}, []string{"phase"})
+	drainDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sks_lifecycler_drain_duration_seconds",
+		Help:    "Duration of draining a node until no reschedulable pod is left on it, by nodepool.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 14),
+	}, []string{"nodepool"})
+	evictionRetriesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sks_lifecycler_eviction_retries_total",
+		Help: "Evictions of pods which have been retried, because a PodDisruptionBudget blocked them.",
+	})
+	deploymentRestartsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sks_lifecycler_deployment_restarts_total",
+		Help: "Rollout restarts of Deployments with pods on drained nodes.",
+	})
+	exoscaleRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sks_lifecycler_exoscale_api_request_duration_seconds",
+		Help:    "Duration of Exoscale API operations, including the wait for asynchronous operations to complete.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 14),
+	}, []string{"operation"})
+	exoscaleRequestErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sks_lifecycler_exoscale_api_errors_total",
+		Help: "Exoscale API operations which failed.",
+	}, []string{"operation"})
+	runsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sks_lifecycler_runs_total",
+		Help: "Cycles which have been run, by result (success or the class of their error).",
+	}, []string{"result"})
+	controllerLeader = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "sks_lifecycler_leader",
+		Help: "Whether the controller holds the lock and schedules reconciliations (1) or waits on standby (0).",
+	})
+	// Only registered once a run has succeeded, so a failed run does not overwrite the timestamp in a Pushgateway
+	lastSuccessTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "sks_lifecycler_last_success_timestamp_seconds",
+		Help: "Unix time at which the last cycle completed successfully.",
+	})
+	lastSuccessOnce sync.Once
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		nodesTotal,
+		phaseDuration,
+		drainDuration,
+		evictionRetriesTotal,
+		deploymentRestartsTotal,
+		exoscaleRequestDuration,
+		exoscaleRequestErrorsTotal,
+		runsTotal,
+		controllerLeader,
+	)
+}
+
+// metricsServer serves /metrics while a command runs, it is nil if no address is configured
+var metricsServer *http.Server
+
+// Serve /metrics on the address until stopMetrics is called, an empty address disables it
+func serveMetrics(addr string) error {
+	if addr == "" {
+		return nil
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("error serving metrics: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	metricsServer = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := metricsServer.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("Error serving metrics", logKeyError, err)
+		}
+	}()
+	return nil
+}
+
+// Stop serving /metrics
+func stopMetrics() {
+	if metricsServer == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	metricsServer.Shutdown(ctx)
+	metricsServer = nil
+}
+
+// Push all metrics to a Pushgateway, grouped by the SKS cluster. Metrics of the same name which have been pushed
+// before are replaced, others are kept, so the timestamp of the last success survives failed runs.
+func pushMetrics(url string, sksClusterId string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return push.New(url, metricsJob).Gatherer(metricsRegistry).Grouping("cluster_id", sksClusterId).AddContext(ctx)
+}
+
+// Observe the duration of a phase which started at the given time
+func observePhase(phase string, start time.Time) {
+	phaseDuration.WithLabelValues(phase).Observe(time.Since(start).Seconds())
+}
+
+// Count the node with its status. The reason tells why a node was selected or skipped, or the class of its error.
+func observeNode(sksNodepoolId string, status string, reason string) {
+	nodesTotal.WithLabelValues(sksNodepoolId, status, reason).Inc()
+}
+
+// Get the reason of the metrics of a node which is selected for replacement
+func selectionReason(node corev1.Node, desiredK8sVersion *version.Version) string {
+	kubeletVersion, err := version.ParseGeneric(node.Status.NodeInfo.KubeletVersion)
+	if err == nil && kubeletVersion.LessThan(desiredK8sVersion) {
+		return nodeReasonVersion
+	}
+	return nodeReasonLabel
+}
+
+// Observe the outcome of a cycle. A run which replaced all selected nodes, or had nothing to do, is successful.
+func observeRun(result *cycleResult, err error) {
+	if err == nil {
+		err = result.err()
+	}
+	if err != nil && !errors.Is(err, errNothingToDo) {
+		runsTotal.WithLabelValues(errorClassOf(err).String()).Inc()
+		return
+	}
+	runsTotal.WithLabelValues("success").Inc()
+	lastSuccessOnce.Do(func() {
+		metricsRegistry.MustRegister(lastSuccessTimestamp)
+	})
+	lastSuccessTimestamp.SetToCurrentTime()
+}
+
+// Observe an Exoscale API operation which started at the given time, to be deferred with the error it returns
+func observeExoscaleRequest(operation string, start time.Time, err *error) {
+	exoscaleRequestDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if *err != nil {
+		exoscaleRequestErrorsTotal.WithLabelValues(operation).Inc()
+	}
+}
@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestRunCycleRecordsMetrics(t *testing.T) {
+	selected := testutil.ToFloat64(nodesTotal.WithLabelValues("np-1", nodeStatusSelected, nodeReasonVersion))
+	replaced := testutil.ToFloat64(nodesTotal.WithLabelValues("np-1", nodeStatusReplaced, ""))
+	successes := testutil.ToFloat64(runsTotal.WithLabelValues("success"))
+
+	clientset := fake.NewSimpleClientset()
+	provider := newFakeSKSProvider(clientset, "1.29.3")
+	provider.addNodepool("np-1", "workers", "v1.28.7", 2)
+
+	if _, err := runCycle(context.Background(), clientset, provider, testCycleOptions()); err != nil {
+		t.Fatalf("runCycle() error = %v", err)
+	}
+
+	if got := testutil.ToFloat64(nodesTotal.WithLabelValues("np-1", nodeStatusSelected, nodeReasonVersion)) - selected; got != 2 {
+		t.Errorf("selected nodes = %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(nodesTotal.WithLabelValues("np-1", nodeStatusReplaced, "")) - replaced; got != 2 {
+		t.Errorf("replaced nodes = %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(runsTotal.WithLabelValues("success")) - successes; got != 1 {
+		t.Errorf("successful runs = %v, want 1", got)
+	}
+	if count, err := testutil.GatherAndCount(metricsRegistry, "sks_lifecycler_last_success_timestamp_seconds"); err != nil || count != 1 {
+		t.Errorf("last success timestamp series = %d (error %v), want 1", count, err)
+	}
+	if count := testutil.CollectAndCount(phaseDuration); count < 3 {
+		t.Errorf("phase duration series = %d, want the cordon, drain and sks-evict phases", count)
+	}
+}
+
+func TestPushMetrics(t *testing.T) {
+	var method, path, body string
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		method, path, body = r.Method, r.URL.Path, string(data)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer gateway.Close()
+
+	evictionRetriesTotal.Inc()
+	if err := pushMetrics(gateway.URL, "cluster-1"); err != nil {
+		t.Fatalf("pushMetrics() error = %v", err)
+	}
+
+	// Metrics are added to the group, so metrics which are not pushed keep their value
+	if method != http.MethodPost {
+		t.Errorf("method = %s, want %s", method, http.MethodPost)
+	}
+	if want := "/metrics/job/" + metricsJob + "/cluster_id/cluster-1"; path != want {
+		t.Errorf("path = %s, want %s", path, want)
+	}
+	if !strings.Contains(body, "sks_lifecycler_eviction_retries_total") {
+		t.Errorf("pushed metrics do not contain the eviction retries")
+	}
+}
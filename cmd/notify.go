@@ -0,0 +1,353 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/spf13/viper"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// Formats of the payload which is posted to the webhooks
+const (
+	notifyFormatGeneric string = "generic"
+	notifyFormatSlack   string = "slack"
+	notifyFormatTeams   string = "teams"
+)
+
+// Events notifications are sent for, node events are named after the status of the node
+const (
+	notifyEventRunStarted      string = "run-started"
+	notifyEventRunFinished     string = "run-finished"
+	notifyEventRunFailed       string = "run-failed"
+	notifyEventNodeReplaced    string = "node-" + nodeStatusReplaced
+	notifyEventNodeSkipped     string = "node-" + nodeStatusSkipped
+	notifyEventNodeFailed      string = "node-" + nodeStatusFailed
+	notifyEventNodeInterrupted string = "node-" + nodeStatusInterrupted
+)
+
+var notifyEvents = []string{
+	notifyEventRunStarted,
+	notifyEventRunFinished,
+	notifyEventRunFailed,
+	notifyEventNodeReplaced,
+	notifyEventNodeSkipped,
+	notifyEventNodeFailed,
+	notifyEventNodeInterrupted,
+}
+
+// Message of a notification, unless a template is configured
+const defaultNotifyTemplate string = `
+{{- if eq .Event "run-started" -}}
+Run {{ .RunId }} started on cluster {{ .ClusterId }}: {{ .Nodes }} nodes are replaced with version {{ .TargetVersion }}
+{{- else if or (eq .Event "run-finished") (eq .Event "run-failed") -}}
+Run {{ .RunId }} on cluster {{ .ClusterId }} finished with {{ .Result }}: {{ .Replaced }} replaced, {{ .Skipped }} skipped, {{ .Failed }} failed
+{{- if .Error }}: {{ .Error }}{{ end }}
+{{- else -}}
+Node {{ .Node }} of nodepool {{ .NodepoolId }} is {{ .Status }}{{ if .Error }}: {{ .Error }}{{ end }} (run {{ .RunId }})
+{{- end -}}`
+
+// Backoff between deliveries of a notification, whose webhook could not be reached or returned a server error
+var notifyBackoff = wait.Backoff{
+	Duration: time.Second,
+	Factor:   2,
+	Jitter:   0.1,
+	Steps:    5,
+	Cap:      30 * time.Second,
+}
+
+// How long notifications which are still queued are delivered once a run is done
+var notifyShutdownTimeout = time.Minute
+
+// notification is what happened in a run, it is the data of the message template and the payload of generic webhooks
+type notification struct {
+	Event         string    `json:"event"`
+	Time          time.Time `json:"time"`
+	RunId         string    `json:"runId"`
+	ClusterId     string    `json:"clusterId"`
+	TargetVersion string    `json:"targetVersion"`
+	// The node and its outcome, for node events
+	Node       string `json:"node,omitempty"`
+	NodepoolId string `json:"nodepoolId,omitempty"`
+	Status     string `json:"status,omitempty"`
+	// Number of selected nodes, for run-started
+	Nodes int `json:"nodes,omitempty"`
+	// Outcome of the run and its nodes, for run-finished and run-failed
+	Result   string `json:"result,omitempty"`
+	Replaced int    `json:"replaced,omitempty"`
+	Skipped  int    `json:"skipped,omitempty"`
+	Failed   int    `json:"failed,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Message  string `json:"message"`
+}
+
+// notifierOptions holds the configuration of the webhooks notifications are posted to
+type notifierOptions struct {
+	urls []string
+	// Payload of the webhooks: generic, slack or teams
+	format string
+	// Path of a Go template for the message, empty uses the default message
+	template string
+	// Events notifications are sent for, empty sends all
+	events []string
+}
+
+// Read the notifier options from the configuration, lists are separated by commas
+func notifierOptionsFromConfig() notifierOptions {
+	return notifierOptions{
+		urls:     splitList(viper.GetString("notify_url")),
+		format:   viper.GetString("notify_format"),
+		template: viper.GetString("notify_template"),
+		events:   splitList(viper.GetString("notify_events")),
+	}
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// notifier posts notifications to webhooks. They are delivered one at a time and in order in the background, so
+// a slow webhook does not hold up the run. A nil notifier sends nothing.
+type notifier struct {
+	opts     notifierOptions
+	client   *http.Client
+	template *template.Template
+	events   map[string]bool
+	queue    chan notification
+	done     chan struct{}
+	// Stops deliveries which are still retried once the shutdown timeout has been reached
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Create a notifier and start delivering, nil if no webhook is configured
+func newNotifier(ctx context.Context, opts notifierOptions) (*notifier, error) {
+	if len(opts.urls) == 0 {
+		return nil, nil
+	}
+
+	switch opts.format {
+	case notifyFormatGeneric, notifyFormatSlack, notifyFormatTeams:
+	case "":
+		opts.format = notifyFormatGeneric
+	default:
+		return nil, configError("invalid notification format '%s', expected '%s', '%s' or '%s'", opts.format, notifyFormatGeneric, notifyFormatSlack, notifyFormatTeams)
+	}
+
+	text := defaultNotifyTemplate
+	if opts.template != "" {
+		data, err := os.ReadFile(opts.template)
+		if err != nil {
+			return nil, configError("error reading notification template: %v", err)
+		}
+		text = string(data)
+	}
+	tmpl, err := template.New("notification").Parse(text)
+	if err != nil {
+		return nil, configError("invalid notification template: %v", err)
+	}
+
+	events := make(map[string]bool)
+	for _, event := range opts.events {
+		if !slices.Contains(notifyEvents, event) {
+			return nil, configError("invalid notification event '%s', expected one of %s", event, strings.Join(notifyEvents, ", "))
+		}
+		events[event] = true
+	}
+	if len(events) == 0 {
+		for _, event := range notifyEvents {
+			events[event] = true
+		}
+	}
+
+	n := &notifier{
+		opts:     opts,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		template: tmpl,
+		events:   events,
+		queue:    make(chan notification, 100),
+		done:     make(chan struct{}),
+	}
+	// Notifications of a stopped run are still delivered
+	n.ctx, n.cancel = context.WithCancel(context.WithoutCancel(ctx))
+	go n.deliver()
+	return n, nil
+}
+
+// Queue a notification of the run, unless its event is not configured
+func (n *notifier) notify(result *cycleResult, event notification) {
+	if n == nil || !n.events[event.Event] {
+		return
+	}
+	event.Time = time.Now()
+	event.RunId, event.ClusterId, event.TargetVersion = result.RunId, result.ClusterId, result.TargetVersion
+
+	select {
+	case n.queue <- event:
+	default:
+		loggerFrom(n.ctx).Warn("Notification queue is full, dropping notification", "event", event.Event)
+	}
+}
+
+// Queue the notification of a node which has been handled
+func (n *notifier) node(result *cycleResult, node string, sksNodepoolId string, status string, err error) {
+	event := notification{Event: "node-" + status, Node: node, NodepoolId: sksNodepoolId, Status: status}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	n.notify(result, event)
+}
+
+// Queue the notification of a finished run, deliver all queued notifications and stop the notifier
+func (n *notifier) finish(result *cycleResult, err error) {
+	if n == nil {
+		return
+	}
+
+	if err == nil {
+		err = result.err()
+	}
+	if !errors.Is(err, errNothingToDo) {
+		event := notification{Event: notifyEventRunFinished, Result: "success"}
+		if err != nil {
+			event.Event, event.Result, event.Error = notifyEventRunFailed, errorClassOf(err).String(), err.Error()
+		}
+		for _, node := range result.Nodes {
+			switch node.Status {
+			case nodeStatusReplaced:
+				event.Replaced += 1
+			case nodeStatusSkipped:
+				event.Skipped += 1
+			case nodeStatusFailed:
+				event.Failed += 1
+			}
+		}
+		n.notify(result, event)
+	}
+
+	close(n.queue)
+	select {
+	case <-n.done:
+	case <-time.After(notifyShutdownTimeout):
+		loggerFrom(n.ctx).Warn("Notifications could not be delivered in time, dropping them", "timeout", notifyShutdownTimeout)
+		n.cancel()
+		<-n.done
+	}
+	n.cancel()
+}
+
+// Deliver queued notifications to every webhook until the queue is closed
+func (n *notifier) deliver() {
+	defer close(n.done)
+	for event := range n.queue {
+		var message bytes.Buffer
+		if err := n.template.Execute(&message, event); err != nil {
+			loggerFrom(n.ctx).Error("Error while rendering notification", "event", event.Event, logKeyError, err)
+			continue
+		}
+		event.Message = message.String()
+
+		payload, err := n.payload(event)
+		if err != nil {
+			loggerFrom(n.ctx).Error("Error while encoding notification", "event", event.Event, logKeyError, err)
+			continue
+		}
+		for _, url := range n.opts.urls {
+			if err := n.post(url, payload); err != nil {
+				loggerFrom(n.ctx).Error("Error while sending notification", "event", event.Event, logKeyError, err)
+			}
+		}
+	}
+}
+
+// Encode the notification in the payload of the configured format
+func (n *notifier) payload(event notification) ([]byte, error) {
+	switch n.opts.format {
+	case notifyFormatSlack:
+		return json.Marshal(map[string]any{"text": event.Message})
+	case notifyFormatTeams:
+		color := "2EB886"
+		if event.Error != "" {
+			color = "D13438"
+		}
+		return json.Marshal(map[string]any{
+			"@type":      "MessageCard",
+			"@context":   "https://schema.org/extensions",
+			"summary":    fmt.Sprintf("%s %s", eventComponent, event.Event),
+			"themeColor": color,
+			"text":       event.Message,
+		})
+	default:
+		return json.Marshal(event)
+	}
+}
+
+// Post the payload to a webhook. Network errors, server errors and rate limits are retried with backoff, up to the
+// steps of notifyBackoff attempts in total.
+func (n *notifier) post(url string, payload []byte) error {
+	backoff := notifyBackoff
+	for attempt := 1; ; attempt++ {
+		err := n.postOnce(url, payload)
+		var statusErr *webhookStatusError
+		if err == nil || (errors.As(err, &statusErr) && !statusErr.retryable()) || attempt >= notifyBackoff.Steps {
+			return err
+		}
+
+		delay := backoff.Step()
+		loggerFrom(n.ctx).Warn("Error while sending notification, retrying", logKeyError, err, "retry_in", delay)
+		select {
+		case <-n.ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (n *notifier) postOnce(url string, payload []byte) error {
+	req, err := http.NewRequestWithContext(n.ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, math.MaxInt16))
+	if resp.StatusCode >= 300 {
+		return &webhookStatusError{statusCode: resp.StatusCode}
+	}
+	return nil
+}
+
+// webhookStatusError is returned when a webhook responds with an unexpected status
+type webhookStatusError struct {
+	statusCode int
+}
+
+func (e *webhookStatusError) Error() string {
+	return fmt.Sprintf("webhook responded with status %d", e.statusCode)
+}
+
+// Server errors and rate limits may go away, other errors are not retried
+func (e *webhookStatusError) retryable() bool {
+	return e.statusCode >= 500 || e.statusCode == http.StatusTooManyRequests
+}
@@ -0,0 +1,196 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// webhookRecorder is a local webhook which records the payloads posted to it. The first failures requests are
+// answered with the given status.
+type webhookRecorder struct {
+	mu       sync.Mutex
+	payloads []map[string]any
+	failures int
+	status   int
+}
+
+func (w *webhookRecorder) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.failures > 0 {
+		w.failures -= 1
+		rw.WriteHeader(w.status)
+		return
+	}
+	data, _ := io.ReadAll(r.Body)
+	var payload map[string]any
+	if err := json.Unmarshal(data, &payload); err != nil || r.Header.Get("Content-Type") != "application/json" {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	w.payloads = append(w.payloads, payload)
+}
+
+func shortNotifyBackoff(t *testing.T) {
+	backoff := notifyBackoff
+	notifyBackoff.Duration, notifyBackoff.Cap = time.Millisecond, 5*time.Millisecond
+	t.Cleanup(func() {
+		notifyBackoff = backoff
+	})
+}
+
+func TestRunCycleSendsNotifications(t *testing.T) {
+	webhook := &webhookRecorder{}
+	server := httptest.NewServer(webhook)
+	defer server.Close()
+
+	clientset := fake.NewSimpleClientset()
+	provider := newFakeSKSProvider(clientset, "1.29.3")
+	provider.addNodepool("np-1", "workers", "v1.28.7", 1)
+
+	opts := testCycleOptions()
+	opts.notify = notifierOptions{urls: []string{server.URL}}
+	if _, err := runCycle(context.Background(), clientset, provider, opts); err != nil {
+		t.Fatalf("runCycle() error = %v", err)
+	}
+
+	// All notifications are delivered before the run returns
+	want := []string{notifyEventRunStarted, notifyEventNodeReplaced, notifyEventRunFinished}
+	if len(webhook.payloads) != len(want) {
+		t.Fatalf("notifications = %v, want %v", webhook.payloads, want)
+	}
+	runId := webhook.payloads[0]["runId"]
+	for i, payload := range webhook.payloads {
+		if payload["event"] != want[i] {
+			t.Errorf("notification %d is %v, want %s", i, payload["event"], want[i])
+		}
+		if payload["runId"] != runId || payload["targetVersion"] != "v1.29.3" || payload["message"] == "" {
+			t.Errorf("notification %d = %v, want the run ID, target version and message", i, payload)
+		}
+	}
+	if node := webhook.payloads[1]; node["node"] != "pool-workers-1" || node["nodepoolId"] != "np-1" {
+		t.Errorf("node notification = %v, want node pool-workers-1 of np-1", node)
+	}
+	if finished := webhook.payloads[2]; finished["result"] != "success" || finished["replaced"] != float64(1) {
+		t.Errorf("run notification = %v, want a success with 1 replaced node", finished)
+	}
+}
+
+func TestResumedRunNotifiesVanishedNodesWithItsRunId(t *testing.T) {
+	webhook := &webhookRecorder{}
+	server := httptest.NewServer(webhook)
+	defer server.Close()
+
+	ctx := context.Background()
+	clientset := fake.NewSimpleClientset()
+	provider := newFakeSKSProvider(clientset, "1.29.3")
+	provider.addNodepool("np-1", "workers", "v1.28.7", 1)
+
+	// The node of the checkpoint has been replaced before the run was killed
+	store, err := newCheckpointStore("configmap:kube-system/sks-lifecycler", clientset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp := &checkpoint{
+		ClusterId:      provider.sksClusterId,
+		RunId:          "0b6e9f5a-run",
+		DesiredVersion: "v1.29.3",
+		Nodes:          []checkpointNode{{Name: "pool-workers-0", NodepoolId: "np-1"}},
+	}
+	if err := store.Save(ctx, cp); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := testCycleOptions()
+	opts.checkpoint = "configmap:kube-system/sks-lifecycler"
+	opts.resume = true
+	opts.notify = notifierOptions{urls: []string{server.URL}}
+	if _, err := runCycle(ctx, clientset, provider, opts); err != nil {
+		t.Fatalf("runCycle() error = %v", err)
+	}
+
+	want := []string{notifyEventNodeReplaced, notifyEventRunFinished}
+	if len(webhook.payloads) != len(want) {
+		t.Fatalf("notifications = %v, want %v", webhook.payloads, want)
+	}
+	for i, payload := range webhook.payloads {
+		if payload["event"] != want[i] || payload["runId"] != cp.RunId || payload["targetVersion"] != "v1.29.3" {
+			t.Errorf("notification %d = %v, want %s of run %s to v1.29.3", i, payload, want[i], cp.RunId)
+		}
+	}
+}
+
+func TestNotifierRetriesAndRendersTemplates(t *testing.T) {
+	shortNotifyBackoff(t)
+	webhook := &webhookRecorder{failures: 2, status: http.StatusServiceUnavailable}
+	server := httptest.NewServer(webhook)
+	defer server.Close()
+
+	template := filepath.Join(t.TempDir(), "message.tmpl")
+	if err := os.WriteFile(template, []byte(`{{ .Event }}: {{ .Node }} is {{ .Status }}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	result := &cycleResult{RunId: "run-1"}
+	n, err := newNotifier(context.Background(), notifierOptions{urls: []string{server.URL}, format: notifyFormatSlack, template: template, events: []string{notifyEventNodeFailed}})
+	if err != nil {
+		t.Fatalf("newNotifier() error = %v", err)
+	}
+	n.node(result, "node-1", "np-1", nodeStatusReplaced, nil)
+	n.node(result, "node-2", "np-1", nodeStatusFailed, errEvictionTimeout)
+	n.finish(result, nil)
+
+	if len(webhook.payloads) != 1 || webhook.payloads[0]["text"] != "node-failed: node-2 is failed" {
+		t.Errorf("notifications = %v, want only the failed node as Slack message", webhook.payloads)
+	}
+}
+
+func TestNotifierGivesUpOnClientErrors(t *testing.T) {
+	shortNotifyBackoff(t)
+	webhook := &webhookRecorder{failures: 1, status: http.StatusBadRequest}
+	server := httptest.NewServer(webhook)
+	defer server.Close()
+
+	n, err := newNotifier(context.Background(), notifierOptions{urls: []string{server.URL}, format: notifyFormatTeams})
+	if err != nil {
+		t.Fatalf("newNotifier() error = %v", err)
+	}
+	result := &cycleResult{}
+	n.node(result, "node-1", "np-1", nodeStatusReplaced, nil)
+	n.node(result, "node-2", "np-1", nodeStatusReplaced, nil)
+	n.finish(result, nil)
+
+	// The first notification is dropped, the second one is delivered as a Teams message card. A run without
+	// selected nodes is not notified.
+	if len(webhook.payloads) != 1 || webhook.payloads[0]["@type"] != "MessageCard" {
+		t.Errorf("notifications = %v, want the second node as Teams message card", webhook.payloads)
+	}
+}
+
+func TestNewNotifierRejectsInvalidOptions(t *testing.T) {
+	tests := map[string]notifierOptions{
+		"format":   {urls: []string{"http://localhost"}, format: "discord"},
+		"event":    {urls: []string{"http://localhost"}, events: []string{"node-selected"}},
+		"template": {urls: []string{"http://localhost"}, template: "/does/not/exist"},
+	}
+	for name, opts := range tests {
+		if _, err := newNotifier(context.Background(), opts); exitCode(err) != exitCodeConfig {
+			t.Errorf("%s: newNotifier() error = %v, want a config error", name, err)
+		}
+	}
+
+	if n, err := newNotifier(context.Background(), notifierOptions{}); n != nil || err != nil {
+		t.Errorf("newNotifier() = %v, %v, want no notifier without webhooks", n, err)
+	}
+}
@@ -0,0 +1,328 @@
+package cmd
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	egoscalev2 "github.com/exoscale/egoscale/v2"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Parse the number of nodes of a nodepool which may be replaced at the same time, either an absolute count like "3"
+// or a percentage of the size of the nodepool like "25%". A percentage is rounded down, but allows at least one node.
+// An empty value allows one node.
+func parseMaxUnavailable(value string, nodepoolSize int) (int, error) {
+	if value == "" {
+		return 1, nil
+	}
+	if percent, found := strings.CutSuffix(value, "%"); found {
+		p, err := strconv.Atoi(percent)
+		if err != nil || p <= 0 || p > 100 {
+			return 0, configError("invalid max unavailable '%s', expected a percentage between 1%% and 100%%", value)
+		}
+		return max(nodepoolSize*p/100, 1), nil
+	}
+	count, err := strconv.Atoi(value)
+	if err != nil || count <= 0 {
+		return 0, configError("invalid max unavailable '%s', expected a count of 1 or more or a percentage", value)
+	}
+	return count, nil
+}
+
+// nodepoolNodes are the selected nodes of a nodepool, in the order they are replaced
+type nodepoolNodes struct {
+	id    string
+	nodes []corev1.Node
+}
+
+// Group the selected nodes by nodepool. Nodepools are ordered by their first node, nodes keep their order.
+// Nodes without a nodepool form a group of their own, they fail once they are replaced.
+func groupByNodepool(nodes []corev1.Node) []nodepoolNodes {
+	var groups []nodepoolNodes
+	index := make(map[string]int)
+	for _, node := range nodes {
+		sksNodepoolId, _ := getNodepoolId(node)
+		i, exists := index[sksNodepoolId]
+		if !exists {
+			i = len(groups)
+			index[sksNodepoolId] = i
+			groups = append(groups, nodepoolNodes{id: sksNodepoolId})
+		}
+		groups[i].nodes = append(groups[i].nodes, node)
+	}
+	return groups
+}
+
+// Compute the budget of every nodepool of the cluster from its size
+func nodepoolBudgets(sksCluster *egoscalev2.SKSCluster, maxUnavailable string) (map[string]int, error) {
+	budgets := make(map[string]int)
+	for _, sksNodepool := range sksCluster.Nodepools {
+		if sksNodepool.ID == nil {
+			continue
+		}
+		size := 0
+		if sksNodepool.Size != nil {
+			size = int(*sksNodepool.Size)
+		}
+		budget, err := parseMaxUnavailable(maxUnavailable, size)
+		if err != nil {
+			return nil, err
+		}
+		budgets[*sksNodepool.ID] = budget
+	}
+	return budgets, nil
+}
+
+// surgeCredit tracks the surge nodes which have been added to a nodepool, but not yet been compensated by evicting
+// an old node. Every node which is being replaced claims one of them, so nodes of a nodepool which are replaced at
+// the same time never count on the same surge node. It is safe for concurrent use.
+type surgeCredit struct {
+	mu      sync.Mutex
+	credit  map[string]int
+	claimed map[string]int
+	// Selected nodes per nodepool which have not held a surge node yet and may still need one
+	remaining map[string]int
+	// IDs of the surge instances per nodepool which the run has created, a rollback only removes these
+	instances map[string][]string
+	// Serialize changes of the size of a nodepool
+	locks map[string]*sync.Mutex
+}
+
+func newSurgeCredit(credit map[string]int, instances map[string][]string, nodes []corev1.Node) *surgeCredit {
+	s := &surgeCredit{
+		credit:    make(map[string]int),
+		claimed:   make(map[string]int),
+		remaining: make(map[string]int),
+		instances: make(map[string][]string),
+		locks:     make(map[string]*sync.Mutex),
+	}
+	for sksNodepoolId, n := range credit {
+		s.credit[sksNodepoolId] = n
+	}
+	for sksNodepoolId, instanceIds := range instances {
+		s.instances[sksNodepoolId] = slices.Clone(instanceIds)
+	}
+	for _, node := range nodes {
+		if sksNodepoolId, err := getNodepoolId(node); err == nil {
+			s.remaining[sksNodepoolId] += 1
+		}
+	}
+	return s
+}
+
+// Lock the size of the nodepool, until the returned function is called
+func (s *surgeCredit) lockNodepool(sksNodepoolId string) func() {
+	s.mu.Lock()
+	lock, exists := s.locks[sksNodepoolId]
+	if !exists {
+		lock = &sync.Mutex{}
+		s.locks[sksNodepoolId] = lock
+	}
+	s.mu.Unlock()
+
+	lock.Lock()
+	return lock.Unlock
+}
+
+// Count a node of the nodepool which is done without ever holding a surge node, it does not need one anymore
+func (s *surgeCredit) settle(sksNodepoolId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remaining[sksNodepoolId] -= 1
+}
+
+// Number of surge nodes a scale-up of the nodepool adds: enough to have target surge nodes, but no more than the
+// nodes which still need one
+func (s *surgeCredit) shortfall(sksNodepoolId string, target int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return max(min(target-s.credit[sksNodepoolId], s.remaining[sksNodepoolId]), 1)
+}
+
+// Claim a surge node of the nodepool which nobody else has claimed, false if there is none
+func (s *surgeCredit) claim(sksNodepoolId string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.credit[sksNodepoolId]-s.claimed[sksNodepoolId] <= 0 {
+		return false
+	}
+	s.claimed[sksNodepoolId] += 1
+	s.remaining[sksNodepoolId] -= 1
+	return true
+}
+
+// Add the surge nodes of a scale-up with the IDs of the instances it created, the node which requested it claims one
+// of them
+func (s *surgeCredit) add(sksNodepoolId string, n int, instanceIds []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.credit[sksNodepoolId] += n
+	s.instances[sksNodepoolId] = append(s.instances[sksNodepoolId], instanceIds...)
+	s.claimed[sksNodepoolId] += 1
+	s.remaining[sksNodepoolId] -= 1
+}
+
+// Give a claimed surge node back, because the replacement of the node which claimed it did not go through
+func (s *surgeCredit) release(sksNodepoolId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.claimed[sksNodepoolId] > 0 {
+		s.claimed[sksNodepoolId] -= 1
+	}
+}
+
+// Compensate a surge node, because an old node has been evicted from the nodepool
+func (s *surgeCredit) use(sksNodepoolId string, claimed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.credit[sksNodepoolId] > 0 {
+		s.credit[sksNodepoolId] -= 1
+	}
+	if claimed && s.claimed[sksNodepoolId] > 0 {
+		s.claimed[sksNodepoolId] -= 1
+	}
+}
+
+// Number of surge nodes of the nodepool which no node has claimed
+func (s *surgeCredit) unclaimed(sksNodepoolId string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return max(s.credit[sksNodepoolId]-s.claimed[sksNodepoolId], 0)
+}
+
+// IDs of the surge instances of the nodepool which the run has created
+func (s *surgeCredit) surgeInstances(sksNodepoolId string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.instances[sksNodepoolId])
+}
+
+// Drop surge instances which have been removed from the nodepool again
+func (s *surgeCredit) drop(sksNodepoolId string, instanceIds []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.credit[sksNodepoolId] = max(s.credit[sksNodepoolId]-len(instanceIds), 0)
+	s.instances[sksNodepoolId] = slices.DeleteFunc(s.instances[sksNodepoolId], func(id string) bool {
+		return slices.Contains(instanceIds, id)
+	})
+}
+
+// Copy of the surge credit of every nodepool, claimed or not, and of the surge instances the run has created
+func (s *surgeCredit) snapshot() (map[string]int, map[string][]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	credit := make(map[string]int)
+	for sksNodepoolId, n := range s.credit {
+		if n > 0 {
+			credit[sksNodepoolId] = n
+		}
+	}
+	instances := make(map[string][]string)
+	for sksNodepoolId, instanceIds := range s.instances {
+		if len(instanceIds) > 0 {
+			instances[sksNodepoolId] = slices.Clone(instanceIds)
+		}
+	}
+	return credit, instances
+}
+
+// Replace the selected nodes, up to parallelNodepools nodepools at a time and within a nodepool up to its budget of
+// nodes at a time. With the defaults, nodes are replaced one after the other in their order. Once a node aborts the
+// cycle or the context is done, no further node is started and the nodes in progress are waited for.
+func (c *cycler) replaceNodes(ctx context.Context, nodes []corev1.Node) error {
+	groups := groupByNodepool(nodes)
+	workers := min(c.opts.parallelNodepools, len(groups))
+
+	var (
+		mu sync.Mutex
+		// First error which aborted the cycle
+		abortErr error
+		// Whether nodes have been left out, because the cycle was stopped
+		leftOut bool
+		handled atomic.Int64
+	)
+	stopped := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if abortErr != nil || ctx.Err() != nil {
+			leftOut = true
+			return true
+		}
+		return false
+	}
+
+	replaceNodepool := func(group nodepoolNodes) {
+		budget := c.budget(group.id)
+		log := loggerFrom(withLogFields(ctx, logKeyNodepool, group.id))
+		log.Info("Replacing nodes of nodepool", "nodes", len(group.nodes), "max_unavailable", budget)
+
+		slots := make(chan struct{}, budget)
+		var wg sync.WaitGroup
+		for _, node := range group.nodes {
+			slots <- struct{}{}
+			if stopped() {
+				break
+			}
+			wg.Add(1)
+			go func(node corev1.Node) {
+				defer wg.Done()
+				defer func() { <-slots }()
+
+				if err := c.replaceNode(ctx, node); err != nil {
+					mu.Lock()
+					if abortErr == nil {
+						abortErr = err
+					}
+					mu.Unlock()
+				} else {
+					// The node has been handled, it does not have to be reconciled on resume
+					c.run.done(ctx, c.result, c.surge, node.Name)
+				}
+				log.Info("Progress of the run", "handled", handled.Add(1), "selected", len(nodes))
+			}(node)
+		}
+		wg.Wait()
+	}
+
+	queue := make(chan nodepoolNodes)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for group := range queue {
+				replaceNodepool(group)
+			}
+		}()
+	}
+	for _, group := range groups {
+		if stopped() {
+			break
+		}
+		queue <- group
+	}
+	close(queue)
+	wg.Wait()
+
+	if abortErr != nil {
+		return abortErr
+	}
+	if leftOut {
+		return interruptedError(ctx)
+	}
+	return nil
+}
+
+// Number of nodes of the nodepool which may be replaced at the same time. With surging, every node which is being
+// replaced holds a surge node, so the surge count limits it as well.
+func (c *cycler) budget(sksNodepoolId string) int {
+	budget := max(c.budgets[sksNodepoolId], 1)
+	if c.opts.surgeCount > 0 {
+		budget = min(budget, c.opts.surgeCount)
+	}
+	return budget
+}
@@ -0,0 +1,195 @@
+package cmd
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// cordonTracker records how many nodes are cordoned at the same time, per nodepool and in the whole cluster
+type cordonTracker struct {
+	mu         sync.Mutex
+	cordoned   map[string]string
+	maxPerPool map[string]int
+	maxTotal   int
+}
+
+func trackCordonedNodes(clientset *fake.Clientset) *cordonTracker {
+	tracker := &cordonTracker{cordoned: make(map[string]string), maxPerPool: make(map[string]int)}
+	clientset.PrependReactor("update", "nodes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		node := action.(k8stesting.UpdateAction).GetObject().(*corev1.Node)
+		tracker.mu.Lock()
+		defer tracker.mu.Unlock()
+
+		if !node.Spec.Unschedulable {
+			delete(tracker.cordoned, node.Name)
+			return false, nil, nil
+		}
+		sksNodepoolId, _ := getNodepoolId(*node)
+		tracker.cordoned[node.Name] = sksNodepoolId
+		inPool := 0
+		for _, id := range tracker.cordoned {
+			if id == sksNodepoolId {
+				inPool += 1
+			}
+		}
+		tracker.maxPerPool[sksNodepoolId] = max(tracker.maxPerPool[sksNodepoolId], inPool)
+		tracker.maxTotal = max(tracker.maxTotal, len(tracker.cordoned))
+		return false, nil, nil
+	})
+	clientset.PrependReactor("delete", "nodes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		tracker.mu.Lock()
+		defer tracker.mu.Unlock()
+		delete(tracker.cordoned, action.(k8stesting.DeleteAction).GetName())
+		return false, nil, nil
+	})
+	return tracker
+}
+
+func TestRunCycleReplacesNodesWithinBudget(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	provider := newFakeSKSProvider(clientset, "1.29.3")
+	provider.creationDelay = 20 * time.Millisecond
+	provider.addNodepool("np-1", "workers", "v1.28.7", 4)
+	provider.addNodepool("np-2", "gpu", "v1.28.7", 4)
+	tracker := trackCordonedNodes(clientset)
+
+	// Drained nodes are held back for a moment, so the replacements of nodes overlap
+	hook := hookConfig{Point: hookPointPostDrain, Command: []string{"sleep", "0.2"}}
+	if err := hook.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := testCycleOptions()
+	opts.surgeCount = 2
+	opts.maxUnavailable = "50%"
+	opts.parallelNodepools = 2
+	opts.hooks = []hookConfig{hook}
+	result, err := runCycle(context.Background(), clientset, provider, opts)
+	if err != nil {
+		t.Fatalf("runCycle() error = %v", err)
+	}
+	if err := result.err(); err != nil {
+		t.Fatalf("result error = %v", err)
+	}
+	if len(result.Nodes) != 8 {
+		t.Errorf("results = %d nodes, want 8", len(result.Nodes))
+	}
+
+	for _, id := range []string{"np-1", "np-2"} {
+		if n := tracker.maxPerPool[id]; n != 2 {
+			t.Errorf("nodepool %s had up to %d nodes cordoned at the same time, want 2", id, n)
+		}
+		if size := provider.nodepoolSize(id); size != 4 {
+			t.Errorf("nodepool %s has %d nodes, want its original size of 4", id, size)
+		}
+	}
+	if tracker.maxTotal <= 2 {
+		t.Errorf("cluster had up to %d nodes cordoned at the same time, want the nodepools to be cycled in parallel", tracker.maxTotal)
+	}
+}
+
+func TestRunCycleReplacesNodesOneAtATimeByDefault(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	provider := newFakeSKSProvider(clientset, "1.29.3")
+	provider.addNodepool("np-1", "workers", "v1.28.7", 2)
+	provider.addNodepool("np-2", "gpu", "v1.28.7", 2)
+	tracker := trackCordonedNodes(clientset)
+
+	opts := testCycleOptions()
+	opts.surgeCount = 1
+	if _, err := runCycle(context.Background(), clientset, provider, opts); err != nil {
+		t.Fatalf("runCycle() error = %v", err)
+	}
+	if tracker.maxTotal != 1 {
+		t.Errorf("cluster had up to %d nodes cordoned at the same time, want 1", tracker.maxTotal)
+	}
+}
+
+func TestRunCycleScalesNodepoolUpOnceForNodesReplacedAtTheSameTime(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	provider := newFakeSKSProvider(clientset, "1.29.3")
+	provider.addNodepool("np-1", "workers", "v1.28.7", 4)
+
+	opts := testCycleOptions()
+	opts.surgeCount = 4
+	opts.maxUnavailable = "100%"
+	result, err := runCycle(context.Background(), clientset, provider, opts)
+	if err != nil {
+		t.Fatalf("runCycle() error = %v", err)
+	}
+	if err := result.err(); err != nil {
+		t.Fatalf("result error = %v", err)
+	}
+	if scales := provider.callCount("ScaleNodepool"); scales != 1 {
+		t.Errorf("nodepool scale-ups = %d, want 1 for all nodes replaced at the same time", scales)
+	}
+	if size := provider.nodepoolSize("np-1"); size != 4 {
+		t.Errorf("nodepool has %d nodes, want its original size of 4", size)
+	}
+}
+
+func TestRunCycleDoesNotSurgeBeyondTheSurgeCount(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	provider := newFakeSKSProvider(clientset, "1.29.3")
+	provider.addNodepool("np-1", "workers", "v1.28.7", 4)
+	tracker := trackCordonedNodes(clientset)
+
+	opts := testCycleOptions()
+	opts.surgeCount = 1
+	opts.maxUnavailable = "100%"
+	if _, err := runCycle(context.Background(), clientset, provider, opts); err != nil {
+		t.Fatalf("runCycle() error = %v", err)
+	}
+	// Every node holds a surge node, so a single surge node lets only one node be replaced at a time
+	if n := tracker.maxPerPool["np-1"]; n != 1 {
+		t.Errorf("nodepool had up to %d nodes cordoned at the same time, want 1", n)
+	}
+	if scales := provider.callCount("ScaleNodepool"); scales != 4 {
+		t.Errorf("nodepool scale-ups = %d, want one surge node for each of the 4 nodes", scales)
+	}
+}
+
+func TestParseMaxUnavailable(t *testing.T) {
+	tests := []struct {
+		value string
+		size  int
+		want  int
+	}{
+		{"", 10, 1},
+		{"3", 10, 3},
+		{"25%", 10, 2},
+		{"10%", 4, 1},
+		{"100%", 4, 4},
+	}
+	for _, test := range tests {
+		if got, err := parseMaxUnavailable(test.value, test.size); err != nil || got != test.want {
+			t.Errorf("parseMaxUnavailable(%q, %d) = %d, %v, want %d", test.value, test.size, got, err, test.want)
+		}
+	}
+	for _, value := range []string{"0", "-1", "0%", "150%", "all"} {
+		if _, err := parseMaxUnavailable(value, 10); exitCode(err) != exitCodeConfig {
+			t.Errorf("parseMaxUnavailable(%q) error = %v, want a config error", value, err)
+		}
+	}
+}
+
+func TestCycleOptionsRejectInvalidParallelism(t *testing.T) {
+	tests := map[string]func(opts *cycleOptions){
+		"max unavailable":    func(opts *cycleOptions) { opts.maxUnavailable = "0" },
+		"parallel nodepools": func(opts *cycleOptions) { opts.parallelNodepools = 0 },
+	}
+	for name, invalidate := range tests {
+		opts := testCycleOptions()
+		invalidate(&opts)
+		if err := opts.validate(); exitCode(err) != exitCodeConfig {
+			t.Errorf("%s: validate() error = %v, want a config error", name, err)
+		}
+	}
+}
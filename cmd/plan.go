@@ -0,0 +1,245 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const (
+	planActionReplace string = "replace"
+	planActionSkip    string = "skip"
+	planActionKeep    string = "keep"
+)
+
+// planCmd represents the plan command
+var planCmd = &cobra.Command{
+	Use:   "plan",
+	Short: "Show which nodes a cycle would replace, without changing anything.",
+	Long: `Show which nodes a cycle would replace, without changing anything.
+
+The same selection as in "nodepool cycle" is applied (kubelet version compared with the
+desired version, plus the evictNodesLabelSelector and the nodepool filter). Nodes are listed
+nodepool by nodepool in the order of the cycle. For every node the plan lists its
+nodepool, the deployments which would be rollout-restarted and the pods which would be
+evicted. Nodes with running jobs are listed as skipped.`,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		return bindNodepoolFlags(cmd)
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		ctx, cancel := commandContext(cmd)
+		defer cancel()
+
+		output, _ := cmd.Flags().GetString("output")
+		return printPlanFromConfig(ctx, cmd.OutOrStdout(), output)
+	},
+}
+
+// cyclePlan describes what a cycle would do, without doing it
+type cyclePlan struct {
+	DesiredK8sVersion string     `json:"desiredK8sVersion"`
+	Nodes             []nodePlan `json:"nodes"`
+}
+
+type nodePlan struct {
+	Node               string   `json:"node"`
+	KubeletVersion     string   `json:"kubeletVersion"`
+	NodepoolId         string   `json:"nodepoolId"`
+	Nodepool           string   `json:"nodepool"`
+	Action             string   `json:"action"`
+	Reason             string   `json:"reason"`
+	RestartDeployments []string `json:"restartDeployments"`
+	EvictPods          []string `json:"evictPods"`
+}
+
+// printPlanFromConfig builds the plan for the configured cluster and prints it in the configured format
+func printPlanFromConfig(ctx context.Context, out io.Writer, format string) error {
+	opts := cycleOptions{
+		desiredK8sVersion:       viper.GetString("desired_k8s_version"),
+		evictNodesLabelSelector: viper.GetString("evict_nodes_labelselector"),
+		surgeCount:              viper.GetInt("surge_count"),
+		nodepools:               splitList(viper.GetString("nodepool")),
+		excludeNodepools:        splitList(viper.GetString("exclude_nodepool")),
+		nodepoolOrder:           viper.GetString("nodepool_order"),
+	}
+
+	clientset, egoclient, err := initClients()
+	if err != nil {
+		return err
+	}
+
+	provider := newExoscaleProvider(egoclient, viper.GetString("exoscale_api_zone"), viper.GetString("sks_cluster_id"))
+	plan, err := buildPlan(ctx, clientset, provider, opts)
+	if err != nil {
+		return err
+	}
+
+	return printPlan(out, plan, format)
+}
+
+// buildPlan applies the node selection of a cycle and collects what would happen to each node. It only reads from the cluster.
+func buildPlan(ctx context.Context, clientset kubernetes.Interface, provider SKSProvider, opts cycleOptions) (*cyclePlan, error) {
+	sksCluster, err := provider.GetCluster(ctx)
+	if err != nil {
+		return nil, exoscaleError(err)
+	}
+
+	filter, err := newNodepoolFilter(sksCluster, opts)
+	if err != nil {
+		return nil, err
+	}
+	desiredK8sVersion, err := resolveDesiredVersion(ctx, provider, sksCluster, opts.desiredK8sVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	nodepoolNames := make(map[string]string)
+	for _, sksNodepool := range sksCluster.Nodepools {
+		if sksNodepool.ID != nil && sksNodepool.Name != nil {
+			nodepoolNames[*sksNodepool.ID] = *sksNodepool.Name
+		}
+	}
+
+	nodes, err := clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, kubernetesError(err)
+	}
+
+	labelSelectedNodes, err := listLabelSelectedNodes(ctx, clientset, opts.evictNodesLabelSelector)
+	if err != nil {
+		return nil, err
+	}
+
+	filter.sort(nodes.Items)
+	plan := &cyclePlan{DesiredK8sVersion: kubeletVersionString(desiredK8sVersion)}
+	for _, node := range nodes.Items {
+		selected, reason := nodeSelected(node, desiredK8sVersion, labelSelectedNodes)
+		if inCycle, filterReason := filter.selected(node); selected && !inCycle {
+			selected, reason = false, filterReason
+		}
+
+		sksNodepoolId, _ := getNodepoolId(node)
+		entry := nodePlan{
+			Node:               node.Name,
+			KubeletVersion:     node.Status.NodeInfo.KubeletVersion,
+			NodepoolId:         sksNodepoolId,
+			Nodepool:           nodepoolNames[sksNodepoolId],
+			Action:             planActionKeep,
+			Reason:             reason,
+			RestartDeployments: []string{},
+			EvictPods:          []string{},
+		}
+
+		if selected {
+			entry.Action = planActionReplace
+
+			hasRunningJobs, err := nodeHasRunningJobs(ctx, clientset, node.Name)
+			if err != nil {
+				return nil, kubernetesError(err)
+			}
+
+			if sksNodepoolId == "" {
+				entry.Action = planActionSkip
+				entry.Reason = fmt.Sprintf("label '%s' does not exist on the node", nodeLabelNodepoolId)
+			} else if hasRunningJobs {
+				entry.Action = planActionSkip
+				entry.Reason = "node has running jobs, it would only be cordoned"
+			} else if err := planNodePods(ctx, clientset, node, &entry); err != nil {
+				return nil, kubernetesError(err)
+			}
+		}
+
+		plan.Nodes = append(plan.Nodes, entry)
+	}
+
+	return plan, nil
+}
+
+// planNodePods collects the deployments which would be restarted and the pods which would be evicted when draining the node
+func planNodePods(ctx context.Context, clientset kubernetes.Interface, node corev1.Node, entry *nodePlan) error {
+	pods, err := listNodePods(ctx, clientset, node.Name)
+	if err != nil {
+		return err
+	}
+
+	deployments := make(map[string]bool)
+	for _, pod := range pods {
+		if pod.DeletionTimestamp != nil {
+			continue
+		}
+
+		podOwnerRef := metav1.GetControllerOf(&pod)
+		if podOwnerRef != nil && podOwnerRef.Kind == "DaemonSet" {
+			continue
+		}
+
+		deployment, err := getPodDeployment(ctx, clientset, pod)
+		if err != nil {
+			return err
+		}
+		if deployment != nil {
+			deployments[deployment.Namespace+"/"+deployment.Name] = true
+			continue
+		}
+
+		entry.EvictPods = append(entry.EvictPods, pod.Namespace+"/"+pod.Name)
+	}
+
+	for deployment := range deployments {
+		entry.RestartDeployments = append(entry.RestartDeployments, deployment)
+	}
+	sort.Strings(entry.RestartDeployments)
+
+	return nil
+}
+
+// printPlan prints the plan either as a table or as JSON
+func printPlan(out io.Writer, plan *cyclePlan, format string) error {
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(plan)
+	case "table", "":
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "NODE\tVERSION\tNODEPOOL\tACTION\tREASON\tRESTART DEPLOYMENTS\tEVICT PODS")
+		for _, entry := range plan.Nodes {
+			nodepool := entry.Nodepool
+			if nodepool == "" {
+				nodepool = entry.NodepoolId
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", entry.Node, entry.KubeletVersion, orNone(nodepool), entry.Action, entry.Reason,
+				orNone(strings.Join(entry.RestartDeployments, ",")), orNone(strings.Join(entry.EvictPods, ",")))
+		}
+		return w.Flush()
+	default:
+		return configError("unknown output format '%s', expected 'table' or 'json'", format)
+	}
+}
+
+func orNone(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+func init() {
+	nodepoolCmd.AddCommand(planCmd)
+
+	addNodepoolFlags(planCmd)
+	planCmd.Flags().StringP("output", "o", "table", "Output format of the plan: table or json")
+}
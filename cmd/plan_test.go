@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/spf13/viper"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestBuildPlanDoesNotMutate(t *testing.T) {
+	h := newScenarioHarness(t, scenarios[0])
+
+	plan, err := buildPlan(context.Background(), h.clientset, h.provider, h.opts)
+	if err != nil {
+		t.Fatalf("buildPlan() error = %v", err)
+	}
+
+	if actions := h.recorder.list(); len(actions) != 0 {
+		t.Errorf("buildPlan() performed actions %q", actions)
+	}
+
+	want := []nodePlan{
+		{
+			Node: "node-a", KubeletVersion: "v1.28.7", NodepoolId: "np-1", Nodepool: "workers",
+			Action: planActionReplace, Reason: "version v1.28.7 is older than the desired version v1.29.3",
+			RestartDeployments: []string{"default/web"}, EvictPods: []string{"default/bare"},
+		},
+		{
+			Node: "node-b", KubeletVersion: "v1.29.3", NodepoolId: "np-1", Nodepool: "workers",
+			Action: planActionKeep, Reason: "already on desired version v1.29.3",
+			RestartDeployments: []string{}, EvictPods: []string{},
+		},
+	}
+	if !reflect.DeepEqual(plan.Nodes, want) {
+		t.Errorf("plan.Nodes =\n\t%+v\nwant\n\t%+v", plan.Nodes, want)
+	}
+}
+
+func TestBuildPlanAppliesNodepoolFilter(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	provider := newFakeSKSProvider(clientset, "1.29.3")
+	provider.addNodepool("np-1", "workers", "v1.28.7", 1)
+	provider.addNodepool("np-2", "gpu", "v1.28.7", 1)
+
+	// The flags of the plan select the nodepools like those of a cycle
+	t.Cleanup(func() {
+		planCmd.Flags().Set("nodepool", "")
+		viper.Reset()
+	})
+	if err := planCmd.Flags().Set("nodepool", "gpu"); err != nil {
+		t.Fatalf("plan has no --nodepool flag: %v", err)
+	}
+	if err := planCmd.PreRunE(planCmd, nil); err != nil {
+		t.Fatal(err)
+	}
+	opts := cycleOptions{
+		desiredK8sVersion: "v1.29.3",
+		nodepools:         splitList(viper.GetString("nodepool")),
+	}
+
+	plan, err := buildPlan(context.Background(), clientset, provider, opts)
+	if err != nil {
+		t.Fatalf("buildPlan() error = %v", err)
+	}
+	actions := make(map[string]string)
+	for _, node := range plan.Nodes {
+		actions[node.Nodepool] = node.Action + ": " + node.Reason
+	}
+	if actions["gpu"] != planActionReplace+": version v1.28.7 is older than the desired version v1.29.3" {
+		t.Errorf("gpu node = %s, want it replaced", actions["gpu"])
+	}
+	if actions["workers"] != planActionKeep+": its nodepool is not included in the cycle" {
+		t.Errorf("workers node = %s, want it kept by the nodepool filter", actions["workers"])
+	}
+}
@@ -0,0 +1,115 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	egoscalev2 "github.com/exoscale/egoscale/v2"
+	apiv2 "github.com/exoscale/egoscale/v2/api"
+)
+
+// SKSProvider covers every Exoscale API call the lifecycler makes against a single SKS cluster.
+type SKSProvider interface {
+	// GetCluster returns the SKS cluster, including its nodepools.
+	GetCluster(ctx context.Context) (*egoscalev2.SKSCluster, error)
+	// GetNodepool returns the nodepool with the given ID.
+	GetNodepool(ctx context.Context, sksNodepoolId string) (*egoscalev2.SKSNodepool, error)
+	// ListNodepoolInstances returns the Compute instances which are members of the nodepool.
+	ListNodepoolInstances(ctx context.Context, sksNodepool *egoscalev2.SKSNodepool) ([]*egoscalev2.Instance, error)
+	// ScaleNodepool scales the nodepool to the given size and waits for the operation to complete.
+	ScaleNodepool(ctx context.Context, sksNodepool *egoscalev2.SKSNodepool, size int64) error
+	// EvictNodepoolMembers evicts the given instances from the nodepool, which also decreases its size.
+	EvictNodepoolMembers(ctx context.Context, sksNodepool *egoscalev2.SKSNodepool, instanceIds []string) error
+	// ListClusterVersions returns the Kubernetes versions which are available for SKS clusters.
+	ListClusterVersions(ctx context.Context) ([]string, error)
+	// UpgradeCluster upgrades the control plane to the given Kubernetes version and waits for the operation to complete.
+	UpgradeCluster(ctx context.Context, version string) error
+}
+
+// exoscaleProvider implements SKSProvider against the Exoscale API
+type exoscaleProvider struct {
+	egoclient    *egoscalev2.Client
+	zone         string
+	sksClusterId string
+}
+
+func newExoscaleProvider(egoclient *egoscalev2.Client, zone string, sksClusterId string) *exoscaleProvider {
+	return &exoscaleProvider{
+		egoclient:    egoclient,
+		zone:         zone,
+		sksClusterId: sksClusterId,
+	}
+}
+
+func (p *exoscaleProvider) GetCluster(ctx context.Context) (_ *egoscalev2.SKSCluster, err error) {
+	defer observeExoscaleRequest("GetCluster", time.Now(), &err)
+	return p.egoclient.GetSKSCluster(ctx, p.zone, p.sksClusterId)
+}
+
+func (p *exoscaleProvider) GetNodepool(ctx context.Context, sksNodepoolId string) (_ *egoscalev2.SKSNodepool, err error) {
+	defer observeExoscaleRequest("GetNodepool", time.Now(), &err)
+	sksCluster, err := p.egoclient.GetSKSCluster(ctx, p.zone, p.sksClusterId)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, sksNodepool := range sksCluster.Nodepools {
+		if sksNodepool.ID != nil && *sksNodepool.ID == sksNodepoolId {
+			return sksNodepool, nil
+		}
+	}
+
+	return nil, fmt.Errorf("nodepool '%s' does not exist in cluster '%s'", sksNodepoolId, p.sksClusterId)
+}
+
+func (p *exoscaleProvider) ListNodepoolInstances(ctx context.Context, sksNodepool *egoscalev2.SKSNodepool) (_ []*egoscalev2.Instance, err error) {
+	defer observeExoscaleRequest("ListNodepoolInstances", time.Now(), &err)
+	if sksNodepool.InstancePoolID == nil {
+		return nil, fmt.Errorf("nodepool '%s' has no instance pool", *sksNodepool.ID)
+	}
+
+	instancePool, err := p.egoclient.GetInstancePool(ctx, p.zone, *sksNodepool.InstancePoolID)
+	if err != nil {
+		return nil, err
+	}
+	if instancePool.InstanceIDs == nil {
+		return nil, nil
+	}
+
+	instances := make([]*egoscalev2.Instance, 0, len(*instancePool.InstanceIDs))
+	for _, instanceId := range *instancePool.InstanceIDs {
+		instance, err := p.egoclient.GetInstance(ctx, p.zone, instanceId)
+		if err != nil {
+			return nil, err
+		}
+		instances = append(instances, instance)
+	}
+
+	return instances, nil
+}
+
+func (p *exoscaleProvider) ScaleNodepool(ctx context.Context, sksNodepool *egoscalev2.SKSNodepool, size int64) (err error) {
+	defer observeExoscaleRequest("ScaleNodepool", time.Now(), &err)
+	return p.egoclient.ScaleSKSNodepool(ctx, p.zone, p.cluster(), sksNodepool, size)
+}
+
+func (p *exoscaleProvider) EvictNodepoolMembers(ctx context.Context, sksNodepool *egoscalev2.SKSNodepool, instanceIds []string) (err error) {
+	defer observeExoscaleRequest("EvictNodepoolMembers", time.Now(), &err)
+	return p.egoclient.EvictSKSNodepoolMembers(ctx, p.zone, p.cluster(), sksNodepool, instanceIds)
+}
+
+func (p *exoscaleProvider) ListClusterVersions(ctx context.Context) (_ []string, err error) {
+	defer observeExoscaleRequest("ListClusterVersions", time.Now(), &err)
+	return p.egoclient.ListSKSClusterVersions(apiv2.WithZone(ctx, p.zone))
+}
+
+func (p *exoscaleProvider) UpgradeCluster(ctx context.Context, version string) (err error) {
+	defer observeExoscaleRequest("UpgradeCluster", time.Now(), &err)
+	return p.egoclient.UpgradeSKSCluster(ctx, p.zone, p.cluster(), version)
+}
+
+// cluster returns a reference to the SKS cluster, which is sufficient for nodepool operations
+func (p *exoscaleProvider) cluster() *egoscalev2.SKSCluster {
+	return &egoscalev2.SKSCluster{ID: &p.sksClusterId}
+}
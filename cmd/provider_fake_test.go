@@ -0,0 +1,331 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	egoscalev2 "github.com/exoscale/egoscale/v2"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sversion "k8s.io/apimachinery/pkg/version"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// fakeSKSProvider is a stateful in-memory SKSProvider. Nodepool members are registered as
+// Nodes in a fake clientset once they are running, so a whole cycle can run in go test.
+type fakeSKSProvider struct {
+	mu sync.Mutex
+
+	clientset      *fake.Clientset
+	sksClusterId   string
+	clusterVersion string
+	// Versions returned by ListClusterVersions
+	availableVersions []string
+	nodepools         []*fakeNodepool
+
+	// Time it takes a new instance to start and join the cluster
+	creationDelay time.Duration
+	// Errors returned by the next call of a method, keyed by method name
+	errors map[string][]error
+	// Names of all methods which have been called, in order
+	calls []string
+
+	instanceCount int
+}
+
+type fakeNodepool struct {
+	id        string
+	name      string
+	version   string
+	instances []*fakeInstance
+}
+
+type fakeInstance struct {
+	id         string
+	nodeName   string
+	version    string
+	runningAt  time.Time
+	registered bool
+}
+
+func newFakeSKSProvider(clientset *fake.Clientset, clusterVersion string) *fakeSKSProvider {
+	return &fakeSKSProvider{
+		clientset:         clientset,
+		sksClusterId:      "00000000-0000-0000-0000-000000000000",
+		clusterVersion:    clusterVersion,
+		availableVersions: []string{clusterVersion},
+		errors:            make(map[string][]error),
+	}
+}
+
+// addNodepool creates a nodepool whose members are already running and registered as ready nodes
+func (p *fakeSKSProvider) addNodepool(id string, name string, version string, size int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	nodepool := &fakeNodepool{id: id, name: name, version: version}
+	p.nodepools = append(p.nodepools, nodepool)
+	for i := 0; i < size; i++ {
+		p.addInstance(nodepool, time.Now())
+	}
+	p.registerRunningInstances()
+}
+
+// setNodepoolVersion sets the kubelet version of instances which are created from now on
+func (p *fakeSKSProvider) setNodepoolVersion(id string, version string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.nodepool(id).version = version
+}
+
+// failNext makes the next call of the given method return err
+func (p *fakeSKSProvider) failNext(method string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.errors[method] = append(p.errors[method], err)
+}
+
+// nodepoolSize returns the current number of members of the nodepool
+func (p *fakeSKSProvider) nodepoolSize(id string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return len(p.nodepool(id).instances)
+}
+
+// callCount returns how often the given method has been called
+func (p *fakeSKSProvider) callCount(method string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	count := 0
+	for _, call := range p.calls {
+		if call == method {
+			count += 1
+		}
+	}
+	return count
+}
+
+func (p *fakeSKSProvider) GetCluster(ctx context.Context) (*egoscalev2.SKSCluster, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.call("GetCluster"); err != nil {
+		return nil, err
+	}
+
+	sksCluster := &egoscalev2.SKSCluster{
+		ID:      &p.sksClusterId,
+		Version: &p.clusterVersion,
+	}
+	for _, nodepool := range p.nodepools {
+		sksCluster.Nodepools = append(sksCluster.Nodepools, p.sksNodepool(nodepool))
+	}
+	return sksCluster, nil
+}
+
+func (p *fakeSKSProvider) GetNodepool(ctx context.Context, sksNodepoolId string) (*egoscalev2.SKSNodepool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.call("GetNodepool"); err != nil {
+		return nil, err
+	}
+
+	nodepool := p.nodepool(sksNodepoolId)
+	if nodepool == nil {
+		return nil, fmt.Errorf("nodepool '%s' does not exist in cluster '%s'", sksNodepoolId, p.sksClusterId)
+	}
+	return p.sksNodepool(nodepool), nil
+}
+
+func (p *fakeSKSProvider) ListNodepoolInstances(ctx context.Context, sksNodepool *egoscalev2.SKSNodepool) ([]*egoscalev2.Instance, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.call("ListNodepoolInstances"); err != nil {
+		return nil, err
+	}
+
+	nodepool := p.nodepool(*sksNodepool.ID)
+	if nodepool == nil {
+		return nil, fmt.Errorf("nodepool '%s' does not exist", *sksNodepool.ID)
+	}
+
+	instances := make([]*egoscalev2.Instance, 0, len(nodepool.instances))
+	for _, instance := range nodepool.instances {
+		id, state := instance.id, "starting"
+		if instance.registered {
+			state = "running"
+		}
+		instances = append(instances, &egoscalev2.Instance{ID: &id, State: &state})
+	}
+	return instances, nil
+}
+
+func (p *fakeSKSProvider) ScaleNodepool(ctx context.Context, sksNodepool *egoscalev2.SKSNodepool, size int64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.call("ScaleNodepool"); err != nil {
+		return err
+	}
+
+	nodepool := p.nodepool(*sksNodepool.ID)
+	if nodepool == nil {
+		return fmt.Errorf("nodepool '%s' does not exist", *sksNodepool.ID)
+	}
+
+	for int64(len(nodepool.instances)) < size {
+		p.addInstance(nodepool, time.Now().Add(p.creationDelay))
+	}
+	for int64(len(nodepool.instances)) > size {
+		p.removeInstance(nodepool, nodepool.instances[len(nodepool.instances)-1].id)
+	}
+	return nil
+}
+
+func (p *fakeSKSProvider) EvictNodepoolMembers(ctx context.Context, sksNodepool *egoscalev2.SKSNodepool, instanceIds []string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.call("EvictNodepoolMembers"); err != nil {
+		return err
+	}
+
+	nodepool := p.nodepool(*sksNodepool.ID)
+	if nodepool == nil {
+		return fmt.Errorf("nodepool '%s' does not exist", *sksNodepool.ID)
+	}
+
+	for _, instanceId := range instanceIds {
+		if !p.removeInstance(nodepool, instanceId) {
+			return fmt.Errorf("instance '%s' is not a member of nodepool '%s'", instanceId, nodepool.id)
+		}
+	}
+	return nil
+}
+
+func (p *fakeSKSProvider) ListClusterVersions(ctx context.Context) ([]string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.call("ListClusterVersions"); err != nil {
+		return nil, err
+	}
+
+	return append([]string(nil), p.availableVersions...), nil
+}
+
+// UpgradeCluster sets the version of the control plane, which the fake discovery client reports from then on
+func (p *fakeSKSProvider) UpgradeCluster(ctx context.Context, version string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.call("UpgradeCluster"); err != nil {
+		return err
+	}
+
+	p.clusterVersion = version
+	p.clientset.Discovery().(*fakediscovery.FakeDiscovery).FakedServerVersion = &k8sversion.Info{GitVersion: "v" + version}
+	return nil
+}
+
+// call records a method call, registers instances which finished starting and returns an injected error
+func (p *fakeSKSProvider) call(method string) error {
+	p.calls = append(p.calls, method)
+	p.registerRunningInstances()
+
+	if errs := p.errors[method]; len(errs) > 0 {
+		p.errors[method] = errs[1:]
+		return errs[0]
+	}
+	return nil
+}
+
+func (p *fakeSKSProvider) nodepool(id string) *fakeNodepool {
+	for _, nodepool := range p.nodepools {
+		if nodepool.id == id {
+			return nodepool
+		}
+	}
+	return nil
+}
+
+func (p *fakeSKSProvider) sksNodepool(nodepool *fakeNodepool) *egoscalev2.SKSNodepool {
+	id, name, version := nodepool.id, nodepool.name, nodepool.version
+	instancePoolId := "instance-pool-" + nodepool.id
+	size := int64(len(nodepool.instances))
+
+	state := "running"
+	for _, instance := range nodepool.instances {
+		if !instance.registered {
+			state = "scaling"
+		}
+	}
+
+	return &egoscalev2.SKSNodepool{
+		ID:             &id,
+		Name:           &name,
+		Version:        &version,
+		InstancePoolID: &instancePoolId,
+		Size:           &size,
+		State:          &state,
+	}
+}
+
+func (p *fakeSKSProvider) addInstance(nodepool *fakeNodepool, runningAt time.Time) {
+	p.instanceCount += 1
+	nodepool.instances = append(nodepool.instances, &fakeInstance{
+		id:        fmt.Sprintf("00000000-0000-0000-0000-%012d", p.instanceCount),
+		nodeName:  fmt.Sprintf("pool-%s-%d", nodepool.name, p.instanceCount),
+		version:   nodepool.version,
+		runningAt: runningAt,
+	})
+}
+
+func (p *fakeSKSProvider) removeInstance(nodepool *fakeNodepool, instanceId string) bool {
+	for i, instance := range nodepool.instances {
+		if instance.id == instanceId {
+			nodepool.instances = append(nodepool.instances[:i], nodepool.instances[i+1:]...)
+			if instance.registered {
+				_ = p.clientset.CoreV1().Nodes().Delete(context.Background(), instance.nodeName, metav1.DeleteOptions{})
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// registerRunningInstances registers a ready node for every instance which finished starting
+func (p *fakeSKSProvider) registerRunningInstances() {
+	for _, nodepool := range p.nodepools {
+		for _, instance := range nodepool.instances {
+			if instance.registered || time.Now().Before(instance.runningAt) {
+				continue
+			}
+
+			_, _ = p.clientset.CoreV1().Nodes().Create(context.Background(), &corev1.Node{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:              instance.nodeName,
+					Labels:            map[string]string{nodeLabelNodepoolId: nodepool.id},
+					CreationTimestamp: metav1.Now(),
+				},
+				Status: corev1.NodeStatus{
+					Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: corev1.ConditionTrue}},
+					NodeInfo: corev1.NodeSystemInfo{
+						SystemUUID:     instance.id,
+						KubeletVersion: instance.version,
+					},
+				},
+			}, metav1.CreateOptions{})
+			instance.registered = true
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/version"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Formats of the report of a run
+const (
+	reportFormatJSON     string = "json"
+	reportFormatMarkdown string = "markdown"
+	reportFormatJUnit    string = "junit"
+)
+
+// Decisions of the report, by the status of the node in the result
+var reportDecisions = map[string]string{
+	nodeStatusReplaced:    "replaced",
+	nodeStatusSkipped:     "skipped-jobs",
+	nodeStatusFailed:      "failed",
+	nodeStatusInterrupted: "interrupted",
+	nodeStatusUpToDate:    "up-to-date",
+	nodeStatusNotSelected: "skipped",
+}
+
+// runReport is the machine-readable summary of a run
+type runReport struct {
+	RunId         string       `json:"runId"`
+	ClusterId     string       `json:"clusterId"`
+	TargetVersion string       `json:"targetVersion"`
+	StartedAt     time.Time    `json:"startedAt"`
+	FinishedAt    time.Time    `json:"finishedAt"`
+	Result        string       `json:"result"`
+	Error         string       `json:"error,omitempty"`
+	Nodes         []nodeReport `json:"nodes"`
+}
+
+type nodeReport struct {
+	Node                 string        `json:"node"`
+	NodepoolId           string        `json:"nodepoolId"`
+	Nodepool             string        `json:"nodepool"`
+	Decision             string        `json:"decision"`
+	Reason               string        `json:"reason,omitempty"`
+	OldVersion           string        `json:"oldVersion"`
+	NewVersion           string        `json:"newVersion,omitempty"`
+	Phases               []phaseReport `json:"phases"`
+	RestartedDeployments []string      `json:"restartedDeployments"`
+	Undone               []string      `json:"undone,omitempty"`
+	Error                string        `json:"error,omitempty"`
+}
+
+type phaseReport struct {
+	Phase      string    `json:"phase"`
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+}
+
+// Get the format of the report, the configured one or the one matching the extension of the path
+func reportFormat(opts cycleOptions) string {
+	if opts.reportFormat != "" {
+		return opts.reportFormat
+	}
+	switch strings.ToLower(filepath.Ext(opts.report)) {
+	case ".md", ".markdown":
+		return reportFormatMarkdown
+	case ".xml":
+		return reportFormatJUnit
+	default:
+		return reportFormatJSON
+	}
+}
+
+// writeReport writes the report of a finished run to the configured path. The error is the one the run returned.
+func writeReport(ctx context.Context, clientset kubernetes.Interface, opts cycleOptions, result *cycleResult, err error) error {
+	report := buildReport(ctx, clientset, result, err)
+
+	var buf bytes.Buffer
+	if err := printReport(&buf, report, reportFormat(opts)); err != nil {
+		return err
+	}
+	if err := os.WriteFile(opts.report, buf.Bytes(), 0o644); err != nil {
+		return fmt.Errorf("error writing report: %w", err)
+	}
+	loggerFrom(ctx).Info("Report has been written", "path", opts.report)
+	return nil
+}
+
+// buildReport collects the nodes of the result into a report. The new version of a replaced node is the highest
+// kubelet version of the nodes which joined its nodepool during the run.
+func buildReport(ctx context.Context, clientset kubernetes.Interface, result *cycleResult, err error) *runReport {
+	if err == nil {
+		err = result.err()
+	}
+	report := &runReport{
+		RunId:         result.RunId,
+		ClusterId:     result.ClusterId,
+		TargetVersion: result.TargetVersion,
+		StartedAt:     result.Start,
+		FinishedAt:    result.End,
+		Result:        "success",
+		Nodes:         []nodeReport{},
+	}
+	if err != nil {
+		report.Result = errorClassOf(err).String()
+		if !errors.Is(err, errNothingToDo) {
+			report.Error = err.Error()
+		}
+	}
+
+	newVersions := make(map[string]*version.Version)
+	if len(result.Nodes) > 0 {
+		// The run may have been stopped, the nodes are still listed for its report
+		listCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+		defer cancel()
+		nodes, listErr := clientset.CoreV1().Nodes().List(listCtx, metav1.ListOptions{})
+		if listErr != nil {
+			loggerFrom(ctx).Warn("Error while listing the new nodes for the report", logKeyError, listErr)
+		} else {
+			for _, node := range nodes.Items {
+				sksNodepoolId, err := getNodepoolId(node)
+				if err != nil || node.CreationTimestamp.Time.Before(result.Start) {
+					continue
+				}
+				kubeletVersion, err := version.ParseGeneric(node.Status.NodeInfo.KubeletVersion)
+				if err != nil {
+					continue
+				}
+				if newest := newVersions[sksNodepoolId]; newest == nil || newest.LessThan(kubeletVersion) {
+					newVersions[sksNodepoolId] = kubeletVersion
+				}
+			}
+		}
+	}
+
+	for _, nodes := range [][]nodeResult{result.Nodes, result.Kept} {
+		for _, node := range nodes {
+			entry := nodeReport{
+				Node:                 node.Node,
+				NodepoolId:           node.NodepoolId,
+				Nodepool:             result.nodepoolNames[node.NodepoolId],
+				Decision:             reportDecisions[node.Status],
+				Reason:               node.Reason,
+				OldVersion:           node.KubeletVersion,
+				Phases:               []phaseReport{},
+				RestartedDeployments: []string{},
+				Undone:               node.Undone,
+			}
+			for _, phase := range node.Phases {
+				entry.Phases = append(entry.Phases, phaseReport{Phase: phase.Phase, StartedAt: phase.Start, FinishedAt: phase.End})
+			}
+			entry.RestartedDeployments = append(entry.RestartedDeployments, node.RestartedDeployments...)
+			if node.Err != nil {
+				entry.Error = node.Err.Error()
+			}
+			switch node.Status {
+			case nodeStatusReplaced:
+				if newest := newVersions[node.NodepoolId]; newest != nil {
+					entry.NewVersion = kubeletVersionString(newest)
+				}
+			case nodeStatusUpToDate:
+				entry.NewVersion = node.KubeletVersion
+			}
+			report.Nodes = append(report.Nodes, entry)
+		}
+	}
+
+	return report
+}
+
+// printReport prints the report as JSON, as a Markdown document or as JUnit XML with one test case per node
+func printReport(out io.Writer, report *runReport, format string) error {
+	switch format {
+	case reportFormatJSON:
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	case reportFormatMarkdown:
+		return printMarkdownReport(out, report)
+	case reportFormatJUnit:
+		return printJUnitReport(out, report)
+	default:
+		return configError("unknown report format '%s', expected '%s', '%s' or '%s'", format, reportFormatJSON, reportFormatMarkdown, reportFormatJUnit)
+	}
+}
+
+func printMarkdownReport(out io.Writer, report *runReport) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Node cycle %s\n\n", report.RunId)
+	fmt.Fprintf(&b, "- Cluster: %s\n", report.ClusterId)
+	fmt.Fprintf(&b, "- Target version: %s\n", orNone(report.TargetVersion))
+	fmt.Fprintf(&b, "- Started: %s\n", report.StartedAt.Format(time.RFC3339))
+	fmt.Fprintf(&b, "- Finished: %s\n", report.FinishedAt.Format(time.RFC3339))
+	fmt.Fprintf(&b, "- Result: %s\n", report.Result)
+	if report.Error != "" {
+		fmt.Fprintf(&b, "- Error: %s\n", markdownCell(report.Error))
+	}
+
+	b.WriteString("\n## Nodes\n\n")
+	b.WriteString("| Node | Nodepool | Decision | Old version | New version | Restarted deployments | Error |\n")
+	b.WriteString("| --- | --- | --- | --- | --- | --- | --- |\n")
+	for _, node := range report.Nodes {
+		nodepool := node.Nodepool
+		if nodepool == "" {
+			nodepool = node.NodepoolId
+		}
+		decision := node.Decision
+		if node.Reason != "" {
+			decision += " (" + node.Reason + ")"
+		}
+		fmt.Fprintf(&b, "| %s | %s | %s | %s | %s | %s | %s |\n", node.Node, orNone(nodepool), markdownCell(decision), orNone(node.OldVersion),
+			orNone(node.NewVersion), orNone(strings.Join(node.RestartedDeployments, ", ")), orNone(markdownCell(node.Error)))
+	}
+
+	b.WriteString("\n## Phases\n\n")
+	b.WriteString("| Node | Phase | Started | Finished | Duration |\n")
+	b.WriteString("| --- | --- | --- | --- | --- |\n")
+	for _, node := range report.Nodes {
+		for _, phase := range node.Phases {
+			fmt.Fprintf(&b, "| %s | %s | %s | %s | %s |\n", node.Node, phase.Phase, phase.StartedAt.Format(time.RFC3339), phase.FinishedAt.Format(time.RFC3339),
+				phase.FinishedAt.Sub(phase.StartedAt).Round(time.Second))
+		}
+	}
+
+	_, err := io.WriteString(out, b.String())
+	return err
+}
+
+// Escape a value for a cell of a Markdown table
+func markdownCell(value string) string {
+	value = strings.ReplaceAll(value, "|", "\\|")
+	return strings.ReplaceAll(value, "\n", "<br>")
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	Cases     []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+func printJUnitReport(out io.Writer, report *runReport) error {
+	suite := junitTestSuite{
+		Name:      fmt.Sprintf("%s %s", eventComponent, report.RunId),
+		Time:      junitSeconds(report.FinishedAt.Sub(report.StartedAt)),
+		Timestamp: report.StartedAt.Format(time.RFC3339),
+	}
+	for _, node := range report.Nodes {
+		testCase := junitTestCase{Name: node.Node, ClassName: node.Nodepool}
+		if testCase.ClassName == "" {
+			testCase.ClassName = node.NodepoolId
+		}
+
+		var duration time.Duration
+		var systemOut strings.Builder
+		for _, phase := range node.Phases {
+			duration += phase.FinishedAt.Sub(phase.StartedAt)
+			fmt.Fprintf(&systemOut, "%s: %s - %s\n", phase.Phase, phase.StartedAt.Format(time.RFC3339), phase.FinishedAt.Format(time.RFC3339))
+		}
+		if len(node.RestartedDeployments) > 0 {
+			fmt.Fprintf(&systemOut, "restarted deployments: %s\n", strings.Join(node.RestartedDeployments, ", "))
+		}
+		fmt.Fprintf(&systemOut, "version: %s -> %s\n", orNone(node.OldVersion), orNone(node.NewVersion))
+		testCase.Time = junitSeconds(duration)
+		testCase.SystemOut = systemOut.String()
+
+		switch node.Decision {
+		case reportDecisions[nodeStatusFailed], reportDecisions[nodeStatusInterrupted]:
+			testCase.Failure = &junitMessage{Message: node.Decision, Text: node.Error}
+			suite.Failures += 1
+		case reportDecisions[nodeStatusReplaced]:
+		default:
+			message := node.Decision
+			if node.Reason != "" {
+				message += ": " + node.Reason
+			}
+			testCase.Skipped = &junitMessage{Message: message}
+			suite.Skipped += 1
+		}
+		suite.Cases = append(suite.Cases, testCase)
+	}
+	suite.Tests = len(suite.Cases)
+
+	if _, err := io.WriteString(out, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(out)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(junitTestSuites{Suites: []junitTestSuite{suite}}); err != nil {
+		return err
+	}
+	_, err := io.WriteString(out, "\n")
+	return err
+}
+
+func junitSeconds(duration time.Duration) string {
+	return fmt.Sprintf("%.3f", duration.Seconds())
+}
@@ -0,0 +1,131 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestRunCycleWritesReport(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	provider := newFakeSKSProvider(clientset, "1.29.3")
+	provider.addNodepool("np-1", "workers", "v1.28.7", 1)
+	provider.setNodepoolVersion("np-1", "v1.29.3")
+	provider.addNodepool("np-2", "current", "v1.29.3", 1)
+
+	path := filepath.Join(t.TempDir(), "report.json")
+	opts := testCycleOptions()
+	opts.surgeCount = 1
+	opts.report = path
+	if _, err := runCycle(context.Background(), clientset, provider, opts); err != nil {
+		t.Fatalf("runCycle() error = %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("report has not been written: %v", err)
+	}
+	var report runReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatalf("report is not valid JSON: %v", err)
+	}
+
+	if report.Result != "success" || report.RunId == "" || report.TargetVersion != "v1.29.3" {
+		t.Errorf("report = %+v, want a successful run to v1.29.3 with a run ID", report)
+	}
+	decisions := make(map[string]nodeReport)
+	for _, node := range report.Nodes {
+		decisions[node.Nodepool] = node
+	}
+	replaced := decisions["workers"]
+	if replaced.Decision != "replaced" || replaced.OldVersion != "v1.28.7" || replaced.NewVersion != "v1.29.3" {
+		t.Errorf("replaced node = %+v, want it replaced from v1.28.7 to v1.29.3", replaced)
+	}
+	var phases []string
+	for _, phase := range replaced.Phases {
+		phases = append(phases, phase.Phase)
+		if phase.FinishedAt.Before(phase.StartedAt) {
+			t.Errorf("phase %s finished before it started", phase.Phase)
+		}
+	}
+	if want := []string{phaseSurge, phaseCordon, phaseDrain, phaseSksEvict}; strings.Join(phases, ",") != strings.Join(want, ",") {
+		t.Errorf("phases = %v, want %v", phases, want)
+	}
+	if current := decisions["current"]; current.Decision != "up-to-date" || current.NewVersion != "v1.29.3" {
+		t.Errorf("current node = %+v, want it up to date", current)
+	}
+}
+
+func TestPrintReport(t *testing.T) {
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	report := &runReport{
+		RunId:         "run-1",
+		ClusterId:     "cluster-1",
+		TargetVersion: "v1.29.3",
+		StartedAt:     start,
+		FinishedAt:    start.Add(10 * time.Minute),
+		Result:        errorClassPartialFailure.String(),
+		Nodes: []nodeReport{
+			{Node: "node-1", Nodepool: "workers", Decision: "replaced", OldVersion: "v1.28.7", NewVersion: "v1.29.3",
+				Phases:               []phaseReport{{Phase: phaseDrain, StartedAt: start, FinishedAt: start.Add(time.Minute)}},
+				RestartedDeployments: []string{"default/web"}},
+			{Node: "node-2", Nodepool: "workers", Decision: "failed", OldVersion: "v1.28.7", Error: "drain | timed out"},
+			{Node: "node-3", Nodepool: "workers", Decision: "skipped-jobs", OldVersion: "v1.28.7"},
+		},
+	}
+
+	var markdown bytes.Buffer
+	if err := printReport(&markdown, report, reportFormatMarkdown); err != nil {
+		t.Fatalf("printReport(markdown) error = %v", err)
+	}
+	for _, want := range []string{"| node-1 | workers | replaced | v1.28.7 | v1.29.3 | default/web | - |", "drain \\| timed out", "| node-1 | drain |"} {
+		if !strings.Contains(markdown.String(), want) {
+			t.Errorf("markdown report does not contain %q:\n%s", want, markdown.String())
+		}
+	}
+
+	var junit bytes.Buffer
+	if err := printReport(&junit, report, reportFormatJUnit); err != nil {
+		t.Fatalf("printReport(junit) error = %v", err)
+	}
+	var suites junitTestSuites
+	if err := xml.Unmarshal(junit.Bytes(), &suites); err != nil {
+		t.Fatalf("junit report is not valid XML: %v", err)
+	}
+	suite := suites.Suites[0]
+	if suite.Tests != 3 || suite.Failures != 1 || suite.Skipped != 1 {
+		t.Errorf("test suite has %d tests, %d failures and %d skipped, want 3, 1 and 1", suite.Tests, suite.Failures, suite.Skipped)
+	}
+	if failure := suite.Cases[1].Failure; failure == nil || failure.Text != "drain | timed out" {
+		t.Errorf("failure of node-2 = %+v, want its error", failure)
+	}
+
+	if err := printReport(&bytes.Buffer{}, report, "yaml"); exitCode(err) != exitCodeConfig {
+		t.Errorf("printReport(yaml) error = %v, want a config error", err)
+	}
+}
+
+func TestReportFormat(t *testing.T) {
+	tests := map[string]string{
+		"report.json": reportFormatJSON,
+		"report.md":   reportFormatMarkdown,
+		"junit.xml":   reportFormatJUnit,
+		"report":      reportFormatJSON,
+	}
+	for path, want := range tests {
+		if got := reportFormat(cycleOptions{report: path}); got != want {
+			t.Errorf("reportFormat(%s) = %s, want %s", path, got, want)
+		}
+	}
+	if got := reportFormat(cycleOptions{report: "report.txt", reportFormat: reportFormatMarkdown}); got != reportFormatMarkdown {
+		t.Errorf("reportFormat() = %s, want the configured format", got)
+	}
+}
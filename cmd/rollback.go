@@ -0,0 +1,154 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// Undo what has been done to a node whose replacement failed and continue with the next node
+	failurePolicyRollback string = "rollback"
+	// Leave a node whose replacement failed as it is (possibly cordoned) and continue with the next node
+	failurePolicyLeave string = "leave"
+	// Undo what has been done to a node whose replacement failed and stop the cycle
+	failurePolicyAbortAll string = "abort-all"
+)
+
+// Record the failed replacement of a node and recover from it according to the failure policy. With abort-all,
+// the returned error stops the cycle.
+func failNode(ctx context.Context, clientset kubernetes.Interface, provider SKSProvider, opts cycleOptions, result *cycleResult, node corev1.Node, sksNodepoolId string, cordoned bool, surgeCredit *surgeCredit, err error) error {
+	result.record(node, sksNodepoolId, nodeStatusFailed, err)
+	eventsFrom(ctx).node(ctx, node, nodeStatusFailed, corev1.EventTypeWarning, eventReasonFailed, "Replacement of the node failed: %v", err)
+	if opts.failurePolicy == failurePolicyLeave {
+		return nil
+	}
+
+	result.undo(node.Name, rollbackNode(ctx, clientset, provider, opts, node, sksNodepoolId, cordoned, surgeCredit))
+	if opts.failurePolicy == failurePolicyAbortAll {
+		return safetyAbortError(fmt.Errorf("cycle aborted, because the replacement of node %s failed: %w", node.Name, err))
+	}
+	return nil
+}
+
+// Uncordon the node and, if configured, remove surge instances which the run has created from its nodepool again, as
+// many as have not been compensated yet and are not held by other nodes in progress. Only surge instances whose nodes
+// are empty are removed, the nodepool is never scaled down, which would let Exoscale pick the instances. Steps which
+// fail are logged and skipped. It returns a description of every step which was undone.
+func rollbackNode(ctx context.Context, clientset kubernetes.Interface, provider SKSProvider, opts cycleOptions, node corev1.Node, sksNodepoolId string, cordoned bool, surgeCredit *surgeCredit) []string {
+	var undone []string
+
+	if cordoned {
+		if err := cordonNode(ctx, clientset, node.Name, false); err != nil {
+			loggerFrom(ctx).Error("Error while uncordoning node during rollback", logKeyError, err)
+		} else {
+			undone = append(undone, "uncordoned node")
+		}
+	}
+
+	if !opts.restoreNodepoolSize || sksNodepoolId == "" {
+		return logRollback(ctx, undone)
+	}
+	unlock := surgeCredit.lockNodepool(sksNodepoolId)
+	defer unlock()
+	if credit := surgeCredit.unclaimed(sksNodepoolId); credit > 0 {
+		sksNodepool, err := provider.GetNodepool(ctx, sksNodepoolId)
+		if err != nil {
+			loggerFrom(ctx).Error("Error while getting nodepool during rollback", logKeyError, err)
+			return logRollback(ctx, undone)
+		}
+		instanceIds, err := emptySurgeInstances(ctx, clientset, sksNodepoolId, surgeCredit.surgeInstances(sksNodepoolId), credit)
+		if err != nil {
+			loggerFrom(ctx).Error("Error while checking surge nodes during rollback", logKeyError, err)
+		}
+		if len(instanceIds) == 0 {
+			loggerFrom(ctx).Warn("No surge node of the nodepool is empty, it keeps its size", "surge", credit)
+			return logRollback(ctx, undone)
+		}
+		if err := provider.EvictNodepoolMembers(ctx, sksNodepool, instanceIds); err != nil {
+			loggerFrom(ctx).Error("Error while removing surge nodes from nodepool during rollback", logKeyError, err)
+			return logRollback(ctx, undone)
+		}
+		undone = append(undone, fmt.Sprintf("removed %d surge nodes from nodepool", len(instanceIds)))
+		surgeCredit.drop(sksNodepoolId, instanceIds)
+	}
+
+	return logRollback(ctx, undone)
+}
+
+// Pick up to n of the surge instances of the nodepool whose nodes run no pods besides DaemonSet and static pods. The
+// nodes are cordoned and checked once more, so no pod is scheduled on them before they are removed.
+func emptySurgeInstances(ctx context.Context, clientset kubernetes.Interface, sksNodepoolId string, instanceIds []string, n int) ([]string, error) {
+	nodes, err := clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{LabelSelector: nodeLabelNodepoolId + "=" + sksNodepoolId})
+	if err != nil {
+		return nil, err
+	}
+	instanceNodes := make(map[string]string)
+	for _, node := range nodes.Items {
+		instanceNodes[node.Status.NodeInfo.SystemUUID] = node.Name
+	}
+
+	var empty []string
+	for _, instanceId := range instanceIds {
+		if len(empty) == n {
+			break
+		}
+		// Instances which have no node yet cannot be confirmed to be empty
+		nodeName, exists := instanceNodes[instanceId]
+		if !exists {
+			continue
+		}
+		if hasPods, err := nodeHasWorkloadPods(ctx, clientset, nodeName); err != nil || hasPods {
+			if err != nil {
+				return empty, err
+			}
+			continue
+		}
+		if err := cordonNode(ctx, clientset, nodeName, true); err != nil {
+			return empty, err
+		}
+		hasPods, err := nodeHasWorkloadPods(ctx, clientset, nodeName)
+		if err != nil || hasPods {
+			if uncordonErr := cordonNode(ctx, clientset, nodeName, false); uncordonErr != nil {
+				loggerFrom(ctx).Error("Error while uncordoning surge node", logKeyNode, nodeName, logKeyError, uncordonErr)
+			}
+			if err != nil {
+				return empty, err
+			}
+			continue
+		}
+		empty = append(empty, instanceId)
+	}
+	return empty, nil
+}
+
+// Check whether pods which are not managed by a DaemonSet and are not static pods are active on the node
+func nodeHasWorkloadPods(ctx context.Context, clientset kubernetes.Interface, nodeName string) (bool, error) {
+	pods, err := listNodePods(ctx, clientset, nodeName)
+	if err != nil {
+		return false, err
+	}
+	for _, pod := range pods {
+		if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		if _, mirror := pod.Annotations[corev1.MirrorPodAnnotationKey]; mirror {
+			continue
+		}
+		if ownerRef := metav1.GetControllerOf(&pod); ownerRef != nil && ownerRef.Kind == "DaemonSet" {
+			continue
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+func logRollback(ctx context.Context, undone []string) []string {
+	if len(undone) > 0 {
+		loggerFrom(ctx).Info("Rolled back replacement of node", "undone", undone)
+	}
+	return undone
+}
@@ -16,8 +16,10 @@ limitations under the License.
 package cmd
 
 import (
-	"fmt"
+	"context"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -38,25 +40,77 @@ to quickly create a Cobra application.`,
 	// Uncomment the following line if your bare application
 	// has an action associated with it:
 	// Run: func(cmd *cobra.Command, args []string) { },
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		// Metrics are served for as long as the command runs, until Execute returns
+		return serveMetrics(viper.GetString("metrics_addr"))
+	},
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
+// The exit code tells the outcome apart, see exitCode.
 func Execute() {
-	err := rootCmd.Execute()
-	if err != nil {
-		os.Exit(1)
+	// The root context of every command is cancelled on SIGINT and SIGTERM, so a run can stop cleanly
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err := rootCmd.ExecuteContext(ctx)
+	stop()
+
+	stopMetrics()
+	if url := viper.GetString("pushgateway_url"); url != "" {
+		if pushErr := pushMetrics(url, viper.GetString("sks_cluster_id")); pushErr != nil {
+			logger.Error("Error pushing metrics to Pushgateway", logKeyError, pushErr)
+		}
 	}
+
+	switch errorClassOf(err) {
+	case errorClassNothingToDo:
+		logger.Info(err.Error())
+	case errorClassInterrupted:
+		logger.Warn("Run was stopped", logKeyError, err)
+	case errorClassLocked:
+		logger.Warn("Refusing to run", logKeyError, err)
+	default:
+		if err != nil {
+			logger.Error("Command failed", logKeyError, err)
+		}
+	}
+	os.Exit(exitCode(err))
+}
+
+// Get the context of a run of the command, which ends on SIGINT, SIGTERM or once the run timeout is reached
+func commandContext(cmd *cobra.Command) (context.Context, context.CancelFunc) {
+	ctx := cmd.Context()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return withTimeout(ctx, viper.GetDuration("timeout"))
 }
 
 func init() {
 	cobra.OnInitialize(initConfig)
 
+	// Errors are logged by Execute
+	rootCmd.SilenceErrors = true
+
 	// Here you will define your flags and configuration settings.
 	// Cobra supports persistent flags, which, if defined here,
 	// will be global for your application.
 
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.exoscale-sks-lifecycler.yaml)")
+	rootCmd.PersistentFlags().String("log-format", "text", "log format: text or json")
+	viper.BindPFlag("log_format", rootCmd.PersistentFlags().Lookup("log-format"))
+	rootCmd.PersistentFlags().String("log-level", "info", "log level: debug, info, warn or error")
+	viper.BindPFlag("log_level", rootCmd.PersistentFlags().Lookup("log-level"))
+	rootCmd.PersistentFlags().Duration("timeout", 0, "Deadline of the whole run, after which it is stopped like on SIGTERM (0 disables the deadline)")
+	viper.BindPFlag("timeout", rootCmd.PersistentFlags().Lookup("timeout"))
+	rootCmd.PersistentFlags().String("lock", "kube-system/exoscale-sks-lifecycler", "Lease which keeps instances from changing nodes at the same time, as <namespace>/<name> (empty disables the lock)")
+	viper.BindPFlag("lock", rootCmd.PersistentFlags().Lookup("lock"))
+	rootCmd.PersistentFlags().Bool("force-lock", false, "Take the lock over from another instance which holds it, instead of refusing to run")
+	viper.BindPFlag("force_lock", rootCmd.PersistentFlags().Lookup("force-lock"))
+	rootCmd.PersistentFlags().String("metrics-addr", "", "Address /metrics is served on while the command runs, e.g. :9090 (empty disables it)")
+	viper.BindPFlag("metrics_addr", rootCmd.PersistentFlags().Lookup("metrics-addr"))
+	rootCmd.PersistentFlags().String("pushgateway-url", "", "URL of a Prometheus Pushgateway the metrics are pushed to once the command has finished (empty disables pushing)")
+	viper.BindPFlag("pushgateway_url", rootCmd.PersistentFlags().Lookup("pushgateway-url"))
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
@@ -90,7 +144,15 @@ func initConfig() {
 	viper.BindEnv("kubeconfig", "KUBECONFIG")
 
 	// If a config file is found, read it in.
-	if err := viper.ReadInConfig(); err == nil {
-		fmt.Fprintln(os.Stderr, "Using config file:", viper.ConfigFileUsed())
+	configErr := viper.ReadInConfig()
+
+	// Logs are written to stderr, so output like the plan stays parseable on stdout
+	if err := initLogger(os.Stderr, viper.GetString("log_format"), viper.GetString("log_level")); err != nil {
+		logger.Error("Invalid logging configuration", logKeyError, err)
+		os.Exit(exitCodeConfig)
+	}
+
+	if configErr == nil {
+		logger.Info("Using config file", "path", viper.ConfigFileUsed())
 	}
 }
@@ -0,0 +1,818 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// scenario declares the state of a cluster before a cycle and the actions the cycle is expected to take
+type scenario struct {
+	name string
+
+	// Configuration of the cycle
+	desiredVersion string
+	// Version of the SKS control plane, defaults to desiredVersion
+	clusterVersion string
+	// Versions available for SKS clusters, defaults to the control plane version
+	availableVersions []string
+	labelSelector     string
+	surge             int
+	// Defaults to 1s and abort
+	evictionTimeout       time.Duration
+	evictionTimeoutAction string
+	// Defaults to 1s
+	workloadTimeout time.Duration
+	// Defaults to no timeout
+	drainTimeout time.Duration
+	// Defaults to rollback
+	failurePolicy       string
+	restoreNodepoolSize bool
+
+	nodepools []nodepoolFixture
+	pods      []podFixture
+	// Number of times the eviction of a pod ("namespace/name") is refused because of a PodDisruptionBudget, -1 for always
+	blockedEvictions map[string]int
+	// Number of times the eviction of a pod ("namespace/name") is throttled by the API server
+	throttledEvictions map[string]int
+	// Workloads ("namespace/name") which never have all replicas available again
+	unavailableWorkloads []string
+	// Deployments ("namespace/name") whose controller never observes that they have been restarted
+	stalledRollouts []string
+
+	// Expected actions in order, e.g. "cordon node-a", "restart default/web", "evict default/bare",
+	// "delete default/bare", "sks-scale np-1 3" and "sks-evict node-a"
+	wantActions []string
+	// Expected nodepool sizes after the cycle
+	wantSizes map[string]int
+	// Expected exit code of the cycle
+	wantExitCode int
+}
+
+type nodepoolFixture struct {
+	id   string
+	name string
+	// Kubelet version of nodes which are added to the nodepool
+	version string
+	nodes   []nodeFixture
+}
+
+type nodeFixture struct {
+	name    string
+	version string
+	labels  map[string]string
+}
+
+type podFixture struct {
+	namespace string
+	name      string
+	node      string
+	// Kind of the workload owning the pod: Deployment, DaemonSet, StatefulSet, Job or empty for bare pods
+	ownerKind string
+	ownerName string
+	// Annotations of the workload owning the pod
+	ownerAnnotations map[string]string
+}
+
+var scenarios = []scenario{
+	{
+		name:           "replaces outdated node and reschedules its pods",
+		desiredVersion: "v1.29.3",
+		surge:          1,
+		nodepools: []nodepoolFixture{{
+			id: "np-1", name: "workers", version: "v1.29.3",
+			nodes: []nodeFixture{{name: "node-a", version: "v1.28.7"}, {name: "node-b", version: "v1.29.3"}},
+		}},
+		pods: []podFixture{
+			{namespace: "default", name: "bare", node: "node-a"},
+			{namespace: "default", name: "web-1", node: "node-a", ownerKind: "Deployment", ownerName: "web"},
+			{namespace: "kube-system", name: "cilium-1", node: "node-a", ownerKind: "DaemonSet", ownerName: "cilium"},
+			{namespace: "default", name: "web-2", node: "node-b", ownerKind: "Deployment", ownerName: "web"},
+		},
+		wantActions: []string{
+			"sks-scale np-1 3",
+			"cordon node-a",
+			"evict default/bare",
+			"restart default/web",
+			"sks-evict node-a",
+		},
+		wantSizes: map[string]int{"np-1": 2},
+	},
+	{
+		name:           "cordons but keeps node with running jobs",
+		desiredVersion: "v1.29.3",
+		surge:          1,
+		nodepools: []nodepoolFixture{{
+			id: "np-1", name: "workers", version: "v1.29.3",
+			nodes: []nodeFixture{{name: "node-a", version: "v1.28.7"}},
+		}},
+		pods: []podFixture{
+			{namespace: "default", name: "backup-1", node: "node-a", ownerKind: "Job", ownerName: "backup"},
+		},
+		wantActions: []string{
+			"cordon node-a",
+		},
+		wantSizes: map[string]int{"np-1": 1},
+	},
+	{
+		name:           "surges once for several nodes of a nodepool",
+		desiredVersion: "v1.29.3",
+		surge:          2,
+		nodepools: []nodepoolFixture{{
+			id: "np-1", name: "workers", version: "v1.29.3",
+			nodes: []nodeFixture{{name: "node-a", version: "v1.28.7"}, {name: "node-b", version: "v1.28.7"}},
+		}},
+		wantActions: []string{
+			"sks-scale np-1 4",
+			"cordon node-a",
+			"sks-evict node-a",
+			"cordon node-b",
+			"sks-evict node-b",
+		},
+		wantSizes: map[string]int{"np-1": 2},
+	},
+	{
+		name:           "replaces up-to-date node selected by labels without surging",
+		desiredVersion: "v1.29.3",
+		labelSelector:  "node.kubernetes.io/instance-type=cpu.extra-large",
+		surge:          0,
+		nodepools: []nodepoolFixture{{
+			id: "np-1", name: "workers", version: "v1.29.3",
+			nodes: []nodeFixture{
+				{name: "node-a", version: "v1.29.3", labels: map[string]string{"node.kubernetes.io/instance-type": "cpu.extra-large"}},
+				{name: "node-b", version: "v1.29.3", labels: map[string]string{"node.kubernetes.io/instance-type": "cpu.large"}},
+			},
+		}},
+		pods: []podFixture{
+			{namespace: "db", name: "postgres-0", node: "node-a", ownerKind: "StatefulSet", ownerName: "postgres"},
+		},
+		wantActions: []string{
+			"cordon node-a",
+			"evict db/postgres-0",
+			"sks-evict node-a",
+		},
+		wantSizes: map[string]int{"np-1": 1},
+	}, {
+		name:             "retries eviction blocked by a PodDisruptionBudget",
+		desiredVersion:   "v1.29.3",
+		nodepools:        []nodepoolFixture{{id: "np-1", name: "workers", version: "v1.29.3", nodes: []nodeFixture{{name: "node-a", version: "v1.28.7"}}}},
+		pods:             []podFixture{{namespace: "default", name: "bare", node: "node-a"}},
+		blockedEvictions: map[string]int{"default/bare": 2},
+		wantActions: []string{
+			"cordon node-a",
+			"evict default/bare",
+			"sks-evict node-a",
+		},
+		wantSizes: map[string]int{"np-1": 0},
+	},
+	{
+		name:               "retries eviction throttled by the API server beyond the eviction timeout",
+		desiredVersion:     "v1.29.3",
+		evictionTimeout:    time.Nanosecond,
+		nodepools:          []nodepoolFixture{{id: "np-1", name: "workers", version: "v1.29.3", nodes: []nodeFixture{{name: "node-a", version: "v1.28.7"}}}},
+		pods:               []podFixture{{namespace: "default", name: "bare", node: "node-a"}},
+		throttledEvictions: map[string]int{"default/bare": 2},
+		wantActions: []string{
+			"cordon node-a",
+			"evict default/bare",
+			"sks-evict node-a",
+		},
+		wantSizes: map[string]int{"np-1": 0},
+	},
+	{
+		name:                  "deletes pod which could not be evicted in time",
+		desiredVersion:        "v1.29.3",
+		evictionTimeout:       20 * time.Millisecond,
+		evictionTimeoutAction: evictionTimeoutActionDelete,
+		nodepools:             []nodepoolFixture{{id: "np-1", name: "workers", version: "v1.29.3", nodes: []nodeFixture{{name: "node-a", version: "v1.28.7"}}}},
+		pods:                  []podFixture{{namespace: "default", name: "bare", node: "node-a"}},
+		blockedEvictions:      map[string]int{"default/bare": -1},
+		wantActions: []string{
+			"cordon node-a",
+			"delete default/bare",
+			"sks-evict node-a",
+		},
+		wantSizes: map[string]int{"np-1": 0},
+	},
+	{
+		name:                  "aborts node whose pod could not be evicted in time",
+		desiredVersion:        "v1.29.3",
+		evictionTimeout:       20 * time.Millisecond,
+		evictionTimeoutAction: evictionTimeoutActionAbort,
+		nodepools:             []nodepoolFixture{{id: "np-1", name: "workers", version: "v1.29.3", nodes: []nodeFixture{{name: "node-a", version: "v1.28.7"}}}},
+		pods:                  []podFixture{{namespace: "default", name: "bare", node: "node-a"}},
+		blockedEvictions:      map[string]int{"default/bare": -1},
+		wantActions: []string{
+			"cordon node-a",
+			"uncordon node-a",
+		},
+		wantSizes:    map[string]int{"np-1": 1},
+		wantExitCode: exitCodeDrainTimeout,
+	},
+	{
+		name:             "reports drain timeout which expires while an eviction is blocked",
+		desiredVersion:   "v1.29.3",
+		drainTimeout:     50 * time.Millisecond,
+		nodepools:        []nodepoolFixture{{id: "np-1", name: "workers", version: "v1.29.3", nodes: []nodeFixture{{name: "node-a", version: "v1.28.7"}}}},
+		pods:             []podFixture{{namespace: "default", name: "bare", node: "node-a"}},
+		blockedEvictions: map[string]int{"default/bare": -1},
+		wantActions: []string{
+			"cordon node-a",
+			"uncordon node-a",
+		},
+		wantSizes:    map[string]int{"np-1": 1},
+		wantExitCode: exitCodeDrainTimeout,
+	},
+	{
+		name:             "leaves node cordoned with the leave failure policy",
+		desiredVersion:   "v1.29.3",
+		evictionTimeout:  20 * time.Millisecond,
+		failurePolicy:    failurePolicyLeave,
+		nodepools:        []nodepoolFixture{{id: "np-1", name: "workers", version: "v1.29.3", nodes: []nodeFixture{{name: "node-a", version: "v1.28.7"}}}},
+		pods:             []podFixture{{namespace: "default", name: "bare", node: "node-a"}},
+		blockedEvictions: map[string]int{"default/bare": -1},
+		wantActions: []string{
+			"cordon node-a",
+		},
+		wantSizes:    map[string]int{"np-1": 1},
+		wantExitCode: exitCodeDrainTimeout,
+	},
+	{
+		name:                "rolls back surge capacity of a failed node",
+		desiredVersion:      "v1.29.3",
+		surge:               1,
+		evictionTimeout:     20 * time.Millisecond,
+		restoreNodepoolSize: true,
+		nodepools:           []nodepoolFixture{{id: "np-1", name: "workers", version: "v1.29.3", nodes: []nodeFixture{{name: "node-a", version: "v1.28.7"}}}},
+		pods:                []podFixture{{namespace: "default", name: "bare", node: "node-a"}},
+		blockedEvictions:    map[string]int{"default/bare": -1},
+		wantActions: []string{
+			"sks-scale np-1 2",
+			"cordon node-a",
+			"uncordon node-a",
+			"cordon workers-2",
+			"sks-evict workers-2",
+		},
+		wantSizes:    map[string]int{"np-1": 1},
+		wantExitCode: exitCodeDrainTimeout,
+	},
+	{
+		name:                "keeps surge node of a failed node which runs rescheduled pods",
+		desiredVersion:      "v1.29.3",
+		surge:               1,
+		evictionTimeout:     20 * time.Millisecond,
+		restoreNodepoolSize: true,
+		nodepools:           []nodepoolFixture{{id: "np-1", name: "workers", version: "v1.29.3", nodes: []nodeFixture{{name: "node-a", version: "v1.28.7"}}}},
+		pods: []podFixture{
+			{namespace: "default", name: "worker", node: "node-a"},
+			{namespace: "default", name: "web-1", node: "node-a", ownerKind: "Deployment", ownerName: "web"},
+		},
+		blockedEvictions: map[string]int{"default/worker": -1},
+		wantActions: []string{
+			"sks-scale np-1 2",
+			"cordon node-a",
+			"restart default/web",
+			"uncordon node-a",
+		},
+		wantSizes:    map[string]int{"np-1": 2},
+		wantExitCode: exitCodeDrainTimeout,
+	},
+	{
+		name:                 "keeps node whose rescheduled deployment does not become available",
+		desiredVersion:       "v1.29.3",
+		workloadTimeout:      20 * time.Millisecond,
+		unavailableWorkloads: []string{"default/web"},
+		nodepools: []nodepoolFixture{{
+			id: "np-1", name: "workers", version: "v1.29.3",
+			nodes: []nodeFixture{{name: "node-a", version: "v1.28.7"}, {name: "node-b", version: "v1.29.3"}},
+		}},
+		pods: []podFixture{
+			{namespace: "default", name: "web-1", node: "node-a", ownerKind: "Deployment", ownerName: "web"},
+		},
+		wantActions: []string{
+			"cordon node-a",
+			"restart default/web",
+			"uncordon node-a",
+		},
+		wantSizes:    map[string]int{"np-1": 2},
+		wantExitCode: exitCodeDrainTimeout,
+	},
+	{
+		name:            "keeps node whose restarted deployment does not finish its rollout",
+		desiredVersion:  "v1.29.3",
+		workloadTimeout: 20 * time.Millisecond,
+		stalledRollouts: []string{"default/web"},
+		nodepools: []nodepoolFixture{{
+			id: "np-1", name: "workers", version: "v1.29.3",
+			nodes: []nodeFixture{{name: "node-a", version: "v1.28.7"}, {name: "node-b", version: "v1.29.3"}},
+		}},
+		pods: []podFixture{
+			{namespace: "default", name: "web-1", node: "node-a", ownerKind: "Deployment", ownerName: "web"},
+		},
+		wantActions: []string{
+			"cordon node-a",
+			"restart default/web",
+			"uncordon node-a",
+		},
+		wantSizes:    map[string]int{"np-1": 2},
+		wantExitCode: exitCodeDrainTimeout,
+	},
+	{
+		name:           "evicts statefulset pods one at a time from the highest ordinal",
+		desiredVersion: "v1.29.3",
+		nodepools: []nodepoolFixture{{
+			id: "np-1", name: "workers", version: "v1.29.3",
+			nodes: []nodeFixture{{name: "node-a", version: "v1.28.7"}, {name: "node-b", version: "v1.29.3"}},
+		}},
+		pods: []podFixture{
+			{namespace: "default", name: "db-0", node: "node-a", ownerKind: "StatefulSet", ownerName: "db"},
+			{namespace: "default", name: "db-1", node: "node-a", ownerKind: "StatefulSet", ownerName: "db"},
+			{namespace: "default", name: "db-2", node: "node-b", ownerKind: "StatefulSet", ownerName: "db"},
+		},
+		wantActions: []string{
+			"cordon node-a",
+			"evict default/db-1",
+			"evict default/db-0",
+			"sks-evict node-a",
+		},
+		wantSizes: map[string]int{"np-1": 1},
+	},
+	{
+		name:           "evicts statefulset pod which keeps its quorum",
+		desiredVersion: "v1.29.3",
+		nodepools: []nodepoolFixture{{
+			id: "np-1", name: "workers", version: "v1.29.3",
+			nodes: []nodeFixture{{name: "node-a", version: "v1.28.7"}, {name: "node-b", version: "v1.29.3"}},
+		}},
+		pods: []podFixture{
+			{namespace: "default", name: "db-0", node: "node-a", ownerKind: "StatefulSet", ownerName: "db", ownerAnnotations: map[string]string{statefulSetQuorumAnnotation: "true"}},
+			{namespace: "default", name: "db-1", node: "node-b", ownerKind: "StatefulSet", ownerName: "db", ownerAnnotations: map[string]string{statefulSetQuorumAnnotation: "true"}},
+			{namespace: "default", name: "db-2", node: "node-b", ownerKind: "StatefulSet", ownerName: "db", ownerAnnotations: map[string]string{statefulSetQuorumAnnotation: "true"}},
+		},
+		wantActions: []string{
+			"cordon node-a",
+			"evict default/db-0",
+			"sks-evict node-a",
+		},
+		wantSizes: map[string]int{"np-1": 1},
+	},
+	{
+		name:            "aborts node whose statefulset would lose its quorum",
+		desiredVersion:  "v1.29.3",
+		evictionTimeout: 20 * time.Millisecond,
+		nodepools: []nodepoolFixture{{
+			id: "np-1", name: "workers", version: "v1.29.3",
+			nodes: []nodeFixture{{name: "node-a", version: "v1.28.7"}, {name: "node-b", version: "v1.29.3"}},
+		}},
+		pods: []podFixture{
+			{namespace: "default", name: "db-0", node: "node-a", ownerKind: "StatefulSet", ownerName: "db", ownerAnnotations: map[string]string{statefulSetQuorumAnnotation: "true"}},
+			{namespace: "default", name: "db-1", node: "node-b", ownerKind: "StatefulSet", ownerName: "db", ownerAnnotations: map[string]string{statefulSetQuorumAnnotation: "true"}},
+		},
+		wantActions: []string{
+			"cordon node-a",
+			"uncordon node-a",
+		},
+		wantSizes:    map[string]int{"np-1": 2},
+		wantExitCode: exitCodeDrainTimeout,
+	},
+	{
+		name:           "resolves the desired version from the control plane",
+		desiredVersion: desiredVersionControlPlane,
+		clusterVersion: "1.29.3",
+		surge:          1,
+		nodepools: []nodepoolFixture{{
+			id: "np-1", name: "workers", version: "v1.29.3",
+			nodes: []nodeFixture{{name: "node-a", version: "v1.28.7"}, {name: "node-b", version: "v1.29.3"}, {name: "node-c", version: "v1.30.0"}},
+		}},
+		wantActions: []string{
+			"sks-scale np-1 4",
+			"cordon node-a",
+			"sks-evict node-a",
+		},
+		wantSizes: map[string]int{"np-1": 3},
+	},
+	{
+		name:              "resolves the latest available version",
+		desiredVersion:    desiredVersionLatest,
+		clusterVersion:    "1.29.3",
+		availableVersions: []string{"1.28.7", "1.30.1", "1.29.3"},
+		surge:             1,
+		nodepools: []nodepoolFixture{{
+			id: "np-1", name: "workers", version: "v1.30.1",
+			nodes: []nodeFixture{{name: "node-a", version: "v1.29.3"}, {name: "node-b", version: "v1.30.1"}},
+		}},
+		wantActions: []string{
+			"sks-scale np-1 3",
+			"cordon node-a",
+			"sks-evict node-a",
+		},
+		wantSizes: map[string]int{"np-1": 2},
+	},
+	{
+		name:           "does nothing when all nodes are on the desired version",
+		desiredVersion: "v1.29.3",
+		surge:          1,
+		nodepools:      []nodepoolFixture{{id: "np-1", name: "workers", version: "v1.29.3", nodes: []nodeFixture{{name: "node-a", version: "v1.29.3"}}}},
+		wantSizes:      map[string]int{"np-1": 1},
+		wantExitCode:   exitCodeNothingToDo,
+	},
+}
+
+func TestCycleScenarios(t *testing.T) {
+	for _, sc := range scenarios {
+		t.Run(sc.name, func(t *testing.T) {
+			h := newScenarioHarness(t, sc)
+
+			result, err := runCycle(context.Background(), h.clientset, h.provider, h.opts)
+			if err != nil {
+				t.Fatalf("runCycle() error = %v", err)
+			}
+			if code := exitCode(result.err()); code != sc.wantExitCode {
+				t.Errorf("exit code = %d (%v), want %d", code, result.err(), sc.wantExitCode)
+			}
+
+			if got := h.recorder.list(); !reflect.DeepEqual(got, sc.wantActions) {
+				t.Errorf("actions =\n\t%q\nwant\n\t%q", got, sc.wantActions)
+			}
+			for nodepoolId, wantSize := range sc.wantSizes {
+				if size := h.stub.nodepoolSize(nodepoolId); size != wantSize {
+					t.Errorf("nodepool %s size = %d, want %d", nodepoolId, size, wantSize)
+				}
+			}
+		})
+	}
+}
+
+// scenarioHarness wires a fake clientset and a local Exoscale API stand-in up to a scenario
+type scenarioHarness struct {
+	clientset *fake.Clientset
+	stub      *exoscaleStub
+	recorder  *actionRecorder
+	provider  SKSProvider
+	opts      cycleOptions
+}
+
+func newScenarioHarness(t *testing.T, sc scenario) *scenarioHarness {
+	t.Helper()
+
+	clientset := fake.NewSimpleClientset()
+	recorder := &actionRecorder{}
+	clusterVersion := sc.clusterVersion
+	if clusterVersion == "" {
+		clusterVersion = sc.desiredVersion
+	}
+	stub := newExoscaleStub(clientset, recorder, clusterVersion)
+	if sc.availableVersions != nil {
+		stub.versions = sc.availableVersions
+	}
+	t.Cleanup(stub.close)
+
+	for _, np := range sc.nodepools {
+		var nodeNames []string
+		for _, n := range np.nodes {
+			nodeNames = append(nodeNames, n.name)
+		}
+		instanceIds := stub.addNodepool(np.id, np.name, np.version, nodeNames)
+
+		for _, n := range np.nodes {
+			labels := map[string]string{nodeLabelNodepoolId: np.id}
+			for key, value := range n.labels {
+				labels[key] = value
+			}
+			mustAdd(t, clientset, &corev1.Node{
+				ObjectMeta: metav1.ObjectMeta{Name: n.name, Labels: labels},
+				Status: corev1.NodeStatus{
+					Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: corev1.ConditionTrue}},
+					NodeInfo:   corev1.NodeSystemInfo{SystemUUID: instanceIds[n.name], KubeletVersion: n.version},
+				},
+			})
+		}
+	}
+
+	workloadReplicas := make(map[string]int32)
+	for _, p := range sc.pods {
+		for _, obj := range podObjects(p) {
+			// Pods of the same workload share their owners
+			if err := clientset.Tracker().Add(obj); err != nil && !apierrors.IsAlreadyExists(err) {
+				t.Fatal(err)
+			}
+		}
+		if p.ownerKind == "Deployment" || p.ownerKind == "StatefulSet" {
+			workloadReplicas[p.ownerKind+"/"+p.namespace+"/"+p.ownerName] += 1
+		}
+	}
+	unavailable := make(map[string]bool)
+	for _, workload := range sc.unavailableWorkloads {
+		unavailable[workload] = true
+	}
+
+	// Workloads have one replica per pod, all of them available unless the scenario says otherwise
+	for key, replicas := range workloadReplicas {
+		parts := strings.SplitN(key, "/", 3)
+		kind, namespace, name := parts[0], parts[1], parts[2]
+		available := replicas
+		if unavailable[namespace+"/"+name] {
+			available -= 1
+		}
+
+		var err error
+		switch kind {
+		case "Deployment":
+			deployment, getErr := clientset.AppsV1().Deployments(namespace).Get(context.Background(), name, metav1.GetOptions{})
+			if getErr != nil {
+				t.Fatal(getErr)
+			}
+			deployment.Generation = 1
+			deployment.Spec.Replicas = &replicas
+			deployment.Status.ObservedGeneration = 1
+			deployment.Status.Replicas = replicas
+			deployment.Status.UpdatedReplicas = replicas
+			deployment.Status.AvailableReplicas = available
+			err = clientset.Tracker().Update(appsv1.SchemeGroupVersion.WithResource("deployments"), deployment, namespace)
+		case "StatefulSet":
+			statefulSet, getErr := clientset.AppsV1().StatefulSets(namespace).Get(context.Background(), name, metav1.GetOptions{})
+			if getErr != nil {
+				t.Fatal(getErr)
+			}
+			statefulSet.Generation = 1
+			statefulSet.Spec.Replicas = &replicas
+			statefulSet.Status.ObservedGeneration = 1
+			statefulSet.Status.Replicas = replicas
+			statefulSet.Status.UpdatedReplicas = replicas
+			statefulSet.Status.ReadyReplicas = available
+			err = clientset.Tracker().Update(appsv1.SchemeGroupVersion.WithResource("statefulsets"), statefulSet, namespace)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	addSimulationReactors(clientset, recorder, sc.blockedEvictions, sc.throttledEvictions, sc.stalledRollouts)
+
+	// Announce policy/v1, so evictions are created through it
+	clientset.Resources = []*metav1.APIResourceList{{GroupVersion: policyv1.SchemeGroupVersion.String()}}
+
+	viper.Reset()
+	viper.Set("exoscale_api_endpoint", stub.server.URL)
+	viper.Set("exoscale_api_key", "EXOtest")
+	viper.Set("exoscale_api_secret", "secret")
+	viper.Set("exoscale_api_poll_interval", 10*time.Millisecond)
+	t.Cleanup(viper.Reset)
+
+	egoclient, err := initExoscaleClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &scenarioHarness{
+		clientset: clientset,
+		stub:      stub,
+		recorder:  recorder,
+		provider:  newExoscaleProvider(egoclient, "at-vie-1", stub.sksClusterId),
+		opts:      testCycleOptions(),
+	}
+	h.opts.desiredK8sVersion = sc.desiredVersion
+	h.opts.evictNodesLabelSelector = sc.labelSelector
+	h.opts.surgeCount = sc.surge
+	h.opts.evictionTimeout = time.Second
+	h.opts.workloadTimeout = time.Second
+	h.opts.restoreNodepoolSize = sc.restoreNodepoolSize
+	h.opts.drainTimeout = sc.drainTimeout
+	if sc.evictionTimeout > 0 {
+		h.opts.evictionTimeout = sc.evictionTimeout
+	}
+	if sc.evictionTimeoutAction != "" {
+		h.opts.evictionTimeoutAction = sc.evictionTimeoutAction
+	}
+	if sc.workloadTimeout > 0 {
+		h.opts.workloadTimeout = sc.workloadTimeout
+	}
+	if sc.failurePolicy != "" {
+		h.opts.failurePolicy = sc.failurePolicy
+	}
+
+	return h
+}
+
+// podObjects returns the pod of the fixture and the workload objects owning it
+func podObjects(p podFixture) []runtime.Object {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: p.namespace, Name: p.name, Labels: map[string]string{}},
+		Spec:       corev1.PodSpec{NodeName: p.node},
+		Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+
+	switch p.ownerKind {
+	case "":
+		return []runtime.Object{pod}
+	case "Deployment":
+		deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: p.namespace, Name: p.ownerName}}
+		replicaSet := &appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{
+			Namespace:       p.namespace,
+			Name:            p.ownerName + "-rs",
+			OwnerReferences: []metav1.OwnerReference{controllerRef("Deployment", p.ownerName)},
+		}}
+		pod.Labels["app"] = p.ownerName
+		pod.OwnerReferences = []metav1.OwnerReference{controllerRef("ReplicaSet", replicaSet.Name)}
+		return []runtime.Object{deployment, replicaSet, pod}
+	case "StatefulSet":
+		statefulSet := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Namespace: p.namespace, Name: p.ownerName, Annotations: p.ownerAnnotations}}
+		pod.Labels["app"] = p.ownerName
+		pod.OwnerReferences = []metav1.OwnerReference{controllerRef("StatefulSet", p.ownerName)}
+		pod.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}}
+		return []runtime.Object{statefulSet, pod}
+	case "Job":
+		pod.Labels["batch.kubernetes.io/job-name"] = p.ownerName
+		pod.OwnerReferences = []metav1.OwnerReference{controllerRef("Job", p.ownerName)}
+		return []runtime.Object{pod}
+	default:
+		pod.OwnerReferences = []metav1.OwnerReference{controllerRef(p.ownerKind, p.ownerName)}
+		return []runtime.Object{pod}
+	}
+}
+
+func controllerRef(kind string, name string) metav1.OwnerReference {
+	controller := true
+	return metav1.OwnerReference{Kind: kind, Name: name, Controller: &controller}
+}
+
+func mustAdd(t *testing.T, clientset *fake.Clientset, obj runtime.Object) {
+	t.Helper()
+	if err := clientset.Tracker().Add(obj); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// addSimulationReactors records the actions of a cycle and simulates the reactions of the cluster to them:
+// evicted pods are removed unless a PodDisruptionBudget blocks them, and pods of restarted deployments are
+// rescheduled on schedulable nodes.
+func addSimulationReactors(clientset *fake.Clientset, recorder *actionRecorder, blockedEvictions map[string]int, throttledEvictions map[string]int, stalledRollouts []string) {
+	tracker := clientset.Tracker()
+
+	blocked := maps.Clone(blockedEvictions)
+	throttled := maps.Clone(throttledEvictions)
+
+	clientset.PrependReactor("update", "nodes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		node := action.(k8stesting.UpdateAction).GetObject().(*corev1.Node)
+		if node.Spec.Unschedulable {
+			recorder.record("cordon %s", node.Name)
+		} else {
+			recorder.record("uncordon %s", node.Name)
+		}
+		return false, nil, nil
+	})
+
+	clientset.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "eviction" {
+			return false, nil, nil
+		}
+
+		var name string
+		switch eviction := action.(k8stesting.CreateAction).GetObject().(type) {
+		case *policyv1.Eviction:
+			name = eviction.Name
+		case *policyv1beta1.Eviction:
+			name = eviction.Name
+		}
+		if throttled[action.GetNamespace()+"/"+name] > 0 {
+			throttled[action.GetNamespace()+"/"+name] -= 1
+			return true, nil, apierrors.NewTooManyRequests("Too many requests, please try again later.", 0)
+		}
+		if count := blocked[action.GetNamespace()+"/"+name]; count != 0 {
+			if count > 0 {
+				blocked[action.GetNamespace()+"/"+name] -= 1
+			}
+			return true, nil, disruptionBudgetError()
+		}
+		recorder.record("evict %s/%s", action.GetNamespace(), name)
+
+		obj, err := tracker.Get(corev1.SchemeGroupVersion.WithResource("pods"), action.GetNamespace(), name)
+		if err != nil {
+			return true, nil, err
+		}
+		if err := tracker.Delete(corev1.SchemeGroupVersion.WithResource("pods"), action.GetNamespace(), name); err != nil {
+			return true, nil, err
+		}
+
+		// The StatefulSet controller recreates the pod under the same name on a schedulable node
+		pod := obj.(*corev1.Pod)
+		if ownerRef := metav1.GetControllerOf(pod); ownerRef != nil && ownerRef.Kind == "StatefulSet" {
+			recreated := pod.DeepCopy()
+			recreated.ResourceVersion = ""
+			recreated.Spec.NodeName = schedulableNode(tracker)
+			_ = tracker.Add(recreated)
+		}
+		return true, nil, nil
+	})
+
+	clientset.PrependReactor("delete", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		recorder.record("delete %s/%s", action.GetNamespace(), action.(k8stesting.DeleteAction).GetName())
+		return false, nil, nil
+	})
+
+	clientset.PrependReactor("patch", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		name := action.(k8stesting.PatchAction).GetName()
+		recorder.record("restart %s/%s", action.GetNamespace(), name)
+
+		// The restart changes the pod template, so the generation of the Deployment increases and its controller
+		// observes it once it has rolled out the new pods
+		obj, err := tracker.Get(appsv1.SchemeGroupVersion.WithResource("deployments"), action.GetNamespace(), name)
+		if err != nil {
+			return true, nil, err
+		}
+		deployment := obj.(*appsv1.Deployment)
+		deployment.Generation += 1
+		if !slices.Contains(stalledRollouts, action.GetNamespace()+"/"+name) {
+			deployment.Status.ObservedGeneration = deployment.Generation
+		}
+		if err := tracker.Update(appsv1.SchemeGroupVersion.WithResource("deployments"), deployment, action.GetNamespace()); err != nil {
+			return true, nil, err
+		}
+
+		rescheduleDeploymentPods(tracker, action.GetNamespace(), name)
+		return false, nil, nil
+	})
+}
+
+// disruptionBudgetError returns the error with which the API server refuses an eviction which would violate a
+// PodDisruptionBudget
+func disruptionBudgetError() error {
+	err := apierrors.NewTooManyRequests("Cannot evict pod as it would violate the pod's disruption budget.", 0)
+	err.ErrStatus.Details.Causes = []metav1.StatusCause{{
+		Type:    policyv1.DisruptionBudgetCause,
+		Message: "The disruption budget pdb needs 1 healthy pods and has 1 currently",
+	}}
+	return err
+}
+
+// schedulableNode returns the name of the first node which is not cordoned
+func schedulableNode(tracker k8stesting.ObjectTracker) string {
+	nodes, _ := tracker.List(corev1.SchemeGroupVersion.WithResource("nodes"), corev1.SchemeGroupVersion.WithKind("Node"), "")
+	for _, node := range nodes.(*corev1.NodeList).Items {
+		if !node.Spec.Unschedulable {
+			return node.Name
+		}
+	}
+	return ""
+}
+
+// rescheduleDeploymentPods moves the pods of a deployment from cordoned nodes to the first schedulable node
+func rescheduleDeploymentPods(tracker k8stesting.ObjectTracker, namespace string, deploymentName string) {
+	nodes, _ := tracker.List(corev1.SchemeGroupVersion.WithResource("nodes"), corev1.SchemeGroupVersion.WithKind("Node"), "")
+	unschedulable := make(map[string]bool)
+	for _, node := range nodes.(*corev1.NodeList).Items {
+		unschedulable[node.Name] = node.Spec.Unschedulable
+	}
+	target := schedulableNode(tracker)
+
+	pods, _ := tracker.List(corev1.SchemeGroupVersion.WithResource("pods"), corev1.SchemeGroupVersion.WithKind("Pod"), namespace)
+	for _, pod := range pods.(*corev1.PodList).Items {
+		if pod.Labels["app"] != deploymentName || !unschedulable[pod.Spec.NodeName] {
+			continue
+		}
+
+		_ = tracker.Delete(corev1.SchemeGroupVersion.WithResource("pods"), pod.Namespace, pod.Name)
+		rescheduled := pod.DeepCopy()
+		rescheduled.Name = fmt.Sprintf("%s-rescheduled", pod.Name)
+		rescheduled.ResourceVersion = ""
+		rescheduled.Spec.NodeName = target
+		_ = tracker.Add(rescheduled)
+	}
+}
+
+// actionRecorder collects the actions of a cycle in the order they happen
+type actionRecorder struct {
+	mu      sync.Mutex
+	actions []string
+}
+
+func (r *actionRecorder) record(format string, args ...any) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.actions = append(r.actions, fmt.Sprintf(format, args...))
+}
+
+func (r *actionRecorder) list() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]string(nil), r.actions...)
+}
@@ -0,0 +1,182 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Annotation on a StatefulSet or its namespace which opts into the quorum check: a pod is only evicted
+// if a majority of the replicas stays ready without it
+const statefulSetQuorumAnnotation string = "sks-lifecycler.whizus.com/statefulset-quorum"
+
+// Sort StatefulSet pods by their StatefulSet and, within a StatefulSet, from the highest to the lowest ordinal,
+// which is the order the StatefulSet controller itself removes pods in
+func sortStatefulSetPods(pods []corev1.Pod) {
+	sort.SliceStable(pods, func(i, j int) bool {
+		ownerI, ownerJ := statefulSetKey(pods[i]), statefulSetKey(pods[j])
+		if ownerI != ownerJ {
+			return ownerI < ownerJ
+		}
+		return podOrdinal(pods[i]) > podOrdinal(pods[j])
+	})
+}
+
+func statefulSetKey(pod corev1.Pod) string {
+	if ownerRef := metav1.GetControllerOf(&pod); ownerRef != nil {
+		return pod.Namespace + "/" + ownerRef.Name
+	}
+	return pod.Namespace + "/"
+}
+
+// Get the ordinal of a StatefulSet pod from its name, e.g. 2 for "db-2", or -1 if it has none
+func podOrdinal(pod corev1.Pod) int {
+	index := strings.LastIndex(pod.Name, "-")
+	if index < 0 {
+		return -1
+	}
+	ordinal, err := strconv.Atoi(pod.Name[index+1:])
+	if err != nil {
+		return -1
+	}
+	return ordinal
+}
+
+// Evict a pod of a StatefulSet and wait until its replacement is ready on another node and the StatefulSet reports
+// all replicas as ready. With the quorum annotation, the pod is only evicted once a majority of the replicas
+// stays ready without it. Waiting for the quorum and evicting the pod are bounded by the eviction timeout, waiting for
+// the replacement by the context of the drain. Once a deadline is reached, errEvictionTimeout is returned.
+func drainStatefulSetPod(ctx context.Context, clientset kubernetes.Interface, watcher *clusterWatcher, node corev1.Node, pod corev1.Pod, opts cycleOptions) error {
+	log := loggerFrom(ctx).With(logKeyPod, pod.Name, logKeyNamespace, pod.Namespace)
+	// The quorum holds the eviction back like a PodDisruptionBudget does, so waiting for it counts against the
+	// eviction timeout. The eviction itself gets the remaining time, so it can still delete the pod once the deadline
+	// is reached.
+	deadline := time.Now().Add(opts.evictionTimeout)
+
+	ownerRef := metav1.GetControllerOf(&pod)
+	statefulSet, err := watcher.statefulSets.StatefulSets(pod.Namespace).Get(ownerRef.Name)
+	if err != nil {
+		return err
+	}
+
+	quorum, err := statefulSetQuorumRequired(ctx, clientset, statefulSet)
+	if err != nil {
+		return err
+	}
+	if quorum {
+		log.Info("Waiting for the StatefulSet to keep its quorum without the pod", "statefulset", statefulSet.Name)
+		quorumCtx, cancel := context.WithDeadline(ctx, deadline)
+		err := waitStatefulSet(quorumCtx, watcher, statefulSet, statefulSetKeepsQuorum)
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := evictPod(ctx, clientset, watcher.policyVersion, pod, max(time.Until(deadline), 0), opts.evictionTimeoutAction); err != nil {
+		return err
+	}
+
+	// A restarted replica may take much longer to become ready than an eviction, only the drain timeout bounds this
+	log.Info("Waiting for the replacement of the StatefulSet pod to be ready", "statefulset", statefulSet.Name)
+	if err := waitPodReplaced(ctx, watcher, pod, node.Name); err != nil {
+		return err
+	}
+
+	return waitStatefulSet(ctx, watcher, statefulSet, statefulSetReady)
+}
+
+// Check the quorum annotation on the StatefulSet and its namespace
+func statefulSetQuorumRequired(ctx context.Context, clientset kubernetes.Interface, statefulSet *appsv1.StatefulSet) (bool, error) {
+	if value, ok := statefulSet.Annotations[statefulSetQuorumAnnotation]; ok {
+		return strconv.ParseBool(value)
+	}
+
+	namespace, err := clientset.CoreV1().Namespaces().Get(ctx, statefulSet.Namespace, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if value, ok := namespace.Annotations[statefulSetQuorumAnnotation]; ok {
+		return strconv.ParseBool(value)
+	}
+
+	return false, nil
+}
+
+func statefulSetReplicas(statefulSet *appsv1.StatefulSet) int32 {
+	return replicasOrDefault(statefulSet.Spec.Replicas)
+}
+
+// Check that all replicas of the StatefulSet are ready
+func statefulSetReady(statefulSet *appsv1.StatefulSet) bool {
+	return statefulSet.Status.ReadyReplicas >= statefulSetReplicas(statefulSet)
+}
+
+// Check that a majority of the replicas of the StatefulSet stays ready, if one more pod goes away
+func statefulSetKeepsQuorum(statefulSet *appsv1.StatefulSet) bool {
+	return statefulSet.Status.ReadyReplicas-1 >= statefulSetReplicas(statefulSet)/2+1
+}
+
+// Wait until the condition holds for the StatefulSet, errEvictionTimeout is returned once the deadline of the context is reached
+func waitStatefulSet(ctx context.Context, watcher *clusterWatcher, statefulSet *appsv1.StatefulSet, condition func(*appsv1.StatefulSet) bool) error {
+	current := statefulSet
+	err := watcher.waitFor(ctx, func() (bool, error) {
+		var err error
+		current, err = watcher.statefulSets.StatefulSets(statefulSet.Namespace).Get(statefulSet.Name)
+		if err != nil {
+			return false, err
+		}
+		return condition(current), nil
+	})
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w: statefulset %s/%s has %d of %d replicas ready", errEvictionTimeout,
+			current.Namespace, current.Name, current.Status.ReadyReplicas, statefulSetReplicas(current))
+	}
+
+	return err
+}
+
+// Wait until the StatefulSet has recreated the pod on another node and it is ready
+func waitPodReplaced(ctx context.Context, watcher *clusterWatcher, pod corev1.Pod, nodeName string) error {
+	err := watcher.waitFor(ctx, func() (bool, error) {
+		replacement, err := watcher.pods.Pods(pod.Namespace).Get(pod.Name)
+		if apierrors.IsNotFound(err) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		return replacement.Spec.NodeName != nodeName && replacement.DeletionTimestamp == nil && podReady(*replacement), nil
+	})
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w: replacement of pod %s/%s is not ready", errEvictionTimeout, pod.Namespace, pod.Name)
+	}
+
+	return err
+}
+
+// Check if the pod is running and reports the Ready condition
+func podReady(pod corev1.Pod) bool {
+	if pod.Status.Phase != corev1.PodRunning {
+		return false
+	}
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
@@ -0,0 +1,226 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/version"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// How long to wait for the API server to report the new version after the upgrade operation completed
+var apiServerVersionTimeout = 10 * time.Minute
+
+// clusterUpgradeCmd represents the cluster upgrade command
+var clusterUpgradeCmd = &cobra.Command{
+	Use:   "upgrade",
+	Short: "Upgrade the SKS control plane to the next Kubernetes version.",
+	Long: `Upgrade the SKS control plane to the next Kubernetes version. The procedure is as follows:
+- Resolve the target version (a version or "latest", defaults to the desired version).
+- Refuse downgrades and upgrades which skip a minor version.
+- Refuse the upgrade if a node's kubelet would violate the version skew policy afterwards.
+- Upgrade the control plane and wait for the operation to complete.
+- Wait until the API server reports the new version.
+- Optionally continue with "nodepool cycle" to replace the nodes (--cycle-nodes), tuned by the flags of a cycle.`,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		return bindCycleFlags(cmd)
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// Errors from here on are not caused by wrong usage
+		cmd.SilenceUsage = true
+
+		targetVersion := viper.GetString("upgrade_k8s_version")
+		if targetVersion == "" {
+			targetVersion = viper.GetString("desired_k8s_version")
+		}
+
+		ctx, cancel := commandContext(cmd)
+		defer cancel()
+
+		clientset, egoclient, err := initClients()
+		if err != nil {
+			return err
+		}
+		provider := newExoscaleProvider(egoclient, viper.GetString("exoscale_api_zone"), viper.GetString("sks_cluster_id"))
+
+		// Only one instance may change the cluster at a time
+		ctx, release, err := acquireLock(ctx, clientset, lockOptionsFromConfig())
+		if err != nil {
+			return err
+		}
+		defer release()
+
+		if err := runUpgrade(ctx, clientset, provider, targetVersion); err != nil {
+			if ctx.Err() != nil {
+				return interruptedError(ctx)
+			}
+			return err
+		}
+		if !viper.GetBool("upgrade_cycle_nodes") {
+			return nil
+		}
+
+		// The nodes follow the control plane, whichever version it has been upgraded to
+		opts, err := cycleOptionsFromConfig()
+		if err != nil {
+			return err
+		}
+		opts.desiredK8sVersion = desiredVersionControlPlane
+		result, err := runCycle(ctx, clientset, provider, opts)
+		if err != nil {
+			return err
+		}
+
+		return result.err()
+	},
+}
+
+// runUpgrade upgrades the control plane to the target version, after checking the upgrade path and the version skew of the nodes
+func runUpgrade(ctx context.Context, clientset kubernetes.Interface, provider SKSProvider, targetVersion string) error {
+	if targetVersion == desiredVersionControlPlane {
+		return configError("the target version of an upgrade cannot be '%s'", desiredVersionControlPlane)
+	}
+
+	sksCluster, err := provider.GetCluster(ctx)
+	if err != nil {
+		return exoscaleError(err)
+	}
+	ctx = withPhase(withLogFields(ctx, logKeyClusterId, *sksCluster.ID), phaseUpgrade)
+
+	currentVersion, err := resolveDesiredVersion(ctx, provider, sksCluster, desiredVersionControlPlane)
+	if err != nil {
+		return err
+	}
+	target, err := resolveDesiredVersion(ctx, provider, sksCluster, targetVersion)
+	if err != nil {
+		return err
+	}
+
+	if versionsEqual(target, currentVersion) {
+		loggerFrom(ctx).Info("Control plane is already on the target version", "version", kubeletVersionString(target))
+		return nil
+	}
+	if err := checkUpgradePath(currentVersion, target); err != nil {
+		return err
+	}
+
+	availableVersions, err := provider.ListClusterVersions(ctx)
+	if err != nil {
+		return exoscaleError(err)
+	}
+	if !versionAvailable(availableVersions, target) {
+		return configError("version %s is not available for SKS clusters, available versions: %s", kubeletVersionString(target), strings.Join(availableVersions, ", "))
+	}
+
+	if err := checkVersionSkew(ctx, clientset, target); err != nil {
+		return err
+	}
+
+	loggerFrom(ctx).Info("Upgrading control plane", "from", kubeletVersionString(currentVersion), "to", kubeletVersionString(target))
+	if err := provider.UpgradeCluster(ctx, target.String()); err != nil {
+		return exoscaleError(err)
+	}
+
+	if err := waitAPIServerVersion(ctx, clientset, target); err != nil {
+		return err
+	}
+	loggerFrom(ctx).Info("Control plane upgraded", "version", kubeletVersionString(target))
+
+	return nil
+}
+
+// Check that the upgrade moves forward by at most one minor version within the same major version
+func checkUpgradePath(currentVersion *version.Version, target *version.Version) error {
+	if target.LessThan(currentVersion) {
+		return configError("refusing to downgrade the control plane from %s to %s", kubeletVersionString(currentVersion), kubeletVersionString(target))
+	}
+	if target.Major() != currentVersion.Major() || target.Minor() > currentVersion.Minor()+1 {
+		return configError("refusing to skip minor versions when upgrading the control plane from %s to %s, upgrade to v%d.%d first",
+			kubeletVersionString(currentVersion), kubeletVersionString(target), currentVersion.Major(), currentVersion.Minor()+1)
+	}
+	return nil
+}
+
+// Check whether the version is one of the available versions
+func versionAvailable(availableVersions []string, target *version.Version) bool {
+	for _, v := range availableVersions {
+		if available, err := version.ParseGeneric(v); err == nil && versionsEqual(available, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the number of minor versions a kubelet may be older than the API server. The skew has been extended from two
+// to three minor versions with Kubernetes 1.28.
+func maxKubeletSkew(apiServerVersion *version.Version) uint {
+	if apiServerVersion.AtLeast(version.MajorMinor(1, 28)) {
+		return 3
+	}
+	return 2
+}
+
+// Check that no kubelet would be older than the version skew policy allows once the API server is on the target version
+func checkVersionSkew(ctx context.Context, clientset kubernetes.Interface, target *version.Version) error {
+	nodes, err := clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return kubernetesError(err)
+	}
+
+	maxSkew := maxKubeletSkew(target)
+	var violations []string
+	for _, node := range nodes.Items {
+		kubeletVersion, err := version.ParseGeneric(node.Status.NodeInfo.KubeletVersion)
+		if err != nil {
+			return safetyAbortError(fmt.Errorf("kubelet version '%s' of node %s cannot be parsed", node.Status.NodeInfo.KubeletVersion, node.Name))
+		}
+		if kubeletVersion.Major() != target.Major() || kubeletVersion.Minor()+maxSkew < target.Minor() {
+			violations = append(violations, node.Name+" ("+node.Status.NodeInfo.KubeletVersion+")")
+		}
+	}
+	if len(violations) > 0 {
+		return safetyAbortError(fmt.Errorf("refusing to upgrade the control plane to %s, the kubelets of these nodes would be more than %d minor versions older: %s",
+			kubeletVersionString(target), maxSkew, strings.Join(violations, ", ")))
+	}
+
+	return nil
+}
+
+// Wait until the API server reports the target version through the discovery API
+func waitAPIServerVersion(ctx context.Context, clientset kubernetes.Interface, target *version.Version) error {
+	err := wait.PollUntilContextTimeout(ctx, pollInterval, apiServerVersionTimeout, true, func(ctx context.Context) (bool, error) {
+		serverVersion, err := clientset.Discovery().ServerVersion()
+		if err != nil {
+			loggerFrom(ctx).Warn("Error getting the API server version", logKeyError, err)
+			return false, nil
+		}
+		reported, err := version.ParseGeneric(serverVersion.GitVersion)
+		if err == nil && versionsEqual(reported, target) {
+			return true, nil
+		}
+		loggerFrom(ctx).Info("API server does not report the target version yet", "reported", serverVersion.GitVersion, "retry_in", pollInterval)
+		return false, nil
+	})
+	if err != nil {
+		return kubernetesError(fmt.Errorf("the API server did not report version %s within %s: %w", kubeletVersionString(target), apiServerVersionTimeout, err))
+	}
+
+	return nil
+}
+
+func init() {
+	clusterCmd.AddCommand(clusterUpgradeCmd)
+
+	clusterUpgradeCmd.Flags().String("version", "", "Kubernetes version to upgrade the control plane to, or latest (defaults to the desired version)")
+	viper.BindPFlag("upgrade_k8s_version", clusterUpgradeCmd.Flags().Lookup("version"))
+	clusterUpgradeCmd.Flags().Bool("cycle-nodes", false, "Replace all nodes with the new version after the control plane has been upgraded")
+	viper.BindPFlag("upgrade_cycle_nodes", clusterUpgradeCmd.Flags().Lookup("cycle-nodes"))
+	addCycleFlags(clusterUpgradeCmd)
+}
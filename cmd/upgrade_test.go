@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"context"
+	"testing"
+
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sversion "k8s.io/apimachinery/pkg/version"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestRunUpgrade(t *testing.T) {
+	tests := []struct {
+		name           string
+		clusterVersion string
+		targetVersion  string
+		kubeletVersion string
+		wantExitCode   int
+		wantVersion    string
+	}{
+		{"upgrades to the next minor version", "1.28.7", "v1.29.3", "v1.28.7", exitCodeSuccess, "1.29.3"},
+		{"upgrades to the latest version", "1.28.7", desiredVersionLatest, "v1.28.7", exitCodeSuccess, "1.29.3"},
+		{"does nothing on the target version", "1.29.3", "1.29.3", "v1.29.3", exitCodeSuccess, "1.29.3"},
+		{"refuses to skip minor versions", "1.27.9", "1.29.3", "v1.27.9", exitCodeConfig, "1.27.9"},
+		{"refuses to downgrade", "1.29.3", "1.28.7", "v1.29.3", exitCodeConfig, "1.29.3"},
+		{"refuses unavailable versions", "1.28.7", "1.29.1", "v1.28.7", exitCodeConfig, "1.28.7"},
+		{"refuses to violate the version skew", "1.28.7", "1.29.3", "v1.25.16", exitCodeSafetyAbort, "1.28.7"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset(&corev1.Node{
+				ObjectMeta: metav1.ObjectMeta{Name: "node-a"},
+				Status:     corev1.NodeStatus{NodeInfo: corev1.NodeSystemInfo{KubeletVersion: tt.kubeletVersion}},
+			})
+			clientset.Discovery().(*fakediscovery.FakeDiscovery).FakedServerVersion = &k8sversion.Info{GitVersion: "v" + tt.clusterVersion}
+			provider := newFakeSKSProvider(clientset, tt.clusterVersion)
+			provider.availableVersions = []string{"1.27.9", "1.28.7", "1.29.3"}
+
+			err := runUpgrade(context.Background(), clientset, provider, tt.targetVersion)
+			if code := exitCode(err); code != tt.wantExitCode {
+				t.Fatalf("exit code = %d (%v), want %d", code, err, tt.wantExitCode)
+			}
+			if provider.clusterVersion != tt.wantVersion {
+				t.Errorf("control plane version = %s, want %s", provider.clusterVersion, tt.wantVersion)
+			}
+		})
+	}
+}
+
+func TestClusterUpgradeBindsCycleFlags(t *testing.T) {
+	// The chained cycle is tuned by the same flags as "nodepool cycle"
+	t.Cleanup(func() {
+		clusterUpgradeCmd.Flags().Set("surge", "1")
+		clusterUpgradeCmd.Flags().Set("max-unavailable", "1")
+		viper.Reset()
+	})
+	for name, value := range map[string]string{"surge": "2", "max-unavailable": "50%"} {
+		if err := clusterUpgradeCmd.Flags().Set(name, value); err != nil {
+			t.Fatalf("cluster upgrade has no --%s flag: %v", name, err)
+		}
+	}
+	if err := clusterUpgradeCmd.PreRunE(clusterUpgradeCmd, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	opts, err := cycleOptionsFromConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.surgeCount != 2 || opts.maxUnavailable != "50%" {
+		t.Errorf("options = surge %d, max unavailable %q, want the flags of cluster upgrade", opts.surgeCount, opts.maxUnavailable)
+	}
+}
@@ -2,21 +2,22 @@ package cmd
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
 	"strings"
 	"time"
 
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
-	policyv1beta1 "k8s.io/api/policy/v1beta1"
-	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/version"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/util/retry"
 
 	egoscalev2 "github.com/exoscale/egoscale/v2"
-	egoscalev2oapi "github.com/exoscale/egoscale/v2/oapi"
 
 	"github.com/spf13/viper"
 	"k8s.io/client-go/kubernetes"
@@ -27,6 +28,17 @@ const (
 	nodeLabelNodepoolId string = "node.exoscale.net/nodepool-id"
 )
 
+// Interval in which the state of the cluster is polled while waiting
+var pollInterval = 15 * time.Second
+
+// Bound the context by the timeout, a timeout of 0 leaves it unbounded
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
 func initKubeClient() (*kubernetes.Clientset, error) {
 	var kubeconfigPath string
 
@@ -45,7 +57,7 @@ func initKubeClient() (*kubernetes.Clientset, error) {
 	return clientset, nil
 }
 
-func initExoscaleClient() (*egoscalev2.Client, error) {	
+func initExoscaleClient() (*egoscalev2.Client, error) {
 	var exoscaleApiEndpoint string
 
 	if viper.GetString("exoscale_api_endpoint") != "" {
@@ -54,9 +66,16 @@ func initExoscaleClient() (*egoscalev2.Client, error) {
 		exoscaleApiEndpoint = fmt.Sprintf("https://api-%s.exoscale.com/v2", viper.GetString("exoscale_api_zone"))
 	}
 
-	egoclient, err := egoscalev2.NewClient(viper.GetString("exoscale_api_key"), viper.GetString("exoscale_api_secret"), egoscalev2.ClientOptWithAPIEndpoint(
-		exoscaleApiEndpoint,
-	))
+	egoclientOpts := []egoscalev2.ClientOpt{
+		egoscalev2.ClientOptWithAPIEndpoint(exoscaleApiEndpoint),
+	}
+
+	// Interval in which asynchronous operations (e.g. scaling a nodepool) are polled until they complete
+	if apiPollInterval := viper.GetDuration("exoscale_api_poll_interval"); apiPollInterval > 0 {
+		egoclientOpts = append(egoclientOpts, egoscalev2.ClientOptWithPollInterval(apiPollInterval))
+	}
+
+	egoclient, err := egoscalev2.NewClient(viper.GetString("exoscale_api_key"), viper.GetString("exoscale_api_secret"), egoclientOpts...)
 	if err != nil {
 		return nil, err
 	}
@@ -64,41 +83,52 @@ func initExoscaleClient() (*egoscalev2.Client, error) {
 	return egoclient, nil
 }
 
-func cordonNode(clientset *kubernetes.Clientset, nodeName string, unschedulable bool) error {
+// Set up the Kubernetes and Exoscale clients, failures are reported as configuration errors
+func initClients() (*kubernetes.Clientset, *egoscalev2.Client, error) {
+	if viper.GetString("sks_cluster_id") == "" {
+		return nil, nil, configError("the SKS cluster ID is not set")
+	}
+
+	clientset, err := initKubeClient()
+	if err != nil {
+		return nil, nil, configError("error creating the Kubernetes client: %w", err)
+	}
+
+	egoclient, err := initExoscaleClient()
+	if err != nil {
+		return nil, nil, configError("error creating the Exoscale client: %w", err)
+	}
+
+	return clientset, egoclient, nil
+}
+
+func cordonNode(ctx context.Context, clientset kubernetes.Interface, nodeName string, unschedulable bool) error {
 	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
-		node, getErr := clientset.CoreV1().Nodes().Get(context.Background(), nodeName, metav1.GetOptions{})
+		node, getErr := clientset.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
 		if getErr != nil {
 			return getErr
 		}
 
 		node.Spec.Unschedulable = unschedulable
-		_, updateErr := clientset.CoreV1().Nodes().Update(context.Background(), node, metav1.UpdateOptions{})
+		_, updateErr := clientset.CoreV1().Nodes().Update(ctx, node, metav1.UpdateOptions{})
 		return updateErr
 	})
 	if retryErr != nil {
-		fmt.Printf("Update failed: %v", retryErr)
+		loggerFrom(ctx).Error("Updating node failed", logKeyError, retryErr)
 		return retryErr
 	}
-	fmt.Printf("Node %s cordoned\n", nodeName)
-
-	return nil
-}
-
-func evictPod(clientset *kubernetes.Clientset, pod corev1.Pod) error {
-	if err := clientset.CoreV1().Pods(pod.Namespace).Evict(context.Background(), &policyv1beta1.Eviction{
-		ObjectMeta:    metav1.ObjectMeta{Namespace: pod.Namespace, Name: pod.Name},
-		DeleteOptions: &metav1.DeleteOptions{},
-	}); err != nil && !errors.IsNotFound(err) {
-		fmt.Printf("Error evicting pod: %v\n", err)
-		return err
+	if unschedulable {
+		loggerFrom(ctx).Info("Node cordoned")
+	} else {
+		loggerFrom(ctx).Info("Node uncordoned")
 	}
-	fmt.Printf("Pod %s/%s evicted\n", pod.Namespace, pod.Name)
 
 	return nil
 }
 
-// restartDeployment restarts the deployment of a pod
-func restartDeployment(clientset *kubernetes.Clientset, deployment appsv1.Deployment) error {
+// restartDeployment restarts the deployment of a pod and returns the generation of the deployment which the restart
+// results in
+func restartDeployment(ctx context.Context, clientset kubernetes.Interface, deployment appsv1.Deployment) (int64, error) {
 	// podOwnerRef := metav1.GetControllerOf(&pod)
 	// if podOwnerRef == nil {
 	// 	return fmt.Errorf("pod %s/%s has no owner", pod.Namespace, pod.Name)
@@ -129,11 +159,14 @@ func restartDeployment(clientset *kubernetes.Clientset, deployment appsv1.Deploy
 	// }
 
 	data := fmt.Sprintf(`{"spec": {"template": {"metadata": {"annotations": {"kubectl.kubernetes.io/restartedAt": "%s"}}}}}`, time.Now().Format("20060102150405"))
-	result, err := clientset.AppsV1().Deployments(deployment.Namespace).Patch(context.Background(), deployment.Name, types.StrategicMergePatchType, []byte(data), metav1.PatchOptions{})
+	patched, err := clientset.AppsV1().Deployments(deployment.Namespace).Patch(ctx, deployment.Name, types.StrategicMergePatchType, []byte(data), metav1.PatchOptions{})
 	if err != nil {
-		fmt.Printf("Error patching deployment %s/%s, result: %s, %v\n", deployment.Namespace, deployment.Name, result, err)
-		return err
+		loggerFrom(ctx).Error("Error patching deployment", "deployment", deployment.Name, logKeyNamespace, deployment.Namespace, logKeyError, err)
+		return 0, err
 	}
+	loggerFrom(ctx).Info("Deployment rollout restarted", "deployment", deployment.Name, logKeyNamespace, deployment.Namespace)
+	deploymentRestartsTotal.Inc()
+	eventsFrom(ctx).event(&deployment, corev1.EventTypeNormal, eventReasonRolloutRestarted, "Deployment has been rollout-restarted to move its pods off a drained node")
 
 	// // Wait for pod to terminate
 	// for {
@@ -147,7 +180,7 @@ func restartDeployment(clientset *kubernetes.Clientset, deployment appsv1.Deploy
 	// 	}
 	// }
 
-	return nil
+	return patched.Generation, nil
 }
 
 // Get the nodepool ID of the selected node
@@ -158,123 +191,230 @@ func getNodepoolId(node corev1.Node) (string, error) {
 	if exists {
 		sksNodepoolId = labelValue
 	} else {
-		errMsg := fmt.Sprintf("Label '%s' does not exist on the node", labelKey)
-		fmt.Println(errMsg)
-		return "", fmt.Errorf(errMsg)
+		return "", fmt.Errorf("label '%s' does not exist on the node", labelKey)
 	}
 
 	return sksNodepoolId, nil
 }
 
-// Get the nodepool of the selected node
-func getNodepool(egoclient *egoscalev2.Client, ctx context.Context, sksClusterId string, sksNodepoolId string) (egoscalev2.SKSNodepool, error) {
-	getSksNodepoolResponse, err := egoclient.GetSksNodepoolWithResponse(ctx, sksClusterId, sksNodepoolId)
+// Wait until the nodepool has the given size, all of its instances are running and all of its nodes are ready.
+// The nodepool is polled from the Exoscale API, the nodes are read from the watcher.
+func waitNodepoolScaled(ctx context.Context, watcher *clusterWatcher, provider SKSProvider, sksNodepoolId string, size int64, timeout time.Duration) error {
+	ctx, cancel := withTimeout(ctx, timeout)
+	defer cancel()
+
+	loggerFrom(ctx).Info("Waiting for nodepool to have running and ready nodes", "size", size)
+	err := wait.PollUntilContextCancel(ctx, pollInterval, true, func(ctx context.Context) (bool, error) {
+		ready, err := nodepoolScaled(ctx, watcher, provider, sksNodepoolId, size)
+		if err == nil && !ready {
+			loggerFrom(ctx).Debug("Nodepool is not scaled yet", "retry_in", pollInterval)
+		}
+		return ready, err
+	})
+	if wait.Interrupted(err) {
+		return fmt.Errorf("nodepool did not have %d running and ready nodes within %s: %w", size, timeout, err)
+	}
 	if err != nil {
-		fmt.Printf("%s", err)
-		return egoscalev2.SKSNodepool{}, err
+		return err
 	}
 
-	var sksNodepool egoscalev2.SKSNodepool
-	if err := json.Unmarshal([]byte(getSksNodepoolResponse.Body), &sksNodepool); err != nil {
-		fmt.Printf("Error occurred during unmarshaling. Error: %s", err)
-		return egoscalev2.SKSNodepool{}, err
+	loggerFrom(ctx).Info("Nodepool has running and ready nodes", "size", size)
+	return nil
+}
+
+func nodepoolScaled(ctx context.Context, watcher *clusterWatcher, provider SKSProvider, sksNodepoolId string, size int64) (bool, error) {
+	sksNodepool, err := provider.GetNodepool(ctx, sksNodepoolId)
+	if err != nil {
+		return false, exoscaleError(err)
+	}
+	if sksNodepool.State == nil || *sksNodepool.State != "running" {
+		return false, nil
 	}
 
-	return sksNodepool, nil
-}
+	instances, err := provider.ListNodepoolInstances(ctx, sksNodepool)
+	if err != nil {
+		return false, exoscaleError(err)
+	}
+	if int64(len(instances)) < size {
+		return false, nil
+	}
 
-// Scale the nodepool of the selected node
-func scaleNodepool(egoclient *egoscalev2.Client, ctx context.Context, _ corev1.Node, sksClusterId string, sksNodepoolId string) error {
+	runningInstances := make(map[string]bool)
+	for _, instance := range instances {
+		if instance.State == nil || *instance.State != "running" {
+			return false, nil
+		}
+		runningInstances[*instance.ID] = true
+	}
 
-	// Get nodepool of the selected node
-	sksNodepool, err := getNodepool(egoclient, ctx, sksClusterId, sksNodepoolId)
+	// Each running instance has to be registered as a ready node in the cluster
+	nodes, err := watcher.nodes.List(labels.SelectorFromSet(labels.Set{nodeLabelNodepoolId: sksNodepoolId}))
 	if err != nil {
-		fmt.Printf("Error while trying to get nodepool: %s", err)
-		return err
+		return false, kubernetesError(err)
 	}
 
-	// Scale nodepool + 1
-	sksNodepoolSizeNext := (*sksNodepool.Size + 1)
-	_, err = egoclient.ScaleSksNodepoolWithResponse(ctx, sksClusterId, sksNodepoolId, egoscalev2oapi.ScaleSksNodepoolJSONRequestBody{
-		Size: sksNodepoolSizeNext,
-	})
+	var readyNodes int64 = 0
+	for _, node := range nodes {
+		if runningInstances[node.Status.NodeInfo.SystemUUID] && nodeReady(*node) {
+			readyNodes += 1
+		}
+	}
+
+	return readyNodes >= size, nil
+}
+
+// Get the IDs of the instances which are members of the nodepool
+func nodepoolInstanceIds(ctx context.Context, provider SKSProvider, sksNodepool *egoscalev2.SKSNodepool) (map[string]bool, error) {
+	instances, err := provider.ListNodepoolInstances(ctx, sksNodepool)
 	if err != nil {
-		fmt.Printf("Error while trying to scale nodepool '%s': %s", sksNodepoolId, err)
-		return err
+		return nil, err
 	}
 
-	return nil
+	ids := make(map[string]bool)
+	for _, instance := range instances {
+		if instance.ID != nil {
+			ids[*instance.ID] = true
+		}
+	}
+	return ids, nil
 }
 
-func nodeHasRunningJobs(clientset *kubernetes.Clientset, nodeName string) (bool, error) {
-	pods, err := clientset.CoreV1().Pods("").List(context.Background(), metav1.ListOptions{
+// List all pods which are scheduled on the given node
+func listNodePods(ctx context.Context, clientset kubernetes.Interface, nodeName string) ([]corev1.Pod, error) {
+	pods, err := clientset.CoreV1().Pods("").List(ctx, metav1.ListOptions{
 		FieldSelector: "spec.nodeName=" + nodeName,
 	})
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 
+	// Not every client honors field selectors, so the result is filtered once more
+	nodePods := make([]corev1.Pod, 0, len(pods.Items))
 	for _, pod := range pods.Items {
-		if pod.Labels["batch.kubernetes.io/job-name"] != "" && pod.Status.Phase == corev1.PodRunning {
-			return true, nil
+		if pod.Spec.NodeName == nodeName {
+			nodePods = append(nodePods, pod)
 		}
 	}
 
-	return false, nil
+	return nodePods, nil
 }
 
-// Wait until pods are healthy in the cluster
-func waitPodsRunning(clientset *kubernetes.Clientset) error {
-	fmt.Printf("Waiting for pods to be running.\n")
-	pods, err := clientset.CoreV1().Pods("").List(context.Background(), metav1.ListOptions{})
+// Get the deployment which manages the pod through a replicaSet, or nil if the pod is not managed by a deployment
+func getPodDeployment(ctx context.Context, clientset kubernetes.Interface, pod corev1.Pod) (*appsv1.Deployment, error) {
+	podOwnerRef := metav1.GetControllerOf(&pod)
+	if podOwnerRef == nil || podOwnerRef.Kind != "ReplicaSet" {
+		return nil, nil
+	}
+
+	replicaSet, err := clientset.AppsV1().ReplicaSets(pod.Namespace).Get(ctx, podOwnerRef.Name, metav1.GetOptions{})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// Wait for all pods to be running
-	for _, pod := range pods.Items {
-		for {
-			if PodRunningOrSucceeded(pod) {
-				break
-			}
-			time.Sleep(5 * time.Second)
-			podObj, err := clientset.CoreV1().Pods(pod.Namespace).Get(context.Background(), pod.Name, metav1.GetOptions{})
-			if err != nil {
-				return err
-			}
-			pod = *podObj
-		}
+	replicaSetOwnerRef := metav1.GetControllerOf(replicaSet)
+	if replicaSetOwnerRef == nil || replicaSetOwnerRef.Kind != "Deployment" {
+		return nil, nil
 	}
 
-	return nil
+	return clientset.AppsV1().Deployments(pod.Namespace).Get(ctx, replicaSetOwnerRef.Name, metav1.GetOptions{})
 }
 
-// Wait until all nodes are ready in the cluster
-func waitNodesReady(clientset *kubernetes.Clientset) error {
-	nodes, err := clientset.CoreV1().Nodes().List(context.Background(), metav1.ListOptions{})
+// Check if the node has to be replaced, either because its kubelet is older than the desired version or because it matches the label selector
+func nodeSelected(node corev1.Node, desiredK8sVersion *version.Version, labelSelectedNodes map[string]bool) (bool, string) {
+	kubeletVersion, err := version.ParseGeneric(node.Status.NodeInfo.KubeletVersion)
 	if err != nil {
-		return err
+		return false, fmt.Sprintf("kubelet version '%s' cannot be parsed", node.Status.NodeInfo.KubeletVersion)
+	}
+
+	if kubeletVersion.LessThan(desiredK8sVersion) {
+		return true, fmt.Sprintf("version %s is older than the desired version %s", node.Status.NodeInfo.KubeletVersion, kubeletVersionString(desiredK8sVersion))
+	}
+
+	if labelSelectedNodes[node.Name] {
+		return true, "matches evictNodesLabelSelector"
+	}
+
+	if desiredK8sVersion.LessThan(kubeletVersion) {
+		return false, fmt.Sprintf("version %s is newer than the desired version %s", node.Status.NodeInfo.KubeletVersion, kubeletVersionString(desiredK8sVersion))
+	}
+	return false, fmt.Sprintf("already on desired version %s", kubeletVersionString(desiredK8sVersion))
+}
+
+// List the names of the nodes which match the label selector. The selector supports the full Kubernetes
+// syntax (=, !=, in, notin, exists and !exists) with all requirements ANDed, and is evaluated by the API server.
+func listLabelSelectedNodes(ctx context.Context, clientset kubernetes.Interface, labelSelector string) (map[string]bool, error) {
+	selectedNodes := make(map[string]bool)
+	if strings.TrimSpace(labelSelector) == "" {
+		return selectedNodes, nil
+	}
+
+	selector, err := labels.Parse(labelSelector)
+	if err != nil {
+		return nil, configError("invalid evictNodesLabelSelector '%s': %w", labelSelector, err)
+	}
+
+	nodes, err := clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{
+		LabelSelector: selector.String(),
+	})
+	if err != nil {
+		return nil, kubernetesError(err)
 	}
 
-	// Wait for all nodes to be ready
-	fmt.Printf("Waiting for nodes to be ready...\n")
 	for _, node := range nodes.Items {
-		for {
-			if nodeReady(node) && kubeSystemPodsReady(clientset, node.Name){
-				break
-			}
+		selectedNodes[node.Name] = true
+	}
+
+	return selectedNodes, nil
+}
+
+func nodeHasRunningJobs(ctx context.Context, clientset kubernetes.Interface, nodeName string) (bool, error) {
+	pods, err := listNodePods(ctx, clientset, nodeName)
+	if err != nil {
+		return false, err
+	}
+
+	for _, pod := range pods {
+		if pod.Labels["batch.kubernetes.io/job-name"] != "" && pod.Status.Phase == corev1.PodRunning {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Wait until all nodes are ready in the cluster, re-checking whenever a node or pod changes
+func waitNodesReady(ctx context.Context, watcher *clusterWatcher, timeout time.Duration) error {
+	ctx, cancel := withTimeout(ctx, timeout)
+	defer cancel()
+
+	loggerFrom(ctx).Info("Waiting for nodes to be ready")
+	var waitingFor string
+	err := watcher.waitFor(ctx, func() (bool, error) {
+		nodes, err := watcher.nodes.List(labels.Everything())
+		if err != nil {
+			return false, err
+		}
+		sort.Slice(nodes, func(i, j int) bool {
+			return nodes[i].Name < nodes[j].Name
+		})
 
-			fmt.Printf("Node %s is not ready yet. Sleeping for 15 seconds.\n", node.Name)
-			time.Sleep(15 * time.Second)
-			nodeObj, err := clientset.CoreV1().Nodes().Get(context.Background(), node.Name, metav1.GetOptions{})
-			if err != nil {
-				return err
+		for _, node := range nodes {
+			if nodeReady(*node) && kubeSystemPodsReady(watcher, node.Name) {
+				continue
 			}
-			node = *nodeObj
+			if waitingFor != node.Name {
+				loggerFrom(ctx).Info("Node is not ready yet", "waiting_for_node", node.Name)
+				waitingFor = node.Name
+			}
+			return false, nil
 		}
+		return true, nil
+	})
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("node %s is not ready after %s: %w", waitingFor, timeout, err)
 	}
 
-	return nil
+	return err
 }
 
 func nodeReady(node corev1.Node) bool {
@@ -286,15 +426,13 @@ func nodeReady(node corev1.Node) bool {
 	return false
 }
 
-func kubeSystemPodsReady(clientset *kubernetes.Clientset, nodeName string) bool {
-	pods, err := clientset.CoreV1().Pods("").List(context.Background(), metav1.ListOptions{
-		FieldSelector: "spec.nodeName=" + nodeName,
-	})
+func kubeSystemPodsReady(watcher *clusterWatcher, nodeName string) bool {
+	pods, err := watcher.nodePods(nodeName)
 	if err != nil {
 		return false
 	}
 
-	for _, pod := range pods.Items {
+	for _, pod := range pods {
 		if pod.Namespace == "kube-system" && (pod.Status.Phase != corev1.PodRunning && pod.Status.Phase != corev1.PodSucceeded) {
 			return false
 		}
@@ -307,20 +445,3 @@ func kubeSystemPodsReady(clientset *kubernetes.Clientset, nodeName string) bool
 func PodRunningOrSucceeded(pod corev1.Pod) bool {
 	return (pod.Status.Phase == corev1.PodRunning || pod.Status.Phase == corev1.PodSucceeded)
 }
-
-func parseLabelSelector(labelSelector string) map[string]string {
-	labels := make(map[string]string)
-	
-	// Split the input by commas to get individual key-value pairs
-	pairs := strings.Split(labelSelector, ",")
-	for _, pair := range pairs {
-			// Split each pair by '=' to separate key and value
-			kv := strings.SplitN(pair, "=", 2)
-			if len(kv) == 2 {
-					key := strings.TrimSpace(kv[0])
-					value := strings.TrimSpace(kv[1])
-					labels[key] = value
-			}
-	}
-	return labels
-}
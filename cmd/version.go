@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	egoscalev2 "github.com/exoscale/egoscale/v2"
+	"k8s.io/apimachinery/pkg/util/version"
+)
+
+const (
+	// Use the Kubernetes version of the SKS control plane as the desired version
+	desiredVersionControlPlane string = "control-plane"
+	// Use the most recent Kubernetes version available for SKS clusters as the desired version
+	desiredVersionLatest string = "latest"
+)
+
+// Resolve the configured desired version to a concrete Kubernetes version. Besides a version like "v1.29.3",
+// "control-plane" (the version of the SKS cluster) and "latest" (the most recent SKS version) are accepted.
+func resolveDesiredVersion(ctx context.Context, provider SKSProvider, sksCluster *egoscalev2.SKSCluster, desiredK8sVersion string) (*version.Version, error) {
+	switch desiredK8sVersion {
+	case desiredVersionControlPlane:
+		if sksCluster.Version == nil {
+			return nil, exoscaleError(fmt.Errorf("cluster '%s' has no version", *sksCluster.ID))
+		}
+		desired, err := version.ParseGeneric(*sksCluster.Version)
+		if err != nil {
+			return nil, exoscaleError(fmt.Errorf("invalid control plane version '%s': %w", *sksCluster.Version, err))
+		}
+		return desired, nil
+
+	case desiredVersionLatest:
+		versions, err := provider.ListClusterVersions(ctx)
+		if err != nil {
+			return nil, exoscaleError(err)
+		}
+		return latestVersion(versions)
+
+	default:
+		desired, err := version.ParseGeneric(desiredK8sVersion)
+		if err != nil {
+			return nil, configError("invalid desired Kubernetes version '%s', expected a version, '%s' or '%s': %w", desiredK8sVersion, desiredVersionControlPlane, desiredVersionLatest, err)
+		}
+		return desired, nil
+	}
+}
+
+// Get the most recent of the given versions, versions which cannot be parsed are ignored
+func latestVersion(versions []string) (*version.Version, error) {
+	var latest *version.Version
+	for _, v := range versions {
+		parsed, err := version.ParseGeneric(v)
+		if err != nil {
+			continue
+		}
+		if latest == nil || latest.LessThan(parsed) {
+			latest = parsed
+		}
+	}
+	if latest == nil {
+		return nil, exoscaleError(fmt.Errorf("no SKS cluster version is available"))
+	}
+
+	return latest, nil
+}
+
+// Format a version the way kubelets report it, e.g. "v1.29.3"
+func kubeletVersionString(v *version.Version) string {
+	return "v" + v.String()
+}
+
+// Check whether two versions are equal, ignoring pre-release and build metadata
+func versionsEqual(a *version.Version, b *version.Version) bool {
+	return !a.LessThan(b) && !b.LessThan(a)
+}
@@ -0,0 +1,188 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Name of the index of the pod informer, which maps node names to the pods scheduled on them
+const podNodeNameIndex string = "spec.nodeName"
+
+// clusterWatcher serves the reads of a cycle from shared informers and wakes up waits whenever a watched object
+// changes, so waits react to changes right away instead of polling the API server.
+type clusterWatcher struct {
+	factory informers.SharedInformerFactory
+	cancel  context.CancelFunc
+
+	nodes        corelisters.NodeLister
+	pods         corelisters.PodLister
+	podIndexer   cache.Indexer
+	deployments  appslisters.DeploymentLister
+	replicaSets  appslisters.ReplicaSetLister
+	statefulSets appslisters.StatefulSetLister
+
+	// Version of the policy API which evictions and PodDisruptionBudgets are served with, detected once per run
+	policyVersion string
+
+	mu sync.Mutex
+	// Closed and replaced whenever a watched object changes
+	changed chan struct{}
+}
+
+// Start the informers and wait until their caches are synced. The watcher has to be stopped once it is not needed anymore.
+func startClusterWatcher(ctx context.Context, clientset kubernetes.Interface) (*clusterWatcher, error) {
+	factory := informers.NewSharedInformerFactory(clientset, 0)
+	w := &clusterWatcher{
+		factory:       factory,
+		nodes:         factory.Core().V1().Nodes().Lister(),
+		pods:          factory.Core().V1().Pods().Lister(),
+		deployments:   factory.Apps().V1().Deployments().Lister(),
+		replicaSets:   factory.Apps().V1().ReplicaSets().Lister(),
+		statefulSets:  factory.Apps().V1().StatefulSets().Lister(),
+		policyVersion: detectPolicyVersion(clientset),
+		changed:       make(chan struct{}),
+	}
+
+	podInformer := factory.Core().V1().Pods().Informer()
+	err := podInformer.AddIndexers(cache.Indexers{
+		podNodeNameIndex: func(obj any) ([]string, error) {
+			return []string{obj.(*corev1.Pod).Spec.NodeName}, nil
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	w.podIndexer = podInformer.GetIndexer()
+
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj any) { w.notify() },
+		UpdateFunc: func(oldObj, newObj any) { w.notify() },
+		DeleteFunc: func(obj any) { w.notify() },
+	}
+	for _, informer := range []cache.SharedIndexInformer{
+		podInformer,
+		factory.Core().V1().Nodes().Informer(),
+		factory.Apps().V1().Deployments().Informer(),
+		factory.Apps().V1().ReplicaSets().Informer(),
+		factory.Apps().V1().StatefulSets().Informer(),
+	} {
+		if _, err := informer.AddEventHandler(handler); err != nil {
+			return nil, err
+		}
+	}
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	w.cancel = cancel
+	factory.Start(watchCtx.Done())
+	for informerType, synced := range factory.WaitForCacheSync(watchCtx.Done()) {
+		if !synced {
+			w.stop()
+			return nil, fmt.Errorf("cache of %s informer could not be synced", informerType)
+		}
+	}
+
+	return w, nil
+}
+
+// Stop the informers and wait for them to terminate
+func (w *clusterWatcher) stop() {
+	w.cancel()
+	w.factory.Shutdown()
+}
+
+func (w *clusterWatcher) notify() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	close(w.changed)
+	w.changed = make(chan struct{})
+}
+
+// Get a channel which is closed on the next change of a watched object. It has to be taken before the state is
+// read, so no change between reading and waiting is missed.
+func (w *clusterWatcher) changes() <-chan struct{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.changed
+}
+
+// Wait for the next change of a watched object
+func waitForChange(ctx context.Context, changed <-chan struct{}) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-changed:
+		return nil
+	}
+}
+
+// Wait until the condition holds. It is evaluated right away and again whenever a watched object changes, until it
+// returns true or an error, or the context is done.
+func (w *clusterWatcher) waitFor(ctx context.Context, condition func() (bool, error)) error {
+	for {
+		changed := w.changes()
+		done, err := condition()
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+		if err := waitForChange(ctx, changed); err != nil {
+			return err
+		}
+	}
+}
+
+// List the pods which are scheduled on the node
+func (w *clusterWatcher) nodePods(nodeName string) ([]corev1.Pod, error) {
+	objs, err := w.podIndexer.ByIndex(podNodeNameIndex, nodeName)
+	if err != nil {
+		return nil, err
+	}
+
+	pods := make([]corev1.Pod, 0, len(objs))
+	for _, obj := range objs {
+		pods = append(pods, *obj.(*corev1.Pod))
+	}
+	// The index has no order, pods are handled in the same order on every pass
+	sort.Slice(pods, func(i, j int) bool {
+		if pods[i].Namespace != pods[j].Namespace {
+			return pods[i].Namespace < pods[j].Namespace
+		}
+		return pods[i].Name < pods[j].Name
+	})
+	return pods, nil
+}
+
+// Get the deployment which manages the pod through a replicaSet, or nil if the pod is not managed by a deployment
+func (w *clusterWatcher) podDeployment(pod corev1.Pod) (*appsv1.Deployment, error) {
+	podOwnerRef := metav1.GetControllerOf(&pod)
+	if podOwnerRef == nil || podOwnerRef.Kind != "ReplicaSet" {
+		return nil, nil
+	}
+
+	replicaSet, err := w.replicaSets.ReplicaSets(pod.Namespace).Get(podOwnerRef.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	replicaSetOwnerRef := metav1.GetControllerOf(replicaSet)
+	if replicaSetOwnerRef == nil || replicaSetOwnerRef.Kind != "Deployment" {
+		return nil, nil
+	}
+
+	return w.deployments.Deployments(pod.Namespace).Get(replicaSetOwnerRef.Name)
+}
@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestWaitNodesReadyReactsToNodeChange(t *testing.T) {
+	ctx := context.Background()
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-1"},
+		Status: corev1.NodeStatus{
+			Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: corev1.ConditionFalse}},
+		},
+	}
+	clientset := fake.NewSimpleClientset(node)
+
+	watcher, err := startClusterWatcher(ctx, clientset)
+	if err != nil {
+		t.Fatalf("startClusterWatcher() error = %v", err)
+	}
+	defer watcher.stop()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- waitNodesReady(ctx, watcher, time.Minute)
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("waitNodesReady() returned %v before the node was ready", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	node.Status.Conditions[0].Status = corev1.ConditionTrue
+	if _, err := clientset.CoreV1().Nodes().UpdateStatus(ctx, node, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("waitNodesReady() error = %v, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waitNodesReady() did not return after the node became ready")
+	}
+}
+
+func TestWaitForStopsAtDeadline(t *testing.T) {
+	watcher, err := startClusterWatcher(context.Background(), fake.NewSimpleClientset())
+	if err != nil {
+		t.Fatalf("startClusterWatcher() error = %v", err)
+	}
+	defer watcher.stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	err = watcher.waitFor(ctx, func() (bool, error) {
+		return false, nil
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("waitFor() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
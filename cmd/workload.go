@@ -0,0 +1,198 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// errWorkloadTimeout is returned when a workload whose pods have been moved off a node does not become available in time
+var errWorkloadTimeout = errors.New("timed out waiting for workload to become available")
+
+// workloadRef identifies a workload whose pods have been moved off a node while draining it
+type workloadRef struct {
+	kind      string
+	namespace string
+	name      string
+}
+
+func (w workloadRef) String() string {
+	return w.kind + " " + w.namespace + "/" + w.name
+}
+
+// Get the workload which has to become available again once the pod has been evicted, if there is one.
+// Pods of Deployments, standalone ReplicaSets and StatefulSets are considered, all other pods are not recreated
+// by a controller with a desired number of replicas.
+func podWorkload(watcher *clusterWatcher, pod corev1.Pod) (*workloadRef, error) {
+	podOwnerRef := metav1.GetControllerOf(&pod)
+	if podOwnerRef == nil {
+		return nil, nil
+	}
+
+	switch podOwnerRef.Kind {
+	case "ReplicaSet":
+		deployment, err := watcher.podDeployment(pod)
+		if err != nil {
+			return nil, err
+		}
+		if deployment != nil {
+			return &workloadRef{kind: "Deployment", namespace: deployment.Namespace, name: deployment.Name}, nil
+		}
+		return &workloadRef{kind: "ReplicaSet", namespace: pod.Namespace, name: podOwnerRef.Name}, nil
+	case "StatefulSet":
+		return &workloadRef{kind: "StatefulSet", namespace: pod.Namespace, name: podOwnerRef.Name}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// Check whether the workload has finished rolling out its desired number of replicas, the way kubectl rollout status
+// does: the controller has observed the latest generation, all replicas are updated and the updated replicas are
+// available. The controller has to have observed at least the given generation, which the informers of the watcher may
+// not know of yet, e.g. right after a restart. If it has not, the returned message tells what is still missing.
+func workloadRolledOut(watcher *clusterWatcher, workload workloadRef, generation int64) (bool, string, error) {
+	switch workload.kind {
+	case "Deployment":
+		deployment, err := watcher.deployments.Deployments(workload.namespace).Get(workload.name)
+		if err != nil {
+			return false, "", err
+		}
+		rolledOut, message := deploymentRolledOut(deployment, generation)
+		return rolledOut, message, nil
+	case "ReplicaSet":
+		replicaSet, err := watcher.replicaSets.ReplicaSets(workload.namespace).Get(workload.name)
+		if err != nil {
+			return false, "", err
+		}
+		rolledOut, message := replicaSetRolledOut(replicaSet, generation)
+		return rolledOut, message, nil
+	case "StatefulSet":
+		statefulSet, err := watcher.statefulSets.StatefulSets(workload.namespace).Get(workload.name)
+		if err != nil {
+			return false, "", err
+		}
+		rolledOut, message := statefulSetRolledOut(statefulSet, generation)
+		return rolledOut, message, nil
+	default:
+		return false, "", fmt.Errorf("unsupported workload kind '%s'", workload.kind)
+	}
+}
+
+func deploymentRolledOut(deployment *appsv1.Deployment, generation int64) (bool, string) {
+	desired := replicasOrDefault(deployment.Spec.Replicas)
+	status := deployment.Status
+	switch {
+	case max(deployment.Generation, generation) > status.ObservedGeneration:
+		return false, "the latest generation has not been observed yet"
+	case status.UpdatedReplicas < desired:
+		return false, fmt.Sprintf("%d of %d replicas are updated", status.UpdatedReplicas, desired)
+	case status.Replicas > status.UpdatedReplicas:
+		return false, fmt.Sprintf("%d old replicas are pending termination", status.Replicas-status.UpdatedReplicas)
+	case status.AvailableReplicas < status.UpdatedReplicas:
+		return false, fmt.Sprintf("%d of %d updated replicas are available", status.AvailableReplicas, status.UpdatedReplicas)
+	}
+	return true, fmt.Sprintf("%d of %d replicas are available", status.AvailableReplicas, desired)
+}
+
+func replicaSetRolledOut(replicaSet *appsv1.ReplicaSet, generation int64) (bool, string) {
+	desired := replicasOrDefault(replicaSet.Spec.Replicas)
+	status := replicaSet.Status
+	switch {
+	case max(replicaSet.Generation, generation) > status.ObservedGeneration:
+		return false, "the latest generation has not been observed yet"
+	case status.AvailableReplicas < desired:
+		return false, fmt.Sprintf("%d of %d replicas are available", status.AvailableReplicas, desired)
+	}
+	return true, fmt.Sprintf("%d of %d replicas are available", status.AvailableReplicas, desired)
+}
+
+// StatefulSets with the OnDelete update strategy only update pods which are deleted, their revisions are not
+// compared, as they may legitimately differ for as long as nobody deletes the pods.
+func statefulSetRolledOut(statefulSet *appsv1.StatefulSet, generation int64) (bool, string) {
+	desired := statefulSetReplicas(statefulSet)
+	status := statefulSet.Status
+	switch {
+	case max(statefulSet.Generation, generation) > status.ObservedGeneration:
+		return false, "the latest generation has not been observed yet"
+	case status.ReadyReplicas < desired:
+		return false, fmt.Sprintf("%d of %d replicas are ready", status.ReadyReplicas, desired)
+	}
+
+	strategy := statefulSet.Spec.UpdateStrategy
+	if strategy.Type != appsv1.OnDeleteStatefulSetStrategyType {
+		if strategy.RollingUpdate != nil && strategy.RollingUpdate.Partition != nil && *strategy.RollingUpdate.Partition > 0 {
+			if updated := desired - *strategy.RollingUpdate.Partition; status.UpdatedReplicas < updated {
+				return false, fmt.Sprintf("%d of %d replicas are updated", status.UpdatedReplicas, updated)
+			}
+		} else if status.UpdateRevision != status.CurrentRevision {
+			return false, fmt.Sprintf("%d of %d replicas are updated to revision %s", status.UpdatedReplicas, desired, status.UpdateRevision)
+		}
+	}
+	return true, fmt.Sprintf("%d of %d replicas are ready", status.ReadyReplicas, desired)
+}
+
+func replicasOrDefault(replicas *int32) int32 {
+	if replicas == nil {
+		return 1
+	}
+	return *replicas
+}
+
+// Wait until each of the workloads has rolled out its desired number of replicas again. Every workload gets the full
+// timeout, a timeout of 0 disables waiting. Each controller has to have observed at least the generation the workload
+// maps to.
+func waitWorkloadsAvailable(ctx context.Context, watcher *clusterWatcher, workloads map[workloadRef]int64, timeout time.Duration) error {
+	if timeout == 0 {
+		return nil
+	}
+
+	refs := make([]workloadRef, 0, len(workloads))
+	for workload := range workloads {
+		refs = append(refs, workload)
+	}
+	sort.Slice(refs, func(i, j int) bool {
+		return refs[i].String() < refs[j].String()
+	})
+
+	for _, workload := range refs {
+		if err := waitWorkloadAvailable(ctx, watcher, workload, workloads[workload], timeout); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func waitWorkloadAvailable(ctx context.Context, watcher *clusterWatcher, workload workloadRef, generation int64, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var message string
+	err := watcher.waitFor(ctx, func() (bool, error) {
+		var rolledOut bool
+		var err error
+		rolledOut, message, err = workloadRolledOut(watcher, workload, generation)
+		if err != nil {
+			return false, err
+		}
+		if !rolledOut {
+			loggerFrom(ctx).Debug("Workload is not available yet", "workload", workload.String(), "status", message)
+		}
+		return rolledOut, nil
+	})
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %s: %s", errWorkloadTimeout, workload, message)
+	}
+	if err != nil {
+		return err
+	}
+
+	loggerFrom(ctx).Info("Workload is available", "workload", workload.String(), "status", message)
+	return nil
+}